@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 
 	"github.com/jukuly/ss_machmos/server/internal/api"
@@ -10,6 +13,8 @@ import (
 	"github.com/jukuly/ss_machmos/server/internal/model"
 	"github.com/jukuly/ss_machmos/server/internal/out"
 	"github.com/jukuly/ss_machmos/server/internal/server"
+	"github.com/jukuly/ss_machmos/server/internal/simulator"
+	"github.com/jukuly/ss_machmos/server/internal/transport"
 )
 
 func serve() {
@@ -22,16 +27,31 @@ func serve() {
 	}
 
 	out.Logger.Println("Loading local config...")
-	var sensors *[]model.Sensor = &[]model.Sensor{}
+	var sensors *model.SensorRegistry = model.NewSensorRegistry(model.SENSORS_FILE)
+	var groups *model.GroupRegistry = model.NewGroupRegistry(model.GROUPS_FILE)
+	var profiles *model.ProfileRegistry = model.NewProfileRegistry(model.PROFILES_FILE)
 	var gateway *model.Gateway = &model.Gateway{}
-	model.LoadSensors(model.SENSORS_FILE, sensors)
-	err = model.LoadSettings(gateway, model.GATEWAY_FILE)
+	err = sensors.Load()
+	if err == nil {
+		err = groups.Load()
+	}
+	if err == nil {
+		err = profiles.Load()
+	}
 	if err != nil {
+		out.Logger.Println("Error:", err)
+		os.Exit(1)
+	}
+	err = model.LoadSettings(gateway, model.GATEWAY_FILE)
+	if errors.Is(err, os.ErrNotExist) {
 		out.Logger.Println("Error loading Gateway settings. Run 'ssmachmos config --id <gateway-id>' and 'ssmachmos config --password <gateway-password>' to set the Gateway settings.")
+	} else if err != nil {
+		out.Logger.Println("Error:", err)
+		os.Exit(1)
 	}
 
 	out.Logger.Println("Starting bluetooth advertisement...")
-	err = server.Init(sensors, gateway)
+	err = server.Init(sensors, groups, profiles, gateway, transport.NewBluetooth())
 	if err != nil {
 		out.Logger.Println("Error:", err)
 	} else {
@@ -41,6 +61,15 @@ func serve() {
 		}
 	}
 
+	if gateway.APIAddress != "" {
+		out.Logger.Println("Starting HTTP API...")
+		apiErr := api.StartHTTP(gateway.APIAddress)
+		if apiErr != nil {
+			out.Logger.Println("Error:", apiErr)
+			err = apiErr
+		}
+	}
+
 	if err == nil {
 		out.Logger.Println("Done initializing server.")
 	} else {
@@ -49,6 +78,77 @@ func serve() {
 	api.Start()
 }
 
+func simulate(options []string, args []string) {
+	count := 50
+	wakeUpInterval := 60
+	wakeUpIntervalMaxOffset := 10
+	for i, option := range options {
+		if i >= len(args) {
+			fmt.Println("Usage: ssmachmos simulate [--sensors <count>] [--interval <seconds>] [--offset <seconds>]")
+			return
+		}
+		value, err := strconv.Atoi(args[i])
+		if err != nil || value < 0 {
+			fmt.Printf("Invalid value for option %s: %s\n", option, args[i])
+			return
+		}
+		switch option {
+		case "--sensors":
+			count = value
+		case "--interval":
+			wakeUpInterval = value
+		case "--offset":
+			wakeUpIntervalMaxOffset = value
+		default:
+			fmt.Printf("Option %s does not exist for command simulate\n", option)
+			return
+		}
+	}
+	if wakeUpIntervalMaxOffset >= wakeUpInterval {
+		fmt.Println("The offset must be smaller than the interval")
+		return
+	}
+
+	// the simulation never touches the real sensors and gateway files, nor
+	// the control socket of a gateway running on the same machine
+	configDir, err := os.MkdirTemp("", "ss_machmos_simulation")
+	if err != nil {
+		out.Logger.Println("Error:", err)
+		return
+	}
+	model.SetConfigDir(configDir)
+
+	endpoint, err := simulator.StartEndpoint()
+	if err != nil {
+		out.Logger.Println("Error:", err)
+		return
+	}
+	var sensors *model.SensorRegistry = model.NewSensorRegistry(model.SENSORS_FILE)
+	var groups *model.GroupRegistry = model.NewGroupRegistry(model.GROUPS_FILE)
+	var profiles *model.ProfileRegistry = model.NewProfileRegistry(model.PROFILES_FILE)
+	var gateway *model.Gateway = &model.Gateway{
+		Id:     "simulation",
+		Sinks:  []model.Sink{{Name: "openphm", Type: "openphm", URL: endpoint}},
+		Socket: model.SocketSettings{Path: path.Join(configDir, "ssmachmos.sock")},
+	}
+
+	out.Logger.Println("Starting simulated bluetooth advertisement...")
+	ble := transport.NewMemory()
+	err = server.Init(sensors, groups, profiles, gateway, ble)
+	if err == nil {
+		err = server.StartAdvertising()
+	}
+	if err != nil {
+		out.Logger.Println("Error:", err)
+		return
+	}
+
+	out.Logger.Println("Simulating " + strconv.Itoa(count) + " sensors...")
+	go simulator.Run(ble, count, wakeUpInterval, wakeUpIntervalMaxOffset)
+	out.Logger.Println("Run the commands against the simulation with " + model.SOCKET_PATH_ENV + "=" + model.GetSocketPath(gateway) + " ssmachmos <command>")
+	api.Start()
+}
+
 func main() {
 
 	// the user must provide at least one argument (the command)
@@ -102,6 +202,11 @@ func main() {
 		return
 	}
 
+	if as[0] == "simulate" {
+		simulate(options, args)
+		return
+	}
+
 	if as[0] == "help" {
 		cli.Help(args)
 		return
@@ -120,9 +225,11 @@ func main() {
 	case "logs":
 		cli.Logs(conn)
 	case "list":
-		cli.List(conn)
+		cli.List(options, args, conn)
 	case "view":
 		cli.View(options, args, conn)
+	case "schedule":
+		cli.Schedule(options, args, conn)
 	case "pair":
 		cli.Pair(args, conn)
 	case "forget":
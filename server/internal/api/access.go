@@ -0,0 +1,136 @@
+package api
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/server"
+)
+
+type role int
+
+const (
+	ROLE_NONE role = iota
+	ROLE_READ_ONLY
+	ROLE_FULL
+)
+
+const ERR_FORBIDDEN = "forbidden"
+
+// the only commands of the read-only role
+var READ_ONLY_COMMANDS = map[string]bool{
+	"LIST":          true,
+	"VIEW":          true,
+	"LIST-GROUPS":   true,
+	"LIST-PROFILES": true,
+	"GET-SCHEDULE":  true,
+	"ADD-LOGGER":    true,
+	"REMOVE-LOGGER": true,
+}
+
+func contains(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// the primary group and the supplementary groups of the user
+func getGroups(uid uint32, gid uint32) []uint32 {
+	groups := []uint32{gid}
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return groups
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return groups
+	}
+	for _, id := range ids {
+		if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+			groups = append(groups, uint32(g))
+		}
+	}
+	return groups
+}
+
+// getRole checks the credentials of the process at the other end of the
+// socket against the allowlist of the gateway
+func getRole(conn net.Conn) (role, error) {
+	settings := model.GetSocketSettings(server.Gateway)
+	noAllowlist := len(settings.Users)+len(settings.Groups)+len(settings.ReadOnlyUsers)+len(settings.ReadOnlyGroups) == 0
+
+	uid, gid, err := getPeerCredentials(conn)
+	if err != nil {
+		// the file mode is the only protection where the credentials can't be read
+		if noAllowlist {
+			return ROLE_FULL, nil
+		}
+		return ROLE_NONE, err
+	}
+	if uid == 0 || uid == uint32(os.Getuid()) || contains(settings.Users, uid) {
+		return ROLE_FULL, nil
+	}
+	groups := getGroups(uid, gid)
+	for _, g := range groups {
+		if contains(settings.Groups, g) {
+			return ROLE_FULL, nil
+		}
+	}
+	if contains(settings.ReadOnlyUsers, uid) {
+		return ROLE_READ_ONLY, nil
+	}
+	for _, g := range groups {
+		if contains(settings.ReadOnlyGroups, g) {
+			return ROLE_READ_ONLY, nil
+		}
+	}
+	// other users allowed by the file mode can only look when nobody is listed
+	if noAllowlist {
+		return ROLE_READ_ONLY, nil
+	}
+	return ROLE_NONE, errors.New("uid " + strconv.FormatUint(uint64(uid), 10) + " is not allowed to use the socket")
+}
+
+// parses user:<name | uid> or group:<name | gid>
+func parsePeer(peer string) (uint32, bool, error) {
+	kind, name, found := strings.Cut(peer, ":")
+	if !found || name == "" {
+		return 0, false, errors.New("invalid peer " + peer + " (must be user:<name | uid> or group:<name | gid>)")
+	}
+	var id string
+	switch kind {
+	case "user":
+		id = name
+		if _, err := strconv.ParseUint(name, 10, 32); err != nil {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return 0, false, err
+			}
+			id = u.Uid
+		}
+	case "group":
+		id = name
+		if _, err := strconv.ParseUint(name, 10, 32); err != nil {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return 0, false, err
+			}
+			id = g.Gid
+		}
+	default:
+		return 0, false, errors.New("invalid peer " + peer + " (must be user:<name | uid> or group:<name | gid>)")
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, false, err
+	}
+	return uint32(n), kind == "group", nil
+}
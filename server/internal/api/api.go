@@ -2,8 +2,12 @@ package api
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"net"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 
 	"github.com/jukuly/ss_machmos/server/internal/model"
@@ -11,136 +15,341 @@ import (
 	"github.com/jukuly/ss_machmos/server/internal/server"
 )
 
-func handleCommand(command string, conn *net.Conn) string {
-	parts := strings.Split(command, " ")
-
-	if len(parts) == 0 {
-		return "ERR:empty command"
-	}
-	switch parts[0] {
+func handleCommand(command string, args []string, conn *net.Conn) model.Response {
+	switch command {
 	case "LIST":
-		res, err := list()
+		// <filter> <value> pairs
+		if len(args)%2 != 0 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
+		}
+		filters := map[string]string{}
+		for i := 0; i < len(args); i += 2 {
+			filters[args[i]] = args[i+1]
+		}
+		res, err := list(filters)
 		if err != nil {
 			out.Logger.Println("Error:", err)
-			return "ERR:LIST:" + err.Error()
+			return fail("LIST", ERR_FAILED, err)
 		}
-		return "OK:LIST:" + res
+		return ok("LIST", res)
 	case "VIEW":
-		if len(parts) < 2 {
-			return "ERR:not enough arguments"
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
 		}
-		res, err := view(parts[1])
+		res, err := view(args[0])
 		if err != nil {
 			out.Logger.Println("Error:", err)
-			return "ERR:VIEW:" + err.Error()
+			return fail("VIEW", ERR_FAILED, err)
 		}
-		return "OK:VIEW:" + res
+		return ok("VIEW", res)
 	case "PAIR-ENABLE":
-		out.PairingConnections[conn] = true
+		out.AddPairingConnection(conn)
 		pairEnable()
-		return "OK:PAIR-ENABLE:"
+		return ok("PAIR-ENABLE", "")
 	case "PAIR-DISABLE":
-		delete(out.PairingConnections, conn)
-		if len(out.PairingConnections) == 0 {
+		if out.RemovePairingConnection(conn) == 0 {
 			pairDisable()
 		}
-		return "OK:PAIR-DISABLE:"
+		return ok("PAIR-DISABLE", "")
 	case "PAIR-ACCEPT":
-		if len(parts) < 2 {
-			return "ERR:PAIR-ACCEPT:not enough arguments"
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
 		}
-		err := pairAccept(parts[1])
+		err := pairAccept(args[0])
 		if err != nil {
 			out.Logger.Println("Error:", err)
-			return "ERR:PAIR-ACCEPT:" + err.Error()
+			return fail("PAIR-ACCEPT", ERR_FAILED, err)
 		}
-		return "OK:PAIR-ACCEPT:"
+		return ok("PAIR-ACCEPT", "")
 	case "FORGET":
-		if len(parts) < 2 {
-			return "ERR:FORGET:not enough arguments"
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
 		}
-		err := forget(parts[1])
+		err := forget(args[0])
 		if err != nil {
 			out.Logger.Println("Error:", err)
-			return "ERR:FORGET:" + err.Error()
+			return fail("FORGET", ERR_FAILED, err)
 		}
-		return "OK:FORGET:"
+		return ok("FORGET", "")
 	case "GET-GATEWAY":
 		res, err := getGateway()
 		if err != nil {
 			out.Logger.Println("Error:", err)
-			return "ERR:GET-GATEWAY:" + err.Error()
+			return fail("GET-GATEWAY", ERR_FAILED, err)
+		}
+		return ok("GET-GATEWAY", res)
+	case "GET-QUEUE":
+		res, err := getQueue()
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("GET-QUEUE", ERR_FAILED, err)
 		}
-		return "OK:GET-GATEWAY:" + res
+		return ok("GET-QUEUE", res)
+	case "GET-SCHEDULE":
+		hours := ""
+		if len(args) > 0 {
+			hours = args[0]
+		}
+		res, err := getSchedule(hours)
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("GET-SCHEDULE", ERR_FAILED, err)
+		}
+		return ok("GET-SCHEDULE", res)
 	case "SET-GATEWAY-HTTP-ENDPOINT":
-		if len(parts) < 2 {
-			return "ERR:SET-GATEWAY-HTTP-ENDPOINT:not enough arguments"
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
 		}
 		var err error
-		if parts[1] == "default" {
-			err = model.SetGatewayHTTPEndpoint(server.Gateway, server.DEFAULT_GATEWAY_HTTP_ENDPOINT)
+		if args[0] == "default" {
+			err = server.SetHTTPEndpoint(server.DEFAULT_GATEWAY_HTTP_ENDPOINT)
 		} else {
-			err = model.SetGatewayHTTPEndpoint(server.Gateway, parts[1])
+			err = server.SetHTTPEndpoint(args[0])
+		}
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("SET-GATEWAY-HTTP-ENDPOINT", ERR_FAILED, err)
+		}
+		return ok("SET-GATEWAY-HTTP-ENDPOINT", "")
+	case "ADD-SINK":
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
+		}
+		err := addSink(strings.Join(args, " "))
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("ADD-SINK", ERR_FAILED, err)
+		}
+		return ok("ADD-SINK", "")
+	case "REMOVE-SINK":
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
+		}
+		err := server.RemoveSink(args[0])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("REMOVE-SINK", ERR_FAILED, err)
+		}
+		return ok("REMOVE-SINK", "")
+	case "SET-GATEWAY-API":
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
+		}
+		address := args[0]
+		if address == "default" {
+			address = DEFAULT_HTTP_API_ADDRESS
+		} else if address == "off" {
+			address = ""
+		}
+		err := StartHTTP(address)
+		if err == nil {
+			err = model.SetGatewayAPIAddress(server.Gateway, address)
+		}
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("SET-GATEWAY-API", ERR_FAILED, err)
+		}
+		return ok("SET-GATEWAY-API", "")
+	case "SET-GATEWAY-API-TOKEN":
+		err := regenerateHTTPTokens()
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("SET-GATEWAY-API-TOKEN", ERR_FAILED, err)
+		}
+		return ok("SET-GATEWAY-API-TOKEN", "")
+	case "SET-GATEWAY-SESSIONS":
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
+		}
+		sessions, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fail("SET-GATEWAY-SESSIONS", ERR_FAILED, errors.New("invalid number of sessions "+args[0]))
+		}
+		err = server.SetSessions(sessions)
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("SET-GATEWAY-SESSIONS", ERR_FAILED, err)
+		}
+		return ok("SET-GATEWAY-SESSIONS", "")
+	case "SET-GATEWAY-RETENTION":
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
+		}
+		days, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fail("SET-GATEWAY-RETENTION", ERR_FAILED, errors.New("invalid retention "+args[0]))
+		}
+		err = server.SetRetention(days)
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("SET-GATEWAY-RETENTION", ERR_FAILED, err)
+		}
+		return ok("SET-GATEWAY-RETENTION", "")
+	case "SET-SOCKET-PATH":
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
+		}
+		path := strings.Join(args, " ")
+		if path == "default" {
+			path = ""
+		}
+		err := model.SetSocketPath(server.Gateway, path)
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("SET-SOCKET-PATH", ERR_FAILED, err)
+		}
+		return ok("SET-SOCKET-PATH", "")
+	case "SET-SOCKET-MODE":
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
+		}
+		err := model.SetSocketMode(server.Gateway, args[0])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("SET-SOCKET-MODE", ERR_FAILED, err)
+		}
+		return ok("SET-SOCKET-MODE", "")
+	case "SOCKET-ALLOW":
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
+		}
+		id, isGroup, err := parsePeer(args[0])
+		if err == nil {
+			err = model.AllowSocketPeer(server.Gateway, id, isGroup, len(args) > 1 && args[1] == "read-only")
+		}
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("SOCKET-ALLOW", ERR_FAILED, err)
+		}
+		return ok("SOCKET-ALLOW", "")
+	case "SOCKET-REVOKE":
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
+		}
+		id, isGroup, err := parsePeer(args[0])
+		if err == nil {
+			err = model.RevokeSocketPeer(server.Gateway, id, isGroup)
 		}
 		if err != nil {
 			out.Logger.Println("Error:", err)
-			return "ERR:SET-GATEWAY-HTTP-ENDPOINT:" + err.Error()
+			return fail("SOCKET-REVOKE", ERR_FAILED, err)
 		}
-		return "OK:SET-GATEWAY-HTTP-ENDPOINT:"
+		return ok("SOCKET-REVOKE", "")
 	case "SET-GATEWAY-ID":
-		if len(parts) < 2 {
-			return "ERR:SET-GATEWAY-ID:not enough arguments"
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
 		}
-		err := model.SetGatewayId(server.Gateway, strings.Join(parts[1:], " "))
+		err := model.SetGatewayId(server.Gateway, strings.Join(args, " "))
 		if err != nil {
 			out.Logger.Println("Error:", err)
-			return "ERR:SET-GATEWAY-ID:" + err.Error()
+			return fail("SET-GATEWAY-ID", ERR_FAILED, err)
 		}
-		return "OK:SET-GATEWAY-ID:"
+		return ok("SET-GATEWAY-ID", "")
 	case "SET-GATEWAY-PASSWORD":
-		if len(parts) < 2 {
-			return "ERR:not enough arguments"
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
 		}
-		err := model.SetGatewayPassword(server.Gateway, strings.Join(parts[1:], " "))
+		err := model.SetGatewayPassword(server.Gateway, strings.Join(args, " "))
 		if err != nil {
 			out.Logger.Println("Error:", err)
-			return "ERR:SET-GATEWAY-PASSWORD:" + err.Error()
+			return fail("SET-GATEWAY-PASSWORD", ERR_FAILED, err)
 		}
-		return "OK:SET-GATEWAY-PASSWORD:"
+		return ok("SET-GATEWAY-PASSWORD", "")
 	case "SET-SENSOR-SETTINGS":
-		if len(parts) < 2 {
-			return "ERR:SET-SENSOR-SETTINGS:not enough arguments"
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
+		}
+		// <mac-address | group> followed by <setting> <value> pairs
+		settings := [][2]string{}
+		for i := 1; i+1 < len(args); i += 2 {
+			settings = append(settings, [2]string{args[i], args[i+1]})
 		}
-		mac, err := model.StringToMac(parts[1])
+		err := setSensorSettings(args[0], settings)
 		if err != nil {
 			out.Logger.Println("Error:", err)
-			return "ERR:SET-SENSOR-SETTING:" + err.Error()
+			return fail("SET-SENSOR-SETTINGS", ERR_FAILED, err)
 		}
-		nbrOfSettings := (len(parts) - 2) / 2
-		for i := 0; i < nbrOfSettings; i++ {
-			err = model.UpdateSensorSetting(mac, parts[2+i*2], parts[3+i*2], server.Sensors)
-			if err != nil {
-				out.Logger.Println("Error:", err)
-				return "ERR:SET-SENSOR-SETTINGS:" + err.Error()
-			}
+		return ok("SET-SENSOR-SETTINGS", "")
+	case "ADD-GROUP":
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
+		}
+		err := addGroup(strings.Join(args, " "))
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("ADD-GROUP", ERR_FAILED, err)
+		}
+		return ok("ADD-GROUP", "")
+	case "REMOVE-GROUP":
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
+		}
+		err := server.Groups.Remove(args[0])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("REMOVE-GROUP", ERR_FAILED, err)
+		}
+		return ok("REMOVE-GROUP", "")
+	case "LIST-GROUPS":
+		res, err := listGroups()
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("LIST-GROUPS", ERR_FAILED, err)
+		}
+		return ok("LIST-GROUPS", res)
+	case "ADD-PROFILE":
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
+		}
+		err := addProfile(strings.Join(args, " "))
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("ADD-PROFILE", ERR_FAILED, err)
+		}
+		return ok("ADD-PROFILE", "")
+	case "REMOVE-PROFILE":
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
+		}
+		err := server.Profiles.Remove(args[0])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("REMOVE-PROFILE", ERR_FAILED, err)
+		}
+		return ok("REMOVE-PROFILE", "")
+	case "LIST-PROFILES":
+		res, err := listProfiles()
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("LIST-PROFILES", ERR_FAILED, err)
+		}
+		return ok("LIST-PROFILES", res)
+	case "SET-DEFAULT-PROFILE":
+		if len(args) < 1 {
+			return fail(command, ERR_MISSING_ARGUMENTS, errNotEnoughArguments)
+		}
+		err := server.Profiles.SetDefault(args[0])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return fail("SET-DEFAULT-PROFILE", ERR_FAILED, err)
 		}
-		return "OK:SET-SENSOR-SETTINGS:"
+		return ok("SET-DEFAULT-PROFILE", "")
 	case "ADD-LOGGER":
-		out.LoggingConnections[conn] = true
-		return "OK:ADD-LOGGER:"
+		out.AddLoggingConnection(conn)
+		return ok("ADD-LOGGER", "")
 	case "REMOVE-LOGGER":
-		delete(out.LoggingConnections, conn)
-		return "OK:REMOVE-LOGGER:"
+		out.RemoveLoggingConnection(conn)
+		return ok("REMOVE-LOGGER", "")
 	case "STOP":
 		stop()
-	default:
-		return "ERR:invalid command"
+		return ok("STOP", "")
 	}
-	return "ERR:unknown"
+	return fail(command, ERR_UNKNOWN_COMMAND, errors.New("invalid command"))
 }
 
-func handleConnection(conn *net.Conn) {
+func handleConnection(conn *net.Conn, r role) {
 	defer (*conn).Close()
+	defer out.RemoveConnection(conn)
 	reader := bufio.NewReader(*conn)
 	for {
 		str, err := reader.ReadString('\x00')
@@ -152,24 +361,87 @@ func handleConnection(conn *net.Conn) {
 			if c == "" {
 				continue
 			}
-			response := handleCommand(c, conn)
-			(*conn).Write([]byte(response + "\x00"))
+			(*conn).Write(append(handleMessage(c, conn, r), '\x00'))
 		}
 	}
 }
 
+func authorizeCommand(command string, args []string, conn *net.Conn, r role) model.Response {
+	if r != ROLE_FULL && !READ_ONLY_COMMANDS[command] {
+		return fail(command, ERR_FORBIDDEN, errors.New("permission denied (read-only access)"))
+	}
+	return handleCommand(command, args, conn)
+}
+
+// the response is in the protocol of the message (see protocol.go)
+func handleMessage(message string, conn *net.Conn, r role) []byte {
+	if !strings.HasPrefix(message, "{") {
+		command, args := parseTextRequest(message)
+		return []byte(formatText(authorizeCommand(command, args, conn, r)))
+	}
+
+	out.SetJSONConnection(conn)
+	command, args, id, err := parseJSONRequest(message)
+	var res model.Response
+	if err != nil {
+		res = fail(command, ERR_INVALID_REQUEST, err)
+	} else {
+		res = authorizeCommand(command, args, conn, r)
+	}
+	res.Id = id
+	jsonStr, err := json.Marshal(res)
+	if err != nil {
+		jsonStr, _ = json.Marshal(fail(command, ERR_FAILED, err))
+	}
+	return jsonStr
+}
+
+// the socket is created in a directory only the server can access and moved
+// in place once its mode is set, it is never reachable with the permissions
+// given by the umask
+func listen(socketPath string, mode os.FileMode) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(path.Dir(socketPath), ".ssmachmos-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := path.Join(dir, "socket")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket is not at tmpPath anymore
+	listener.SetUnlinkOnClose(false)
+	err = os.Chmod(tmpPath, mode)
+	if err == nil {
+		err = os.Rename(tmpPath, socketPath)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
 func Start() error {
-	socketPath := "/tmp/ss_machmos.sock"
+	socketPath := model.GetSocketPath(server.Gateway)
+	mode, err := model.GetSocketMode(server.Gateway)
+	if err != nil {
+		out.Logger.Println("Error:", err)
+		return err
+	}
 	if err := os.RemoveAll(socketPath); err != nil {
 		out.Logger.Println("Error:", err)
 		return err
 	}
 
-	listener, err := net.Listen("unix", socketPath)
+	listener, err := listen(socketPath, mode)
 	if err != nil {
 		out.Logger.Println("Error:", err)
 		return err
 	}
+	defer os.Remove(socketPath)
 	defer listener.Close()
 
 	for {
@@ -178,6 +450,12 @@ func Start() error {
 			out.Logger.Println("Error:", err)
 			return err
 		}
-		go handleConnection(&conn)
+		r, err := getRole(conn)
+		if r == ROLE_NONE {
+			out.Logger.Println("Connection to the socket refused:", err)
+			conn.Close()
+			continue
+		}
+		go handleConnection(&conn, r)
 	}
 }
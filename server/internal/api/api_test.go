@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jukuly/ss_machmos/server/internal/server"
+)
+
+// the socket only appears at its path with its final mode, and the
+// directory it was created in is removed
+func TestListen(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := path.Join(dir, "ssmachmos.sock")
+
+	listener, err := listen(socketPath, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		t.Errorf("expected a socket, got %v", info.Mode())
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("expected mode 0640, got %o", info.Mode().Perm())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the socket in the directory, got %d entries", len(entries))
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+// the user running the server always has full access, whatever the allowlist
+func TestGetRoleOwner(t *testing.T) {
+	newTestGateway(t)
+	socketPath := path.Join(t.TempDir(), "ssmachmos.sock")
+	listener, err := listen(socketPath, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	for _, users := range [][]uint32{nil, {uint32(os.Getuid()) + 1}} {
+		server.Gateway.Socket.Users = users
+		client, err := net.Dial("unix", socketPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := getRole(conn)
+		if r != ROLE_FULL {
+			t.Errorf("users %v: expected full access, got %d (%v)", users, r, err)
+		}
+		conn.Close()
+		client.Close()
+	}
+}
@@ -3,6 +3,8 @@ package api
 import (
 	"encoding/json"
 	"errors"
+	"strconv"
+	"time"
 
 	"github.com/jukuly/ss_machmos/server/internal/model"
 	"github.com/jukuly/ss_machmos/server/internal/server"
@@ -25,14 +27,26 @@ func pairAccept(mac string) error {
 	return nil
 }
 
-func list() (string, error) {
-	jsonStr, err := json.Marshal(*server.Sensors)
+// the sensors matching every filter (see model.SENSOR_FILTERS)
+func list(filters map[string]string) (string, error) {
+	sensors := []model.Sensor{}
+	for _, sensor := range server.Sensors.List() {
+		matches, err := sensor.Matches(filters)
+		if err != nil {
+			return "", err
+		}
+		if matches {
+			sensors = append(sensors, sensor)
+		}
+	}
+	jsonStr, err := json.Marshal(sensors)
 	return string(jsonStr), err
 }
 
 func view(mac string) (string, error) {
-	for _, sensor := range *server.Sensors {
-		if sensor.IsMacEqual(mac) {
+	m, err := model.StringToMac(mac)
+	if err == nil {
+		if sensor, exists := server.Sensors.Get(m); exists {
 			jsonStr, err := json.Marshal(sensor)
 			return string(jsonStr), err
 		}
@@ -52,8 +66,123 @@ func forget(mac string) error {
 	return nil
 }
 
+// the gateway settings with the upload queue of every sink
 func getGateway() (string, error) {
-	jsonStr, err := json.Marshal(*server.Gateway)
+	queues, err := server.GetSpoolStatus()
+	if err != nil {
+		return "", err
+	}
+	jsonStr, err := json.Marshal(struct {
+		*model.Gateway
+		// read only, from before the sinks (set with SET-GATEWAY-HTTP-ENDPOINT)
+		HTTPEndpoint string                       `json:"http_endpoint"`
+		Queues       map[string]model.SpoolStatus `json:"queues"`
+	}{model.CopyGateway(server.Gateway), model.GetGatewayHTTPEndpoint(server.Gateway), queues})
+	return string(jsonStr), err
+}
+
+func getQueue() (string, error) {
+	status, err := server.GetSpoolStatus()
+	if err != nil {
+		return "", err
+	}
+	jsonStr, err := json.Marshal(status)
+	return string(jsonStr), err
+}
+
+// hours is the length of the schedule, 24 if empty
+func getSchedule(hours string) (string, error) {
+	h := 24
+	if hours != "" {
+		var err error
+		h, err = strconv.Atoi(hours)
+		if err != nil {
+			return "", errors.New("invalid number of hours " + hours)
+		}
+	}
+	schedule, err := server.GetSchedule(time.Duration(h) * time.Hour)
+	if err != nil {
+		return "", err
+	}
+	jsonStr, err := json.Marshal(schedule)
+	return string(jsonStr), err
+}
+
+func addSink(jsonStr string) error {
+	sink := model.Sink{}
+	err := json.Unmarshal([]byte(jsonStr), &sink)
+	if err != nil {
+		return err
+	}
+	return server.AddSink(sink)
+}
+
+// the sensors targeted by a MAC address or the name of a group
+func getTargets(target string) ([][6]byte, error) {
+	mac, err := model.StringToMac(target)
+	if err == nil {
+		return [][6]byte{mac}, nil
+	}
+	group, exists := server.Groups.Get(target)
+	if !exists {
+		return nil, errors.New(target + " is neither a MAC address nor a group")
+	}
+	macs := group.Members(server.Sensors.List())
+	if len(macs) == 0 {
+		return nil, errors.New("group " + target + " has no sensors")
+	}
+	return macs, nil
+}
+
+// settings are [<setting>, <value>] pairs applied in order to every target,
+// or to none of them if one fails
+func setSensorSettings(target string, settings [][2]string) error {
+	macs, err := getTargets(target)
+	if err != nil {
+		return err
+	}
+	return model.UpdateSensorsSettings(macs, settings, server.Sensors, server.Profiles)
+}
+
+func addGroup(jsonStr string) error {
+	group := model.Group{}
+	err := json.Unmarshal([]byte(jsonStr), &group)
+	if err != nil {
+		return err
+	}
+	return server.Groups.Add(group)
+}
+
+// every group with its members
+func listGroups() (string, error) {
+	type groupMembers struct {
+		model.Group
+		Members [][6]byte `json:"members"`
+	}
+	sensors := server.Sensors.List()
+	groups := []groupMembers{}
+	for _, g := range server.Groups.List() {
+		groups = append(groups, groupMembers{g, g.Members(sensors)})
+	}
+	jsonStr, err := json.Marshal(groups)
+	return string(jsonStr), err
+}
+
+func addProfile(jsonStr string) error {
+	profile := model.Profile{}
+	err := json.Unmarshal([]byte(jsonStr), &profile)
+	if err != nil {
+		return err
+	}
+	return server.Profiles.Add(profile)
+}
+
+// every profile and which one is applied on pairing
+func listProfiles() (string, error) {
+	jsonStr, err := json.Marshal(struct {
+		Default  string          `json:"default"`
+		Profiles []model.Profile `json:"profiles"`
+	}{server.Profiles.GetDefault().Name, server.Profiles.List()})
 	return string(jsonStr), err
 }
 
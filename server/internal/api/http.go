@@ -0,0 +1,559 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+	"github.com/jukuly/ss_machmos/server/internal/server"
+)
+
+// Optional HTTP API exposing the same resources as the Unix socket as JSON:
+//
+//	GET    /sensors                 every paired sensor (?location=, machine=, component=, tag= to filter)
+//	GET    /sensors/{mac}           one sensor
+//	PUT    /sensors/{mac}           update settings in order ({"<setting>": <value>, ...} or
+//	                                [{"setting": ..., "value": ...}, ...], see config --sensor)
+//	DELETE /sensors/{mac}           forget the sensor
+//	GET    /groups                  every group of sensors with its members
+//	POST   /groups                  add a group ({"name": ..., "tag" | "machine" | "macs": ...})
+//	PUT    /groups/{name}           update the settings of every sensor of the group (all or
+//	                                nothing, same body as PUT /sensors/{mac})
+//	DELETE /groups/{name}           remove a group (not its sensors)
+//	GET    /profiles                {"default": <name>, "profiles": [...]}
+//	POST   /profiles                add a settings profile
+//	PUT    /profiles                {"default": <name>} (the profile applied on pairing)
+//	DELETE /profiles/{name}         remove a profile (the sensors keep their settings)
+//	GET    /schedule                upcoming wake ups of every sensor (?hours=, 24 by default)
+//	GET    /gateway                 gateway settings and upload queues (without the passwords)
+//	PUT    /gateway                 {"id": ..., "password": ..., "http_endpoint": ..., "sessions": ..., "retention": ...} (all optional)
+//	POST   /gateway/sinks           add a sink
+//	DELETE /gateway/sinks/{name}    remove a sink
+//	GET    /pairing                 {"enabled": ..., "requests": [<mac>, ...]}
+//	PUT    /pairing                 {"enabled": true | false}
+//	POST   /pairing/{mac}           accept the pairing request of a sensor
+//
+// Every request carries one of the tokens of the gateway (generated when
+// the API is first started, see config --api-token) as a bearer token: the
+// full access token, or the read-only token that only allows the routes
+// doing what the read-only commands of the socket do (see
+// READ_ONLY_COMMANDS). A request with a body must be application/json. The
+// API only listens on localhost unless configured otherwise (config --api).
+
+const DEFAULT_HTTP_API_ADDRESS = "localhost:8484"
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+var httpServer *http.Server
+var httpServerMutex sync.Mutex
+
+// StartHTTP (re)starts the HTTP API on address, an empty address stops it
+func StartHTTP(address string) error {
+	httpServerMutex.Lock()
+	defer httpServerMutex.Unlock()
+
+	if httpServer != nil {
+		httpServer.Close()
+		httpServer = nil
+	}
+	if address == "" {
+		return nil
+	}
+	if full, readOnly := model.GetGatewayAPITokens(server.Gateway); full == "" || readOnly == "" {
+		err := model.GenerateGatewayAPITokens(server.Gateway)
+		if err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	httpServer = &http.Server{Handler: http.HandlerFunc(handleRequest)}
+	go func(s *http.Server) {
+		err := s.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			out.Logger.Println("Error:", err)
+		}
+	}(httpServer)
+	out.Logger.Println("HTTP API listening on " + listener.Addr().String())
+	return nil
+}
+
+// the old tokens stop working right away
+func regenerateHTTPTokens() error {
+	httpServerMutex.Lock()
+	defer httpServerMutex.Unlock()
+	return model.GenerateGatewayAPITokens(server.Gateway)
+}
+
+// the same roles as the socket, given by the token instead of the peer
+// credentials
+func getHTTPRole(r *http.Request) role {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return ROLE_NONE
+	}
+	full, readOnly := model.GetGatewayAPITokens(server.Gateway)
+	if full != "" && subtle.ConstantTimeCompare([]byte(token), []byte(full)) == 1 {
+		return ROLE_FULL
+	}
+	if readOnly != "" && subtle.ConstantTimeCompare([]byte(token), []byte(readOnly)) == 1 {
+		return ROLE_READ_ONLY
+	}
+	return ROLE_NONE
+}
+
+// the socket command doing what the route does, the routes that change
+// something are only allowed with the full access token
+func getHTTPCommand(method string, path []string) string {
+	if method != http.MethodGet {
+		return ""
+	}
+	switch {
+	case len(path) == 1 && path[0] == "sensors":
+		return "LIST"
+	case len(path) == 2 && path[0] == "sensors":
+		return "VIEW"
+	case len(path) == 1 && path[0] == "groups":
+		return "LIST-GROUPS"
+	case len(path) == 1 && path[0] == "profiles":
+		return "LIST-PROFILES"
+	case len(path) == 1 && path[0] == "schedule":
+		return "GET-SCHEDULE"
+	case len(path) == 1 && path[0] == "gateway":
+		return "GET-GATEWAY"
+	}
+	return ""
+}
+
+// a browser can send a form or text to the API from any page, but not JSON
+func isJSONRequest(r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodDelete {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+func writeJSON(w http.ResponseWriter, status int, jsonStr string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write([]byte(jsonStr))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	jsonStr, _ := json.Marshal(httpError{Error: err.Error()})
+	writeJSON(w, status, string(jsonStr))
+}
+
+func writeOK(w http.ResponseWriter) {
+	writeJSON(w, http.StatusOK, "{}")
+}
+
+// routes by hand, the http.ServeMux of go 1.20 does not match methods and
+// path parameters
+func handleRequest(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch role := getHTTPRole(r); {
+	case role == ROLE_NONE:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+		return
+	case role != ROLE_FULL && !READ_ONLY_COMMANDS[getHTTPCommand(r.Method, path)]:
+		writeError(w, http.StatusForbidden, errors.New("permission denied (read-only access)"))
+		return
+	}
+	if !isJSONRequest(r) {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("the body must be application/json"))
+		return
+	}
+
+	switch {
+	case len(path) == 1 && path[0] == "sensors":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		filters := map[string]string{}
+		for filter := range r.URL.Query() {
+			filters[filter] = r.URL.Query().Get(filter)
+		}
+		res, err := list(filters)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	case len(path) == 2 && path[0] == "sensors":
+		handleSensor(w, r, path[1])
+	case len(path) == 1 && path[0] == "groups":
+		switch r.Method {
+		case http.MethodGet:
+			res, err := listGroups()
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, res)
+		case http.MethodPost:
+			group := model.Group{}
+			err := json.NewDecoder(r.Body).Decode(&group)
+			if err == nil {
+				err = server.Groups.Add(group)
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			writeOK(w)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+	case len(path) == 2 && path[0] == "groups":
+		handleGroup(w, r, path[1])
+	case len(path) == 1 && path[0] == "profiles":
+		handleProfiles(w, r)
+	case len(path) == 2 && path[0] == "profiles":
+		if r.Method != http.MethodDelete {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		err := server.Profiles.Remove(path[1])
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeOK(w)
+	case len(path) == 1 && path[0] == "schedule":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		res, err := getSchedule(r.URL.Query().Get("hours"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	case len(path) == 1 && path[0] == "gateway":
+		handleGateway(w, r)
+	case len(path) == 2 && path[0] == "gateway" && path[1] == "sinks":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		sink := model.Sink{}
+		err := json.NewDecoder(r.Body).Decode(&sink)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = server.AddSink(sink)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeOK(w)
+	case len(path) == 3 && path[0] == "gateway" && path[1] == "sinks":
+		if r.Method != http.MethodDelete {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		err := server.RemoveSink(path[2])
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeOK(w)
+	case len(path) == 1 && path[0] == "pairing":
+		handlePairing(w, r)
+	case len(path) == 2 && path[0] == "pairing":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		err := pairAccept(path[1])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		// the result of the pairing is only known once the sensor confirms it
+		writeJSON(w, http.StatusAccepted, "{}")
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func handleSensor(w http.ResponseWriter, r *http.Request, mac string) {
+	switch r.Method {
+	case http.MethodGet:
+		res, err := view(mac)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	case http.MethodPut:
+		_, err := model.StringToMac(mac)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		settings, err := decodeSettings(r)
+		if err == nil {
+			err = setSensorSettings(mac, settings)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		res, err := view(mac)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	case http.MethodDelete:
+		err := forget(mac)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeOK(w)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// {"<setting>": <value>, ...} or [{"setting": <setting>, "value": <value>}, ...]
+// as [<setting>, <value>] pairs in the order of the body, the settings
+// depend on each other (e.g. auto resets the others, the max offset must be
+// smaller than the interval)
+func decodeSettings(r *http.Request) ([][2]string, error) {
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	settings := [][2]string{}
+	switch token {
+	case json.Delim('{'):
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			var value interface{}
+			err = decoder.Decode(&value)
+			if err != nil {
+				return nil, err
+			}
+			settings = append(settings, [2]string{key.(string), settingToString(value)})
+		}
+	case json.Delim('['):
+		for decoder.More() {
+			pair := struct {
+				Setting string      `json:"setting"`
+				Value   interface{} `json:"value"`
+			}{}
+			err := decoder.Decode(&pair)
+			if err != nil {
+				return nil, err
+			}
+			if pair.Setting == "" {
+				return nil, errors.New("missing setting in settings array")
+			}
+			settings = append(settings, [2]string{pair.Setting, settingToString(pair.Value)})
+		}
+	default:
+		return nil, errors.New("the settings must be an object or an array")
+	}
+	// closing delimiter
+	_, err = decoder.Token()
+	return settings, err
+}
+
+func settingToString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+func handleGroup(w http.ResponseWriter, r *http.Request, name string) {
+	if _, exists := server.Groups.Get(name); !exists {
+		writeError(w, http.StatusNotFound, errors.New("group "+name+" not found"))
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		settings, err := decodeSettings(r)
+		if err == nil {
+			err = setSensorSettings(name, settings)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeOK(w)
+	case http.MethodDelete:
+		err := server.Groups.Remove(name)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeOK(w)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func handleProfiles(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		res, err := listProfiles()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	case http.MethodPost:
+		profile := model.Profile{}
+		err := json.NewDecoder(r.Body).Decode(&profile)
+		if err == nil {
+			err = server.Profiles.Add(profile)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeOK(w)
+	case http.MethodPut:
+		body := struct {
+			Default string `json:"default"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err == nil {
+			err = server.Profiles.SetDefault(body.Default)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeOK(w)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func handleGateway(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		queues, err := server.GetSpoolStatus()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		// secrets are never sent over HTTP
+		gateway := model.CopyGateway(server.Gateway)
+		gateway.Password = ""
+		gateway.APIToken = ""
+		gateway.APIReadOnlyToken = ""
+		for i := range gateway.Sinks {
+			gateway.Sinks[i].Password = ""
+			gateway.Sinks[i].Token = ""
+		}
+		jsonStr, err := json.Marshal(struct {
+			*model.Gateway
+			HTTPEndpoint string                       `json:"http_endpoint"` // read only, see getGateway
+			Queues       map[string]model.SpoolStatus `json:"queues"`
+		}{gateway, model.GetGatewayHTTPEndpoint(gateway), queues})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, string(jsonStr))
+	case http.MethodPut:
+		settings := struct {
+			Id           *string `json:"id"`
+			Password     *string `json:"password"`
+			HTTPEndpoint *string `json:"http_endpoint"`
+			Sessions     *int    `json:"sessions"`
+			Retention    *int    `json:"retention"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&settings)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if settings.Id != nil {
+			err = model.SetGatewayId(server.Gateway, *settings.Id)
+		}
+		if err == nil && settings.Password != nil {
+			err = model.SetGatewayPassword(server.Gateway, *settings.Password)
+		}
+		if err == nil && settings.HTTPEndpoint != nil {
+			err = server.SetHTTPEndpoint(*settings.HTTPEndpoint)
+		}
+		if err == nil && settings.Sessions != nil {
+			err = server.SetSessions(*settings.Sessions)
+		}
+		if err == nil && settings.Retention != nil {
+			err = server.SetRetention(*settings.Retention)
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeOK(w)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func handlePairing(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jsonStr, err := json.Marshal(struct {
+			Enabled  bool     `json:"enabled"`
+			Requests []string `json:"requests"`
+		}{server.IsPairingEnabled(), server.GetPairingRequests()})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, string(jsonStr))
+	case http.MethodPut:
+		settings := struct {
+			Enabled bool `json:"enabled"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&settings)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if settings.Enabled {
+			pairEnable()
+		} else if out.CountPairingConnections() == 0 {
+			// the clients of the socket in pairing mode keep it enabled
+			pairDisable()
+		}
+		writeOK(w)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/server"
+)
+
+func newTestGateway(t *testing.T) {
+	t.Helper()
+	model.SetConfigDir(t.TempDir())
+	server.Gateway = &model.Gateway{Id: "test", Password: "secret"}
+	server.Sensors = model.NewSensorRegistry(model.SENSORS_FILE)
+	server.Groups = model.NewGroupRegistry(model.GROUPS_FILE)
+	t.Cleanup(func() {
+		model.SetConfigDir("")
+		server.Gateway = nil
+		server.Sensors = nil
+		server.Groups = nil
+	})
+	err := model.GenerateGatewayAPITokens(server.Gateway)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func doRequest(method string, target string, token string, contentType string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	handleRequest(w, r)
+	return w
+}
+
+func TestHTTPAuthentication(t *testing.T) {
+	newTestGateway(t)
+	token := server.Gateway.APIToken
+
+	for _, c := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{token + "0", http.StatusUnauthorized},
+		{token, http.StatusOK},
+	} {
+		w := doRequest(http.MethodGet, "/sensors", c.token, "", "")
+		if w.Code != c.status {
+			t.Errorf("token %q: expected status %d, got %d", c.token, c.status, w.Code)
+		}
+	}
+
+	w := doRequest(http.MethodGet, "/gateway", token, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), token) || strings.Contains(w.Body.String(), server.Gateway.APIReadOnlyToken) || strings.Contains(w.Body.String(), "secret") {
+		t.Error("the gateway secrets were sent over HTTP")
+	}
+
+	old := token
+	err := regenerateHTTPTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doRequest(http.MethodGet, "/sensors", old, "", "").Code != http.StatusUnauthorized {
+		t.Error("the replaced token still works")
+	}
+}
+
+// a page in a browser can send a form or text/plain without a preflight
+func TestHTTPRequiresJSON(t *testing.T) {
+	newTestGateway(t)
+	token := server.Gateway.APIToken
+	body := `{"name": "test", "tag": "test"}`
+
+	for _, c := range []struct {
+		contentType string
+		status      int
+	}{
+		{"", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"application/json; charset=utf-8", http.StatusOK},
+	} {
+		w := doRequest(http.MethodPost, "/groups", token, c.contentType, body)
+		if w.Code != c.status {
+			t.Errorf("content type %q: expected status %d, got %d: %s", c.contentType, c.status, w.Code, w.Body.String())
+		}
+		server.Groups.Remove("test")
+	}
+}
+
+// the read-only token only allows the routes of the read-only commands of
+// the socket
+func TestHTTPReadOnlyToken(t *testing.T) {
+	newTestGateway(t)
+	token := server.Gateway.APIReadOnlyToken
+
+	for _, c := range []struct {
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "/sensors", "", http.StatusOK},
+		{http.MethodGet, "/groups", "", http.StatusOK},
+		{http.MethodGet, "/sensors/5E:00:00:00:00:01", "", http.StatusNotFound},
+		{http.MethodGet, "/gateway", "", http.StatusForbidden},
+		{http.MethodGet, "/pairing", "", http.StatusForbidden},
+		{http.MethodPut, "/pairing", `{"enabled": true}`, http.StatusForbidden},
+		{http.MethodPost, "/groups", `{"name": "test", "tag": "test"}`, http.StatusForbidden},
+		{http.MethodDelete, "/sensors/5E:00:00:00:00:01", "", http.StatusForbidden},
+		{http.MethodPut, "/gateway", `{"id": "changed"}`, http.StatusForbidden},
+	} {
+		w := doRequest(c.method, c.target, token, "application/json", c.body)
+		if w.Code != c.status {
+			t.Errorf("%s %s: expected status %d, got %d: %s", c.method, c.target, c.status, w.Code, w.Body.String())
+		}
+	}
+	if server.Gateway.Id != "test" {
+		t.Error("the read-only token changed the gateway")
+	}
+	if _, exists := server.Groups.Get("test"); exists {
+		t.Error("the read-only token added a group")
+	}
+}
+
+// the max offset must be lowered before the interval (300 and 3600 seconds
+// by default)
+func TestHTTPSettingsAreAppliedInOrder(t *testing.T) {
+	newTestGateway(t)
+	token := server.Gateway.APIToken
+	mac := [6]byte{0x5E, 0, 0, 0, 0, 1}
+	err := model.AddSensor(mac, []string{"temperature"}, 1000000, &model.PublicKey{}, 2, nil, server.Sensors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Groups.Add(model.Group{Name: "test", Macs: [][6]byte{mac}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		target string
+		body   string
+		status int
+	}{
+		{"/sensors/" + model.MacToString(mac), `{"wake_up_interval": 200, "wake_up_interval_max_offset": 100}`, http.StatusBadRequest},
+		{"/sensors/" + model.MacToString(mac), `{"wake_up_interval_max_offset": 100, "wake_up_interval": 200}`, http.StatusOK},
+		{"/sensors/" + model.MacToString(mac), `{"auto": true, "wake_up_interval_max_offset": 90}`, http.StatusOK},
+		{"/groups/test", `[{"setting": "wake_up_interval", "value": 80}, {"setting": "wake_up_interval_max_offset", "value": 50}]`, http.StatusBadRequest},
+		{"/groups/test", `[{"setting": "wake_up_interval_max_offset", "value": 50}, {"setting": "wake_up_interval", "value": 80}]`, http.StatusOK},
+		{"/groups/test", `"wake_up_interval"`, http.StatusBadRequest},
+	} {
+		w := doRequest(http.MethodPut, c.target, token, "application/json", c.body)
+		if w.Code != c.status {
+			t.Errorf("%s %s: expected status %d, got %d: %s", c.target, c.body, c.status, w.Code, w.Body.String())
+		}
+		if c.target == "/sensors/"+model.MacToString(mac) && c.status == http.StatusOK {
+			sensor, _ := server.Sensors.Get(mac)
+			if sensor.WakeUpIntervalMaxOffset != 100 && sensor.WakeUpIntervalMaxOffset != 90 {
+				t.Errorf("%s: the settings were not applied", c.body)
+			}
+		}
+	}
+	sensor, _ := server.Sensors.Get(mac)
+	if sensor.WakeUpInterval != 80 || sensor.WakeUpIntervalMaxOffset != 50 {
+		t.Errorf("expected a wake up every 80 +- 50 seconds, got %d +- %d", sensor.WakeUpInterval, sensor.WakeUpIntervalMaxOffset)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package api
+
+import (
+	"errors"
+	"net"
+)
+
+func getPeerCredentials(conn net.Conn) (uint32, uint32, error) {
+	return 0, 0, errors.New("peer credentials are not supported on this platform")
+}
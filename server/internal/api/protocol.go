@@ -0,0 +1,88 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+)
+
+// The socket speaks two protocols, chosen per message (every message ends
+// with a NUL byte):
+//
+// - text (compatibility mode): "<COMMAND> <arg> <arg>..." answered with
+//   "OK:<COMMAND>:<payload>" or "ERR:<COMMAND>:<error>", events are sent as
+//   "MSG:<message>" (pairing) and "LOG:<line>"
+// - JSON: a model.Request answered with a model.Response with the same id,
+//   events are sent as out.Event. Once a connection has sent a JSON request,
+//   the events it receives are JSON as well.
+
+const (
+	ERR_INVALID_REQUEST   = "invalid_request"
+	ERR_UNKNOWN_COMMAND   = "unknown_command"
+	ERR_MISSING_ARGUMENTS = "missing_arguments"
+	ERR_FAILED            = "failed"
+)
+
+var errNotEnoughArguments = errors.New("not enough arguments")
+
+func ok(command string, payload string) model.Response {
+	res := model.Response{Command: command, Status: model.STATUS_OK}
+	if payload != "" {
+		res.Payload = json.RawMessage(payload)
+	}
+	return res
+}
+
+func fail(command string, code string, err error) model.Response {
+	return model.Response{Command: command, Status: model.STATUS_ERROR, ErrorCode: code, Error: err.Error()}
+}
+
+// numbers are formatted without exponent so that the settings parse them
+func argToString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	}
+	jsonStr, _ := json.Marshal(value)
+	return string(jsonStr)
+}
+
+func parseJSONRequest(message string) (string, []string, uint64, error) {
+	req := model.Request{}
+	err := json.Unmarshal([]byte(message), &req)
+	if err != nil {
+		return "", nil, req.Id, err
+	}
+	if req.Command == "" {
+		return "", nil, req.Id, errors.New("missing command")
+	}
+	args := make([]string, len(req.Args))
+	for i, arg := range req.Args {
+		args[i] = argToString(arg)
+	}
+	return req.Command, args, req.Id, nil
+}
+
+func parseTextRequest(message string) (string, []string) {
+	parts := strings.Split(message, " ")
+	return parts[0], parts[1:]
+}
+
+func formatText(res model.Response) string {
+	if res.Status == model.STATUS_OK {
+		return "OK:" + res.Command + ":" + string(res.Payload)
+	}
+	if res.Command == "" {
+		return "ERR:" + res.Error
+	}
+	return "ERR:" + res.Command + ":" + res.Error
+}
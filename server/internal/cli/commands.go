@@ -2,12 +2,17 @@ package cli
 
 import (
 	"bufio"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/jukuly/ss_machmos/server/internal/model"
 	"github.com/jukuly/ss_machmos/server/internal/out"
@@ -25,18 +30,35 @@ var messagesToPrint = map[string]string{
 	"PAIRING-TIMEOUT":       "Pairing timed out with sensor ",
 }
 
-var waitingFor = map[string]chan<- bool{}
+// the CLI speaks the JSON protocol of the socket (see api/protocol.go)
+var waitingFor = map[uint64]chan model.Response{}
+var waitingForMutex sync.Mutex
+var lastRequestId uint64 = 0
 
-func waitFor(command ...string) {
-	done := make(chan bool)
-	for _, p := range command {
-		waitingFor[p] = done
+// waits for the response to the request, once Listen has printed it
+func waitFor(id uint64) model.Response {
+	waitingForMutex.Lock()
+	done, exists := waitingFor[id]
+	waitingForMutex.Unlock()
+	if !exists {
+		return model.Response{}
 	}
-	<-done
+	res := <-done
+	waitingForMutex.Lock()
+	delete(waitingFor, id)
+	waitingForMutex.Unlock()
+	return res
 }
 
 func OpenConnection() (net.Conn, error) {
-	socketPath := "/tmp/ss_machmos.sock"
+	// the CLI can only know the path the server uses from the environment
+	// or, when run by the same user, from the gateway settings
+	gateway := &model.Gateway{}
+	socket, err := model.ReadSocketSettings(model.GATEWAY_FILE)
+	if err == nil {
+		gateway.Socket = socket
+	}
+	socketPath := model.GetSocketPath(gateway)
 
 	conn, err := net.Dial("unix", socketPath)
 	if err != nil {
@@ -56,31 +78,59 @@ func Listen(conn net.Conn) {
 		}
 		ress := strings.Split(str, "\x00")
 		for _, res := range ress {
-			found := []string{}
-			if msg := parseResponse(res); msg != "" {
-				fmt.Println(msg)
+			if res == "" {
+				continue
 			}
-			for prefix, done := range waitingFor {
-				if strings.HasPrefix(res, prefix) {
-					done <- true
-					found = append(found, prefix)
+			event := out.Event{}
+			if json.Unmarshal([]byte(res), &event) == nil && event.Event != "" {
+				if msg := parseEvent(event); msg != "" {
+					fmt.Println(msg)
 				}
+				continue
+			}
+			response := model.Response{}
+			err := json.Unmarshal([]byte(res), &response)
+			if err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			if msg := parseResponse(response); msg != "" {
+				fmt.Println(msg)
 			}
-			for _, f := range found {
-				delete(waitingFor, f)
+			waitingForMutex.Lock()
+			if done, exists := waitingFor[response.Id]; exists {
+				done <- response
 			}
+			waitingForMutex.Unlock()
 		}
 	}
 }
 
-func sendCommand(command string, conn net.Conn) error {
-	_, err := conn.Write([]byte(command + "\x00"))
+// sendCommand sends a request and returns its id (see waitFor)
+func sendCommand(conn net.Conn, command string, args ...string) (uint64, error) {
+	waitingForMutex.Lock()
+	lastRequestId++
+	id := lastRequestId
+	waitingFor[id] = make(chan model.Response, 1)
+	waitingForMutex.Unlock()
 
+	req := model.Request{Id: id, Command: command, Args: make([]interface{}, len(args))}
+	for i, arg := range args {
+		req.Args[i] = arg
+	}
+	jsonStr, err := json.Marshal(req)
 	if err != nil {
-		return err
+		return id, err
+	}
+	_, err = conn.Write(append(jsonStr, '\x00'))
+	if err != nil {
+		waitingForMutex.Lock()
+		delete(waitingFor, id)
+		waitingForMutex.Unlock()
+		return id, err
 	}
 
-	return nil
+	return id, nil
 }
 
 func Help(args []string) {
@@ -98,14 +148,31 @@ func Help(args []string) {
 			"|         | --no-console | None                            | Start the server without the       |\n" +
 			"|         |              |                                 | live stream of logs                |\n" +
 			"+---------+--------------+---------------------------------+------------------------------------+\n" +
+			"| simulate| None         | None                            | Start the server with 50 virtual   |\n" +
+			"|         |              |                                 | sensors instead of the adapter     |\n" +
+			"|         | --sensors    | <count>                         | Number of virtual sensors          |\n" +
+			"|         | --interval   | <seconds>                       | Wake up interval of the sensors    |\n" +
+			"|         | --offset     | <seconds>                       | Wake up interval max offset        |\n" +
+			"+---------+--------------+---------------------------------+------------------------------------+\n" +
 			"| logs    | None         | None                            | View the live stream of logs       |\n" +
 			"+---------+--------------+---------------------------------+------------------------------------+\n" +
 			"| stop    | None         | None                            | Stop the server                    |\n" +
 			"+---------+--------------+---------------------------------+------------------------------------+\n" +
 			"| list    | None         | None                            | List all sensors                   |\n" +
+			"|         | --location   | <location>                      | Filter the sensors, type           |\n" +
+			"|         | --machine    | <machine>                       |   \"help list\" for more             |\n" +
+			"|         | --component  | <component>                     |   information                      |\n" +
+			"|         | --tag        | <tag>                           |                                    |\n" +
 			"+---------+--------------+---------------------------------+------------------------------------+\n" +
 			"| view    | --sensor     | <mac-address>                   | View a specific sensors' settings  |\n" +
 			"|         | --gateway    | None                            | View the Gateway settings          |\n" +
+			"|         | --queue      | None                            | View the measurements waiting to   |\n" +
+			"|         |              |                                 | be uploaded                        |\n" +
+			"+---------+--------------+---------------------------------+------------------------------------+\n" +
+			"| schedule| None         | None                            | View the wake ups of the next 24 h |\n" +
+			"|         | --hours      | <hours>                         | View the wake ups of the next hours|\n" +
+			"|         | --csv        | None                            | Export the wake ups as CSV         |\n" +
+			"|         | --json       | None                            | Export the wake ups as JSON        |\n" +
 			"+---------+--------------+---------------------------------+------------------------------------+\n" +
 			"| pair    | None         | None                            | Enter pairing mode                 |\n" +
 			"+---------+--------------+---------------------------------+------------------------------------+\n" +
@@ -117,9 +184,50 @@ func Help(args []string) {
 			"|         |              | default                         |   data will be sent                |\n" +
 			"|         |              |                                 |   default is openphm.org           |\n" +
 			"|         |              |                                 |                                    |\n" +
-			"|         | --sensor     | <mac-address> <setting> <value> | Set a setting of a sensor          |\n" +
-			"|         |              |                                 |   Type \"help config\"               |\n" +
+			"|         | --api        | <address>                       | Serve the HTTP API on address      |\n" +
+			"|         |              | default                         |   default is localhost:8484        |\n" +
+			"|         |              | off                             |                                    |\n" +
+			"|         |              |                                 |                                    |\n" +
+			"|         | --api-token  | new                             | Replace the tokens of the HTTP API |\n" +
+			"|         |              |                                 |                                    |\n" +
+			"|         | --sessions   | <count>                         | Set how many sensors can be awake  |\n" +
+			"|         |              |                                 |   at the same time, default is 1   |\n" +
+			"|         |              |                                 |                                    |\n" +
+			"|         | --retention  | <days>                          | Delete the stored measurements     |\n" +
+			"|         |              |                                 |   older than days, 0 (default)     |\n" +
+			"|         |              |                                 |   keeps them forever               |\n" +
+			"|         |              |                                 |                                    |\n" +
+			"|         | --socket-    | <path>                          | Set the path of the control socket |\n" +
+			"|         |   path       | default                         |   (on restart)                     |\n" +
+			"|         | --socket-    | <octal-mode>                    | Set the file mode of the socket    |\n" +
+			"|         |   mode       |                                 |   (on restart) default is 0660     |\n" +
+			"|         | --socket-    | user:<name | uid> [read-only]   | Allow a user or group to use the   |\n" +
+			"|         |   allow      | group:<name | gid> [read-only]  |   socket                           |\n" +
+			"|         | --socket-    | user:<name | uid>               | Revoke the access of a user or     |\n" +
+			"|         |   revoke     | group:<name | gid>              |   group                            |\n" +
+			"|         |              |                                 |                                    |\n" +
+			"|         | --sink       | add <name> <type> <url>         | Add a sink (openphm, http, mqtt,   |\n" +
+			"|         |              |   [<option>=<value> ...]        |   influx or file) the data is      |\n" +
+			"|         |              |                                 |   sent to. Type \"help config\"     |\n" +
 			"|         |              |                                 |   for more information             |\n" +
+			"|         |              | remove <name>                   | Remove a sink and its queue        |\n" +
+			"|         |              | list                            | List the sinks                     |\n" +
+			"|         |              |                                 |                                    |\n" +
+			"|         | --sensor     | <mac-address | group>           | Set settings of a sensor or of     |\n" +
+			"|         |              |   <setting> <value> ...         |   every sensor of a group. Type    |\n" +
+			"|         |              |                                 |   \"help config\" for more           |\n" +
+			"|         |              |                                 |   information                      |\n" +
+			"|         |              |                                 |                                    |\n" +
+			"|         | --group      | add <name> tag <tag>            | Add a group of sensors             |\n" +
+			"|         |              | add <name> machine <machine>    |                                    |\n" +
+			"|         |              | add <name> macs <mac>,<mac>...  |                                    |\n" +
+			"|         |              | remove <name>                   | Remove a group (not its sensors)   |\n" +
+			"|         |              | list                            | List the groups and their sensors  |\n" +
+			"|         |              |                                 |                                    |\n" +
+			"|         | --profile    | add <name> <setting>=<value>... | Add a profile of settings          |\n" +
+			"|         |              | remove <name>                   | Remove a profile                   |\n" +
+			"|         |              | default <name>                  | Set the profile applied on pairing |\n" +
+			"|         |              | list                            | List the profiles                  |\n" +
 			"+---------+--------------+---------------------------------+------------------------------------+\n")
 		return
 	}
@@ -141,6 +249,16 @@ func Help(args []string) {
 			"|         |              |                                 | live stream of logs                |\n" +
 			"+---------+--------------+---------------------------------+------------------------------------+\n")
 
+	case "simulate":
+		fmt.Print("+---------+--------------+---------------------------------+------------------------------------+\n" +
+			"| simulate| None         | None                            | Start the server with 50 virtual   |\n" +
+			"|         |              |                                 | sensors instead of the adapter     |\n" +
+			"|         |              |                                 | (60 +- 10 seconds wake up interval)|\n" +
+			"|         | --sensors    | <count>                         | Number of virtual sensors          |\n" +
+			"|         | --interval   | <seconds>                       | Wake up interval of the sensors    |\n" +
+			"|         | --offset     | <seconds>                       | Wake up interval max offset        |\n" +
+			"+---------+--------------+---------------------------------+------------------------------------+\n")
+
 	case "logs":
 		fmt.Print("+---------+------------+---------------------------------+------------------------------------+\n" +
 			"| logs    | None       | None                            | View the live stream of logs       |\n" +
@@ -154,12 +272,32 @@ func Help(args []string) {
 	case "list":
 		fmt.Print("+---------+------------+---------------------------------+------------------------------------+\n" +
 			"| list    | None       | None                            | List all sensors                   |\n" +
+			"|         | --location | <location>                      | Only the sensors at a location     |\n" +
+			"|         | --machine  | <machine>                       | Only the sensors on a machine      |\n" +
+			"|         | --component| <component>                     | Only the sensors on a component    |\n" +
+			"|         | --tag      | <tag>                           | Only the sensors with a tag        |\n" +
+			"|         |            |                                 | (filters can be combined)          |\n" +
 			"+---------+------------+---------------------------------+------------------------------------+\n")
 
 	case "view":
 		fmt.Print("+---------+------------+---------------------------------+------------------------------------+\n" +
 			"| view    | --sensor   | <mac-address>                   | View a specific sensors' settings  |\n" +
 			"|         | --gateway  | None                            | View the Gateway settings          |\n" +
+			"|         | --queue    | None                            | View the measurements waiting to   |\n" +
+			"|         |            |                                 | be uploaded                        |\n" +
+			"+---------+------------+---------------------------------+------------------------------------+\n")
+
+	case "schedule":
+		fmt.Print("+---------+------------+---------------------------------+------------------------------------+\n" +
+			"| schedule| None       | None                            | View the wake ups of every sensor  |\n" +
+			"|         |            |                                 | in the next 24 hours, the ones     |\n" +
+			"|         |            |                                 | with more sensors awake than the   |\n" +
+			"|         |            |                                 | gateway has sessions and the share |\n" +
+			"|         |            |                                 | of the sessions' time in use       |\n" +
+			"|         | --hours    | <hours>                         | View the next <hours> hours        |\n" +
+			"|         |            |                                 | (at most 168)                      |\n" +
+			"|         | --csv      | None                            | Export the wake ups as CSV         |\n" +
+			"|         | --json     | None                            | Export the wake ups as JSON        |\n" +
 			"+---------+------------+---------------------------------+------------------------------------+\n")
 
 	case "pair":
@@ -179,12 +317,94 @@ func Help(args []string) {
 			"|         | --http     | <http-endpoint>                 | Set the HTTP Endpoint where the    |\n" +
 			"|         |            |                                 | 	data will be sent                |\n" +
 			"|         |            |                                 |                                    |\n" +
-			"|         | --sensor   | <mac-address> <setting> <value> | Set a setting of a sensor          |\n" +
+			"|         | --api      | <address>                       | Serve the HTTP API (JSON resources |\n" +
+			"|         |            | default                         |   /sensors, /gateway, /pairing) on |\n" +
+			"|         |            | off                             |   address, default is              |\n" +
+			"|         |            |                                 |   localhost:8484, every request    |\n" +
+			"|         |            |                                 |   needs a token of the gateway     |\n" +
+			"|         |            |                                 |   (Authorization: Bearer <token>), |\n" +
+			"|         |            |                                 |   the read-only token only allows  |\n" +
+			"|         |            |                                 |   what read-only socket users can  |\n" +
+			"|         |            |                                 |   do (view --gateway shows them)   |\n" +
+			"|         |            |                                 |                                    |\n" +
+			"|         | --api-     | new                             | Replace the tokens of the HTTP     |\n" +
+			"|         |   token    |                                 |   API, the old ones stop working   |\n" +
+			"|         |            |                                 |                                    |\n" +
+			"|         | --sessions | <count>                         | Set how many sensors the adapter   |\n" +
+			"|         |            |                                 |   serves at the same time (1 to    |\n" +
+			"|         |            |                                 |   16, default is 1), the wake ups  |\n" +
+			"|         |            |                                 |   are scheduled so that no more    |\n" +
+			"|         |            |                                 |   sensors are awake at once        |\n" +
+			"|         |            |                                 |                                    |\n" +
+			"|         | --retention| <days>                          | Delete the measurements stored by  |\n" +
+			"|         |            |                                 |   the gateway older than days (0   |\n" +
+			"|         |            |                                 |   to 3650), 0 (default) keeps them |\n" +
+			"|         |            |                                 |   forever                          |\n" +
+			"|         |            |                                 |                                    |\n" +
+			"|         | --socket-  | <path>                          | Set the path of the control socket |\n" +
+			"|         |   path     | default                         |   (on restart), the CLI uses       |\n" +
+			"|         |            |                                 |   $SSMACHMOS_SOCKET if set         |\n" +
+			"|         | --socket-  | <octal-mode>                    | Set the file mode of the socket    |\n" +
+			"|         |   mode     |                                 |   (on restart) default is 0660     |\n" +
+			"|         | --socket-  | user:<name | uid> [read-only]   | Allow a user or group to use the   |\n" +
+			"|         |   allow    | group:<name | gid> [read-only]  |   socket. Read-only access can only|\n" +
+			"|         |            |                                 |   list, view sensors and see logs. |\n" +
+			"|         |            |                                 |   Root and the user running the    |\n" +
+			"|         |            |                                 |   server always have full access,  |\n" +
+			"|         |            |                                 |   anyone allowed by the file mode  |\n" +
+			"|         |            |                                 |   is read-only when nobody is      |\n" +
+			"|         |            |                                 |   allowed                          |\n" +
+			"|         | --socket-  | user:<name | uid>               | Revoke the access of a user or     |\n" +
+			"|         |   revoke   | group:<name | gid>              |   group                            |\n" +
+			"|         |            |                                 |                                    |\n" +
+			"|         | --sink     | add <name> <type> <url>         | Add a sink the data is sent to,    |\n" +
+			"|         |            |   [<option>=<value> ...]        |   every sink has its own upload    |\n" +
+			"|         |            |                                 |   queue                            |\n" +
+			"|         |            |                                 |   <type> and <url>:                |\n" +
+			"|         |            |                                 |   openphm <http-endpoint>          |\n" +
+			"|         |            |                                 |   http <url>                       |\n" +
+			"|         |            |                                 |   mqtt <mqtt(s)://host:port>       |\n" +
+			"|         |            |                                 |   influx <write-url>               |\n" +
+			"|         |            |                                 |   file <directory>                 |\n" +
+			"|         |            |                                 |   <option> can be \"topic\" (mqtt), |\n" +
+			"|         |            |                                 |   \"username\", \"password\" (mqtt) |\n" +
+			"|         |            |                                 |   or \"token\" (http, influx)       |\n" +
+			"|         |            | remove <name>                   | Remove a sink and its queue        |\n" +
+			"|         |            | list                            | List the sinks                     |\n" +
+			"|         |            |                                 |                                    |\n" +
+			"|         | --sensor   | <mac-address | group>           | Set settings of a sensor or of     |\n" +
+			"|         |            |   <setting> <value>             |   every sensor of a group, the     |\n" +
+			"|         |            |   [<setting> <value> ...]       |   settings are applied to every    |\n" +
+			"|         |            |                                 |   sensor or to none of them if one |\n" +
+			"|         |            |                                 |   is invalid for any sensor        |\n" +
 			"|         |            | <setting> can be \"name\",        |                                    |\n" +
-			"|         |            | \"description\" or composed of    |                                    |\n" +
+			"|         |            | \"description\", \"location\",      |                                    |\n" +
+			"|         |            | \"machine\", \"component\",         |                                    |\n" +
+			"|         |            | \"tags\" (comma separated),       |                                    |\n" +
+			"|         |            | \"profile\" (see --profile) or    |                                    |\n" +
+			"|         |            | composed of                     |                                    |\n" +
 			"|         |            | the measurement type and the    |                                    |\n" +
 			"|         |            | setting separated by an \"_\"     |                                    |\n" +
 			"|         |            | eg.: \"audio_wake_up_interval\"|                                    |\n" +
+			"|         |            |                                 |                                    |\n" +
+			"|         | --group    | add <name> tag <tag>            | Add a group of the sensors with a  |\n" +
+			"|         |            |                                 |   tag, on a machine or listed      |\n" +
+			"|         |            | add <name> machine <machine>    |   (the members of a group by tag   |\n" +
+			"|         |            | add <name> macs <mac>,<mac>...  |   or machine follow the sensors)   |\n" +
+			"|         |            | remove <name>                   | Remove a group (not its sensors)   |\n" +
+			"|         |            | list                            | List the groups and their sensors  |\n" +
+			"|         |            |                                 |                                    |\n" +
+			"|         | --profile  | add <name> <setting>=<value>    | Add a named profile of the wake up |\n" +
+			"|         |            |   [<setting>=<value> ...]       |   interval and sampling settings,  |\n" +
+			"|         |            |                                 |   <setting> as for --sensor. Only  |\n" +
+			"|         |            |                                 |   the types with a setting are in  |\n" +
+			"|         |            |                                 |   the profile, the other values    |\n" +
+			"|         |            |                                 |   are the ones of \"builtin\"        |\n" +
+			"|         |            | remove <name>                   | Remove a profile (the sensors keep |\n" +
+			"|         |            |                                 |   their settings)                  |\n" +
+			"|         |            | default <name>                  | Set the profile applied on pairing |\n" +
+			"|         |            |                                 |   and by the \"auto\" setting        |\n" +
+			"|         |            | list                            | List the profiles                  |\n" +
 			"+---------+------------+---------------------------------+------------------------------------+\n")
 
 	default:
@@ -193,42 +413,55 @@ func Help(args []string) {
 }
 
 func Logs(conn net.Conn) {
-	err := sendCommand("ADD-LOGGER", conn)
+	id, err := sendCommand(conn, "ADD-LOGGER")
 	if err != nil {
 		fmt.Println("Error:", err)
 		return
 	}
-	waitFor("OK:ADD-LOGGER")
+	waitFor(id)
+	done := make(chan bool)
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		for sig := range c {
 			if sig == os.Interrupt {
-				err := sendCommand("REMOVE-LOGGER", conn)
+				id, err := sendCommand(conn, "REMOVE-LOGGER")
 				if err != nil {
 					out.Logger.Println("Error:", err)
 					os.Exit(0)
 				}
+				waitFor(id)
+				done <- true
 				return
 			}
 		}
 	}()
-	waitFor("OK:REMOVE-LOGGER")
+	<-done
 }
 
-func List(conn net.Conn) {
-	err := sendCommand("LIST", conn)
+func List(options []string, args []string, conn net.Conn) {
+	if len(args) < len(options) {
+		fmt.Println("Usage: list [--location <location>] [--machine <machine>] [--component <component>] [--tag <tag>]")
+		return
+	}
+	// <filter> <value> pairs
+	filters := []string{}
+	for i, option := range options {
+		filters = append(filters, strings.TrimPrefix(option, "--"), args[i])
+	}
+	id, err := sendCommand(conn, "LIST", filters...)
 	if err != nil {
 		fmt.Println("Error:", err)
 		return
 	}
-	waitFor("OK:LIST", "ERR:LIST")
+	waitFor(id)
 }
 
 func View(options []string, args []string, conn net.Conn) {
 	if len(options) == 0 {
 		fmt.Print("\nUsage: view --sensor <mac-address>\n" +
-			"              --gateway\n")
+			"              --gateway\n" +
+			"              --queue\n")
 		return
 	}
 	switch options[0] {
@@ -237,38 +470,129 @@ func View(options []string, args []string, conn net.Conn) {
 			fmt.Println("Usage: view --sensor <mac-address>")
 			return
 		}
-		err := sendCommand("VIEW "+args[0], conn)
+		id, err := sendCommand(conn, "VIEW", args[0])
 		if err != nil {
 			fmt.Println("Error:", err)
 			return
 		}
-		waitFor("OK:VIEW", "ERR:VIEW")
+		waitFor(id)
 	case "--gateway":
-		err := sendCommand("GET-GATEWAY", conn)
+		id, err := sendCommand(conn, "GET-GATEWAY")
 		if err != nil {
 			fmt.Println("Error:", err)
 			return
 		}
-		waitFor("OK:GET-GATEWAY", "ERR:GET-GATEWAY")
+		waitFor(id)
+	case "--queue":
+		id, err := sendCommand(conn, "GET-QUEUE")
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor(id)
 	default:
 		fmt.Printf("Option %s does not exist for command view\n", options[0])
 	}
 }
 
+func Schedule(options []string, args []string, conn net.Conn) {
+	hours := "24"
+	format := "table"
+	for _, option := range options {
+		switch option {
+		case "--hours":
+			if len(args) == 0 {
+				fmt.Println("Usage: schedule [--hours <hours>] [--csv | --json]")
+				return
+			}
+			hours = args[0]
+		case "--csv":
+			format = "csv"
+		case "--json":
+			format = "json"
+		default:
+			fmt.Printf("Option %s does not exist for command schedule\n", option)
+			return
+		}
+	}
+	id, err := sendCommand(conn, "GET-SCHEDULE", hours)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	// the errors are printed by Listen
+	res := waitFor(id)
+	if res.Status == model.STATUS_OK {
+		fmt.Println(scheduleToString(res.Payload, format))
+	}
+}
+
+// format is "table", "csv" or "json"
+func scheduleToString(payload []byte, format string) string {
+	if format == "json" {
+		return string(payload)
+	}
+	schedule := model.Schedule{}
+	err := json.Unmarshal(payload, &schedule)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+
+	if format == "csv" {
+		str := &strings.Builder{}
+		w := csv.NewWriter(str)
+		w.Write([]string{"mac", "name", "start", "end", "overlaps", "over_capacity"})
+		for _, wakeUp := range schedule.WakeUps {
+			overlaps := []string{}
+			for _, mac := range wakeUp.Overlaps {
+				overlaps = append(overlaps, model.MacToString(mac))
+			}
+			w.Write([]string{model.MacToString(wakeUp.Mac), wakeUp.Name, wakeUp.Start.Format(time.RFC3339), wakeUp.End.Format(time.RFC3339), strings.Join(overlaps, ";"), strconv.FormatBool(wakeUp.OverCapacity)})
+		}
+		w.Flush()
+		return strings.TrimSuffix(str.String(), "\n")
+	}
+
+	const layout = "2006-01-02 15:04:05"
+	str := "Wake ups from " + schedule.From.Local().Format(layout) + " to " + schedule.To.Local().Format(layout) + "\n"
+	overCapacity := 0
+	for _, wakeUp := range schedule.WakeUps {
+		str += wakeUp.Start.Local().Format(layout) + " - " + wakeUp.End.Local().Format("15:04:05") + "  " + wakeUp.Name + " (" + model.MacToString(wakeUp.Mac) + ")"
+		if len(wakeUp.Overlaps) > 0 {
+			macs := []string{}
+			for _, mac := range wakeUp.Overlaps {
+				macs = append(macs, model.MacToString(mac))
+			}
+			// overlapping is fine as long as the gateway has sessions left
+			if wakeUp.OverCapacity {
+				overCapacity++
+				str += "  OVER CAPACITY with " + strings.Join(macs, ", ")
+			} else {
+				str += "  with " + strings.Join(macs, ", ")
+			}
+		}
+		str += "\n"
+	}
+	str += strconv.Itoa(len(schedule.WakeUps)) + " wake ups, " + strconv.Itoa(overCapacity) + " with more than " + strconv.Itoa(schedule.Sessions) + " sensors awake\n"
+	str += "Air time utilisation: " + strconv.FormatFloat(schedule.Utilisation*100, 'f', 1, 64) + " % of " + strconv.Itoa(schedule.Sessions) + " sessions\n"
+	str += "Over capacity: " + strconv.FormatFloat(schedule.OverCapacity, 'f', 0, 64) + " seconds"
+	return str
+}
+
 func Pair(args []string, conn net.Conn) {
-	err := sendCommand("PAIR-ENABLE", conn)
+	id, err := sendCommand(conn, "PAIR-ENABLE")
 	if err != nil {
 		fmt.Println("Error:", err)
 		return
 	}
-	waitFor("OK:PAIR-ENABLE", "ERR:PAIR-ENABLE")
+	waitFor(id)
 	fmt.Println("Entering pairing mode. Press Ctrl+C to exit pairing mode.")
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		for sig := range c {
 			if sig == os.Interrupt {
-				err := sendCommand("PAIR-DISABLE", conn)
+				_, err := sendCommand(conn, "PAIR-DISABLE")
 				if err != nil {
 					fmt.Println("Error:", err)
 					os.Exit(0)
@@ -294,7 +618,7 @@ func Pair(args []string, conn net.Conn) {
 				fmt.Println("Usage: accept <mac-address>")
 				continue
 			}
-			err := sendCommand("PAIR-ACCEPT "+parts[1], conn)
+			_, err := sendCommand(conn, "PAIR-ACCEPT", parts[1])
 			if err != nil {
 				fmt.Println("Error:", err)
 				return
@@ -308,12 +632,12 @@ func Forget(args []string, conn net.Conn) {
 		fmt.Println("Usage: forget <mac-address>")
 		return
 	}
-	err := sendCommand("FORGET "+args[0], conn)
+	id, err := sendCommand(conn, "FORGET", args[0])
 	if err != nil {
 		fmt.Println("Error:", err)
 		return
 	}
-	waitFor("OK:FORGET", "ERR:FORGET")
+	waitFor(id)
 }
 
 func Config(options []string, args []string, conn net.Conn) {
@@ -321,7 +645,25 @@ func Config(options []string, args []string, conn net.Conn) {
 		fmt.Print("\nUsage: config --id <gateway-id>\n" +
 			"              --password <gateway-password>\n" +
 			"              --http <http-endpoint> | default\n" +
-			"              --sensor <mac-address> <setting> <value>\n")
+			"              --api <address> | default | off\n" +
+			"              --api-token new\n" +
+			"              --sessions <count>\n" +
+			"              --retention <days>\n" +
+			"              --socket-path <path> | default\n" +
+			"              --socket-mode <octal-mode>\n" +
+			"              --socket-allow user:<name | uid> | group:<name | gid> [read-only]\n" +
+			"              --socket-revoke user:<name | uid> | group:<name | gid>\n" +
+			"              --sink add <name> <type> <url> [<option>=<value> ...]\n" +
+			"              --sink remove <name>\n" +
+			"              --sink list\n" +
+			"              --sensor <mac-address | group> <setting> <value> [<setting> <value> ...]\n" +
+			"              --group add <name> tag <tag> | machine <machine> | macs <mac-address>[,<mac-address> ...]\n" +
+			"              --group remove <name>\n" +
+			"              --group list\n" +
+			"              --profile add <name> <setting>=<value> [<setting>=<value> ...]\n" +
+			"              --profile remove <name>\n" +
+			"              --profile default <name>\n" +
+			"              --profile list\n")
 		return
 	}
 	switch options[0] {
@@ -330,72 +672,349 @@ func Config(options []string, args []string, conn net.Conn) {
 			fmt.Println("Usage: config --id <gateway-id>")
 			return
 		}
-		err := sendCommand("SET-GATEWAY-ID "+args[0], conn)
+		id, err := sendCommand(conn, "SET-GATEWAY-ID", args[0])
 		if err != nil {
 			fmt.Println("Error:", err)
 			return
 		}
-		waitFor("OK:SET-GATEWAY-ID", "ERR:SET-GATEWAY-ID")
+		waitFor(id)
 	case "--password":
 		if len(args) == 0 {
 			fmt.Println("Usage: config --password <gateway-password>")
 			return
 		}
-		err := sendCommand("SET-GATEWAY-PASSWORD "+args[0], conn)
+		id, err := sendCommand(conn, "SET-GATEWAY-PASSWORD", args[0])
 		if err != nil {
 			fmt.Println("Error:", err)
 			return
 		}
-		waitFor("OK:SET-GATEWAY-PASSWORD", "ERR:SET-GATEWAY-PASSWORD")
+		waitFor(id)
 	case "--http":
 		if len(args) == 0 {
 			fmt.Println("Usage: config --http <http-endpoint> | default")
 			return
 		}
-		err := sendCommand("SET-GATEWAY-HTTP-ENDPOINT "+args[0], conn)
+		id, err := sendCommand(conn, "SET-GATEWAY-HTTP-ENDPOINT", args[0])
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor(id)
+	case "--api":
+		if len(args) == 0 {
+			fmt.Println("Usage: config --api <address> | default | off")
+			return
+		}
+		id, err := sendCommand(conn, "SET-GATEWAY-API", args[0])
 		if err != nil {
 			fmt.Println("Error:", err)
 			return
 		}
-		waitFor("OK:SET-GATEWAY-HTTP-ENDPOINT", "ERR:SET-GATEWAY-HTTP-ENDPOINT")
+		waitFor(id)
+	case "--api-token":
+		if len(args) == 0 || args[0] != "new" {
+			fmt.Println("Usage: config --api-token new")
+			return
+		}
+		id, err := sendCommand(conn, "SET-GATEWAY-API-TOKEN")
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor(id)
+	case "--sessions":
+		if len(args) == 0 {
+			fmt.Println("Usage: config --sessions <count>")
+			return
+		}
+		id, err := sendCommand(conn, "SET-GATEWAY-SESSIONS", args[0])
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor(id)
+	case "--retention":
+		if len(args) == 0 {
+			fmt.Println("Usage: config --retention <days>")
+			return
+		}
+		id, err := sendCommand(conn, "SET-GATEWAY-RETENTION", args[0])
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor(id)
+	case "--socket-path":
+		if len(args) == 0 {
+			fmt.Println("Usage: config --socket-path <path> | default")
+			return
+		}
+		id, err := sendCommand(conn, "SET-SOCKET-PATH", args[0])
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor(id)
+	case "--socket-mode":
+		if len(args) == 0 {
+			fmt.Println("Usage: config --socket-mode <octal-mode>")
+			return
+		}
+		id, err := sendCommand(conn, "SET-SOCKET-MODE", args[0])
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor(id)
+	case "--socket-allow":
+		if len(args) == 0 {
+			fmt.Println("Usage: config --socket-allow user:<name | uid> | group:<name | gid> [read-only]")
+			return
+		}
+		id, err := sendCommand(conn, "SOCKET-ALLOW", args...)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor(id)
+	case "--socket-revoke":
+		if len(args) == 0 {
+			fmt.Println("Usage: config --socket-revoke user:<name | uid> | group:<name | gid>")
+			return
+		}
+		id, err := sendCommand(conn, "SOCKET-REVOKE", args[0])
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor(id)
+	case "--sink":
+		if len(args) == 0 {
+			fmt.Println("Usage: config --sink add <name> <type> <url> [<option>=<value> ...] | remove <name> | list")
+			return
+		}
+		switch args[0] {
+		case "add":
+			if len(args) < 4 {
+				fmt.Println("Usage: config --sink add <name> <type> <url> [<option>=<value> ...]")
+				return
+			}
+			sink := model.Sink{Name: args[1], Type: args[2], URL: args[3]}
+			for _, option := range args[4:] {
+				key, value, found := strings.Cut(option, "=")
+				if !found {
+					fmt.Printf("Invalid sink option %s (must be <option>=<value>)\n", option)
+					return
+				}
+				switch key {
+				case "topic":
+					sink.Topic = value
+				case "username":
+					sink.Username = value
+				case "password":
+					sink.Password = value
+				case "token":
+					sink.Token = value
+				default:
+					fmt.Printf("Sink option %s does not exist\n", key)
+					return
+				}
+			}
+			jsonStr, err := json.Marshal(sink)
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			id, err := sendCommand(conn, "ADD-SINK", string(jsonStr))
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			waitFor(id)
+		case "remove":
+			if len(args) < 2 {
+				fmt.Println("Usage: config --sink remove <name>")
+				return
+			}
+			id, err := sendCommand(conn, "REMOVE-SINK", args[1])
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			waitFor(id)
+		case "list":
+			id, err := sendCommand(conn, "GET-GATEWAY")
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			waitFor(id)
+		default:
+			fmt.Println("Usage: config --sink add <name> <type> <url> [<option>=<value> ...] | remove <name> | list")
+		}
 	case "--sensor":
-		if len(args) < 3 {
-			fmt.Println("Usage: config --sensor <mac-address> <setting> <value>")
+		if len(args) < 3 || len(args)%2 == 0 {
+			fmt.Println("Usage: config --sensor <mac-address | group> <setting> <value> [<setting> <value> ...]")
 			return
 		}
-		err := sendCommand("SET-SENSOR-SETTINGS "+args[0]+" "+args[1]+" "+args[2], conn)
+		id, err := sendCommand(conn, "SET-SENSOR-SETTINGS", args...)
 		if err != nil {
 			fmt.Println("Error:", err)
 			return
 		}
-		waitFor("OK:SET-SENSOR-SETTINGS", "ERR:SET-SENSOR-SETTINGS")
+		waitFor(id)
+	case "--group":
+		if len(args) == 0 {
+			fmt.Println("Usage: config --group add <name> tag <tag> | machine <machine> | macs <mac-address>[,<mac-address> ...] | remove <name> | list")
+			return
+		}
+		switch args[0] {
+		case "add":
+			if len(args) < 4 {
+				fmt.Println("Usage: config --group add <name> tag <tag> | machine <machine> | macs <mac-address>[,<mac-address> ...]")
+				return
+			}
+			group := model.Group{Name: args[1]}
+			switch args[2] {
+			case "tag":
+				group.Tag = args[3]
+			case "machine":
+				group.Machine = args[3]
+			case "macs":
+				for _, mac := range strings.Split(args[3], ",") {
+					m, err := model.StringToMac(strings.TrimSpace(mac))
+					if err != nil {
+						fmt.Printf("Invalid MAC address %s\n", mac)
+						return
+					}
+					group.Macs = append(group.Macs, m)
+				}
+			default:
+				fmt.Printf("A group cannot be defined by %s (must be tag, machine or macs)\n", args[2])
+				return
+			}
+			jsonStr, err := json.Marshal(group)
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			id, err := sendCommand(conn, "ADD-GROUP", string(jsonStr))
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			waitFor(id)
+		case "remove":
+			if len(args) < 2 {
+				fmt.Println("Usage: config --group remove <name>")
+				return
+			}
+			id, err := sendCommand(conn, "REMOVE-GROUP", args[1])
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			waitFor(id)
+		case "list":
+			id, err := sendCommand(conn, "LIST-GROUPS")
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			waitFor(id)
+		default:
+			fmt.Println("Usage: config --group add <name> tag <tag> | machine <machine> | macs <mac-address>[,<mac-address> ...] | remove <name> | list")
+		}
+	case "--profile":
+		if len(args) == 0 {
+			fmt.Println("Usage: config --profile add <name> <setting>=<value> [<setting>=<value> ...] | remove <name> | default <name> | list")
+			return
+		}
+		switch args[0] {
+		case "add":
+			if len(args) < 3 {
+				fmt.Println("Usage: config --profile add <name> <setting>=<value> [<setting>=<value> ...]")
+				return
+			}
+			settings := [][2]string{}
+			for _, setting := range args[2:] {
+				key, value, found := strings.Cut(setting, "=")
+				if !found {
+					fmt.Printf("Invalid profile setting %s (must be <setting>=<value>)\n", setting)
+					return
+				}
+				settings = append(settings, [2]string{key, value})
+			}
+			profile, err := model.ParseProfile(args[1], settings)
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			jsonStr, err := json.Marshal(profile)
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			id, err := sendCommand(conn, "ADD-PROFILE", string(jsonStr))
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			waitFor(id)
+		case "remove":
+			if len(args) < 2 {
+				fmt.Println("Usage: config --profile remove <name>")
+				return
+			}
+			id, err := sendCommand(conn, "REMOVE-PROFILE", args[1])
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			waitFor(id)
+		case "default":
+			if len(args) < 2 {
+				fmt.Println("Usage: config --profile default <name>")
+				return
+			}
+			id, err := sendCommand(conn, "SET-DEFAULT-PROFILE", args[1])
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			waitFor(id)
+		case "list":
+			id, err := sendCommand(conn, "LIST-PROFILES")
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			waitFor(id)
+		default:
+			fmt.Println("Usage: config --profile add <name> <setting>=<value> [<setting>=<value> ...] | remove <name> | default <name> | list")
+		}
 	default:
 		fmt.Printf("Option %s does not exist for command config\n", options[0])
 	}
 }
 
 func Stop(conn net.Conn) {
-	err := sendCommand("STOP", conn)
+	_, err := sendCommand(conn, "STOP")
 	if err != nil {
 		fmt.Println("Error:", err)
 		return
 	}
 }
 
-func parseResponse(res string) string {
-	parts := strings.Split(res, ":")
-	if len(parts) == 0 || len(parts) == 1 {
-		return ""
+func parseResponse(res model.Response) string {
+	if res.Status == model.STATUS_ERROR {
+		return "Error: " + res.Error
 	}
-	if parts[0] == "OK" {
-		if len(parts) < 3 {
-			return strings.Join(parts[1:], ":")
-		}
-		parts[2] = strings.Join(parts[2:], ":")
-		switch parts[1] {
+	if res.Status == model.STATUS_OK {
+		switch res.Command {
 		case "LIST":
 			sensors := []model.Sensor{}
-			err := json.Unmarshal([]byte(parts[2]), &sensors)
+			err := json.Unmarshal(res.Payload, &sensors)
 			if err != nil {
 				return "Error: " + err.Error()
 			}
@@ -409,39 +1028,172 @@ func parseResponse(res string) string {
 				return str
 			}
 		case "VIEW":
-			str, err := sensorJSONToString([]byte(parts[2]))
+			str, err := sensorJSONToString(res.Payload)
 			if err != nil {
 				return "Error: " + err.Error()
 			}
 			return str
 		case "GET-GATEWAY":
-			gateway := model.Gateway{}
-			err := json.Unmarshal([]byte(parts[2]), &gateway)
+			gateway := struct {
+				model.Gateway
+				Queues map[string]model.SpoolStatus `json:"queues"`
+			}{}
+			err := json.Unmarshal(res.Payload, &gateway)
 			if err != nil {
 				return "Error: " + err.Error()
 			}
-			return "Gateway ID: " + gateway.Id + "\nHTTP Endpoint: " + gateway.HTTPEndpoint
-		}
-	} else if parts[0] == "ERR" {
-		if len(parts) < 3 {
-			return "Error: " + strings.Join(parts[1:], ":")
-		}
-		return "Error: " + strings.Join(parts[2:], ":")
-	} else if parts[0] == "MSG" {
-		for command, msg := range messagesToPrint {
-			if parts[1] == command {
-				if len(parts) < 3 {
-					return msg
+			str := "Gateway ID: " + gateway.Id + "\nSessions: " + strconv.Itoa(model.GetSessions(&gateway.Gateway)) + "\nHTTP API: "
+			if gateway.APIAddress == "" {
+				str += "Off"
+			} else {
+				str += gateway.APIAddress
+			}
+			if gateway.APIToken != "" {
+				str += "\n  Token: " + gateway.APIToken
+			}
+			if gateway.APIReadOnlyToken != "" {
+				str += "\n  Read-only Token: " + gateway.APIReadOnlyToken
+			}
+			str += "\nRetention: "
+			if gateway.Retention == 0 {
+				str += "Forever"
+			} else {
+				str += strconv.Itoa(gateway.Retention) + " days"
+			}
+			str += "\nSocket: " + model.GetSocketPath(&gateway.Gateway)
+			if mode, err := model.GetSocketMode(&gateway.Gateway); err == nil {
+				str += " (mode 0" + strconv.FormatUint(uint64(mode), 8) + ")"
+			}
+			if ids := gateway.Socket.Users; len(ids) > 0 {
+				str += "\n  Users: " + idsToString(ids)
+			}
+			if ids := gateway.Socket.Groups; len(ids) > 0 {
+				str += "\n  Groups: " + idsToString(ids)
+			}
+			if ids := gateway.Socket.ReadOnlyUsers; len(ids) > 0 {
+				str += "\n  Read-only Users: " + idsToString(ids)
+			}
+			if ids := gateway.Socket.ReadOnlyGroups; len(ids) > 0 {
+				str += "\n  Read-only Groups: " + idsToString(ids)
+			}
+			str += "\nSinks:"
+			if len(gateway.Sinks) == 0 {
+				str += " None (the measurements are only kept locally)"
+			}
+			for _, sink := range gateway.Sinks {
+				str += "\n  " + sink.Name + " (" + sink.Type + "): " + sink.URL
+				if sink.Topic != "" {
+					str += "\n    Topic: " + sink.Topic
+				}
+				if sink.Username != "" {
+					str += "\n    Username: " + sink.Username
+				}
+				if status, exists := gateway.Queues[sink.Name]; exists {
+					str += "\n    " + queueStatusToString(status, "    ")
 				}
-				return msg + strings.Join(parts[2:], ":")
 			}
+			return str
+		case "GET-QUEUE":
+			statuses := map[string]model.SpoolStatus{}
+			err := json.Unmarshal(res.Payload, &statuses)
+			if err != nil {
+				return "Error: " + err.Error()
+			}
+			if len(statuses) == 0 {
+				return "No sinks configured"
+			}
+			names := []string{}
+			for name := range statuses {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			str := ""
+			for _, name := range names {
+				str += name + ": " + queueStatusToString(statuses[name], "  ") + "\n"
+			}
+			return str
+		case "LIST-GROUPS":
+			groups := []struct {
+				model.Group
+				Members [][6]byte `json:"members"`
+			}{}
+			err := json.Unmarshal(res.Payload, &groups)
+			if err != nil {
+				return "Error: " + err.Error()
+			}
+			if len(groups) == 0 {
+				return "No groups of sensors"
+			}
+			str := ""
+			for _, group := range groups {
+				str += group.ToString() + "\n"
+				str += "  Sensors (" + strconv.Itoa(len(group.Members)) + "):"
+				for _, mac := range group.Members {
+					str += " " + model.MacToString(mac)
+				}
+				str += "\n"
+			}
+			return str
+		case "LIST-PROFILES":
+			profiles := struct {
+				Default  string          `json:"default"`
+				Profiles []model.Profile `json:"profiles"`
+			}{}
+			err := json.Unmarshal(res.Payload, &profiles)
+			if err != nil {
+				return "Error: " + err.Error()
+			}
+			str := ""
+			for _, profile := range profiles.Profiles {
+				if profile.Name == profiles.Default {
+					str += "(default) "
+				}
+				str += profile.ToString()
+			}
+			return str
 		}
-	} else if parts[0] == "LOG" {
-		line := strings.Join(parts[1:], ":")
-		if last := len(line) - 1; last >= 0 && line[last] == '\n' {
-			line = line[:last]
+	}
+	return ""
+}
+
+func parseEvent(event out.Event) string {
+	switch event.Event {
+	case "pairing":
+		parts := strings.SplitN(event.Message, ":", 2)
+		if msg, exists := messagesToPrint[parts[0]]; exists {
+			if len(parts) < 2 {
+				return msg
+			}
+			return msg + parts[1]
 		}
-		return line
+	case "log":
+		return strings.TrimSuffix(event.Message, "\n")
 	}
 	return ""
 }
+
+func idsToString(ids []uint32) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return strings.Join(strs, ", ")
+}
+
+func queueStatusToString(status model.SpoolStatus, indent string) string {
+	str := "Upload Queue: " + strconv.Itoa(status.Batches) + " batches of measurements (" + strconv.FormatInt(status.Bytes, 10) + " bytes)"
+	if status.Batches > 0 {
+		str += "\n" + indent + "Oldest: " + status.Oldest.Local().Format(time.RFC3339)
+	}
+	if status.Evicted > 0 {
+		str += "\n" + indent + "Evicted: " + strconv.Itoa(status.Evicted) + " batches (queue full)"
+	}
+	if status.Failed > 0 {
+		str += "\n" + indent + "Rejected: " + strconv.Itoa(status.Failed) + " batches (in the " + model.DEAD_LETTER_PATH + " directory of the queue)"
+	}
+	if status.LastError != "" {
+		str += "\n" + indent + "Last Error: " + status.LastError
+		str += "\n" + indent + "Next Retry: " + status.NextRetry.Local().Format(time.RFC3339)
+	}
+	return str
+}
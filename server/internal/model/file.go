@@ -0,0 +1,104 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+const CONFIG_FILE_MODE = 0600 // the gateway file holds passwords and tokens
+const CONFIG_BACKUPS = 3      // <file>.1 (newest) to <file>.3
+
+// the sensors are saved whenever a block of message counters is reserved and
+// when the counters are flushed (every minute), rotating the backups every
+// time would only keep the last few minutes
+const CONFIG_BACKUP_INTERVAL = time.Hour
+
+func backupPath(filePath string, i int) string {
+	return filePath + "." + strconv.Itoa(i)
+}
+
+// writeConfigFile replaces a file of the config directory atomically: a crash
+// leaves either the old or the new content, never a mix of both
+func writeConfigFile(fileName string, data []byte) error {
+	configPath, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+	filePath := path.Join(configPath, fileName)
+
+	err = backupConfigFile(filePath)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filePath, data)
+}
+
+// writes to a temporary file (created with CONFIG_FILE_MODE) which is then
+// renamed over filePath
+func writeFileAtomic(filePath string, data []byte) error {
+	dir := path.Dir(filePath)
+	tmp, err := os.CreateTemp(dir, path.Base(filePath)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filePath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// the rename itself is only durable once the directory is synced
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// backupConfigFile copies the file to <file>.1 after shifting the older
+// backups, unless <file>.1 is less than CONFIG_BACKUP_INTERVAL old
+func backupConfigFile(filePath string) error {
+	info, err := os.Stat(backupPath(filePath, 1))
+	if err == nil && time.Since(info.ModTime()) < CONFIG_BACKUP_INTERVAL {
+		return nil
+	}
+
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := CONFIG_BACKUPS - 1; i >= 1; i-- {
+		err = os.Rename(backupPath(filePath, i), backupPath(filePath, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return writeFileAtomic(backupPath(filePath, 1), data)
+}
+
+// the server refuses to start with a file it cannot parse rather than
+// overwrite it with empty settings
+func corruptConfigFileError(fileName string, err error) error {
+	configPath, _ := GetConfigDir()
+	filePath := path.Join(configPath, fileName)
+	return fmt.Errorf("%s is corrupt (%w): restore it from one of its backups (%s to %s) or remove it to start over", filePath, err, backupPath(filePath, 1), backupPath(filePath, CONFIG_BACKUPS))
+}
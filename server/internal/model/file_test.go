@@ -0,0 +1,146 @@
+package model
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestConfigDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	SetConfigDir(dir)
+	t.Cleanup(func() { SetConfigDir("") })
+	return dir
+}
+
+func readTestFile(t *testing.T, filePath string) string {
+	t.Helper()
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filePath := path.Join(dir, "file.json")
+
+	for _, content := range []string{"first", "second, longer than the first", ""} {
+		err := writeFileAtomic(filePath, []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := readTestFile(t, filePath); data != content {
+			t.Errorf("expected %q, got %q", content, data)
+		}
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != CONFIG_FILE_MODE {
+		t.Errorf("expected mode %o, got %o", CONFIG_FILE_MODE, info.Mode().Perm())
+	}
+	// no temporary file is left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the file in the directory, got %d entries", len(entries))
+	}
+
+	err = writeFileAtomic(path.Join(dir, "missing", "file.json"), []byte("content"))
+	if err == nil {
+		t.Error("expected an error writing to a missing directory")
+	}
+}
+
+// the backups are only rotated once <file>.1 is CONFIG_BACKUP_INTERVAL old,
+// and the oldest one is dropped after CONFIG_BACKUPS
+func TestConfigBackupRotation(t *testing.T) {
+	dir := newTestConfigDir(t)
+	filePath := path.Join(dir, "file.json")
+	old := time.Now().Add(-2 * CONFIG_BACKUP_INTERVAL)
+
+	// nothing to back up the first time
+	err := writeConfigFile("file.json", []byte("0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(backupPath(filePath, 1)); !os.IsNotExist(err) {
+		t.Error("a backup was made without a previous file")
+	}
+
+	for i := 1; i <= CONFIG_BACKUPS+1; i++ {
+		err = writeConfigFile("file.json", []byte(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a write shortly after does not rotate the backups
+		err = writeConfigFile("file.json", []byte(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := readTestFile(t, backupPath(filePath, 1)); data != strconv.Itoa(i-1) {
+			t.Errorf("write %d: expected %q in the newest backup, got %q", i, strconv.Itoa(i-1), data)
+		}
+		err = os.Chtimes(backupPath(filePath, 1), old, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the file was written with 0 to 4, the backups keep 3 to 1
+	if data := readTestFile(t, filePath); data != strconv.Itoa(CONFIG_BACKUPS+1) {
+		t.Errorf("expected %q in the file, got %q", strconv.Itoa(CONFIG_BACKUPS+1), data)
+	}
+	for i := 1; i <= CONFIG_BACKUPS; i++ {
+		expected := strconv.Itoa(CONFIG_BACKUPS + 1 - i)
+		if data := readTestFile(t, backupPath(filePath, i)); data != expected {
+			t.Errorf("backup %d: expected %q, got %q", i, expected, data)
+		}
+	}
+	if _, err := os.Stat(backupPath(filePath, CONFIG_BACKUPS+1)); !os.IsNotExist(err) {
+		t.Errorf("expected at most %d backups", CONFIG_BACKUPS)
+	}
+}
+
+// a file that can't be parsed is left as is and the error points to the backups
+func TestCorruptConfigFileIsRefused(t *testing.T) {
+	for _, c := range []struct {
+		fileName string
+		content  string
+		load     func() error
+	}{
+		{GATEWAY_FILE, `{"id": "gateway", "password":`, func() error { return LoadSettings(&Gateway{}, GATEWAY_FILE) }},
+		{GATEWAY_FILE, `{"schema_version": 1, "id": 42}`, func() error { return LoadSettings(&Gateway{}, GATEWAY_FILE) }},
+		{SENSORS_FILE, `[{"mac": [1, 2, 3`, func() error { return NewSensorRegistry(SENSORS_FILE).Load() }},
+		{SENSORS_FILE, `{"schema_version": 1, "sensors": "none"}`, func() error { return NewSensorRegistry(SENSORS_FILE).Load() }},
+	} {
+		dir := newTestConfigDir(t)
+		filePath := path.Join(dir, c.fileName)
+		err := os.WriteFile(filePath, []byte(c.content), CONFIG_FILE_MODE)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.load()
+		if err == nil {
+			t.Errorf("%s: the corrupt file %q was loaded", c.fileName, c.content)
+			continue
+		}
+		if !strings.Contains(err.Error(), "corrupt") || !strings.Contains(err.Error(), backupPath(filePath, 1)) {
+			t.Errorf("%s: the error does not point to the backups: %v", c.fileName, err)
+		}
+		if data := readTestFile(t, filePath); data != c.content {
+			t.Errorf("%s: the corrupt file was overwritten with %q", c.fileName, data)
+		}
+	}
+}
@@ -1,57 +1,468 @@
 package model
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const GATEWAY_FILE = "gateway.json"
+const DEFAULT_MQTT_TOPIC = "ssmachmos/{gateway}/{sensor}/{type}"
+
+// the measurements are sent to every sink of the gateway
+//
+//	openphm: the openPHM gateway API (gateway id and password in the body)
+//	http:    POST of the measurements to any URL (Token as a bearer token)
+//	mqtt:    every measurement published on Topic ({gateway}, {sensor} and {type} are replaced)
+//	influx:  InfluxDB line protocol, URL is the full write URL (with precision=ns)
+//	file:    JSON lines appended to a file per day in the directory URL
+var SINK_TYPES = []string{"openphm", "http", "mqtt", "influx", "file"}
+
+type Sink struct {
+	Name     string `json:"name"` // also the name of its upload queue
+	Type     string `json:"type"`
+	URL      string `json:"url"`
+	Topic    string `json:"topic,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// the batches a sink rejects are moved to this directory of its upload queue
+const DEAD_LETTER_PATH = "failed"
+
+// SpoolStatus is the state of the upload queue of a sink
+type SpoolStatus struct {
+	Batches   int       `json:"batches"`
+	Bytes     int64     `json:"bytes"`
+	Oldest    time.Time `json:"oldest"`
+	Evicted   int       `json:"evicted"`
+	Failed    int       `json:"failed"` // batches rejected by the sink
+	LastError string    `json:"last_error"`
+	NextRetry time.Time `json:"next_retry"`
+}
 
 type Gateway struct {
-	Id               string    `json:"id"`
-	Password         string    `json:"password"`
-	DataCharUUID     [4]uint32 `json:"data_char_uuid"`
-	SettingsCharUUID [4]uint32 `json:"settings_char_uuid"`
-	HTTPEndpoint     string    `json:"http_endpoint"`
+	Id               string         `json:"id"`
+	Password         string         `json:"password"`
+	DataCharUUID     [4]uint32      `json:"data_char_uuid"`
+	SettingsCharUUID [4]uint32      `json:"settings_char_uuid"`
+	Sinks            []Sink         `json:"sinks"`
+	APIAddress       string         `json:"api_address"`                   // address of the HTTP API, empty when disabled
+	APIToken         string         `json:"api_token,omitempty"`           // bearer token with full access to the HTTP API
+	APIReadOnlyToken string         `json:"api_read_only_token,omitempty"` // bearer token with the read-only role of the socket
+	Socket           SocketSettings `json:"socket"`
+	Sessions         int            `json:"sessions,omitempty"`  // sensors awake at the same time, DEFAULT_SESSIONS when 0
+	Retention        int            `json:"retention,omitempty"` // days the measurements are stored locally, forever when 0
+
+	// the gateway is shared by the server, the socket and the HTTP API: the
+	// functions of this file take it to read or change the fields, the other
+	// packages go through them (or CopyGateway)
+	mutex sync.RWMutex
+}
+
+// how many sensors the adapter can serve at the same time
+const DEFAULT_SESSIONS = 1
+const MAX_SESSIONS = 16
+
+// the local store keeps at most 10 years of measurements
+const MAX_RETENTION = 3650
+
+const DEFAULT_SOCKET_PATH = "/tmp/ss_machmos.sock"
+const DEFAULT_SOCKET_MODE = "0660"
+const SOCKET_PATH_ENV = "SSMACHMOS_SOCKET" // overrides the socket path (for the CLI as well)
+
+// who can use the control socket, the user running the server and root
+// always have full access. When no user or group is listed, the other
+// processes allowed to connect by the file mode have read-only access.
+type SocketSettings struct {
+	Path           string   `json:"path,omitempty"`
+	Mode           string   `json:"mode,omitempty"` // octal, e.g. "0660"
+	Users          []uint32 `json:"users,omitempty"`
+	Groups         []uint32 `json:"groups,omitempty"`
+	ReadOnlyUsers  []uint32 `json:"read_only_users,omitempty"`
+	ReadOnlyGroups []uint32 `json:"read_only_groups,omitempty"`
 }
 
 func LoadSettings(gateway *Gateway, fileName string) error {
-	configPath, err := os.UserConfigDir()
+	configPath, err := GetConfigDir()
 	if err != nil {
 		return err
 	}
 
-	err = os.MkdirAll(path.Join(configPath, "ss_machmos"), 0777)
+	jsonStr, err := os.ReadFile(path.Join(configPath, fileName))
 	if err != nil {
+		gateway = &Gateway{}
 		return err
 	}
-
-	jsonStr, err := os.ReadFile(path.Join(configPath, "ss_machmos", fileName))
+	jsonStr, migrated, err := migrateConfigFile(fileName, jsonStr, GATEWAY_MIGRATIONS)
 	if err != nil {
-		gateway = &Gateway{}
 		return err
 	}
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
 	err = json.Unmarshal(jsonStr, gateway)
 	if err != nil {
 		gateway = &Gateway{}
-		return err
+		return corruptConfigFileError(fileName, err)
+	}
+
+	if migrated {
+		return saveSettings(gateway, fileName)
 	}
 	return nil
 }
 
+// ReadSocketSettings reads the socket settings saved by the server without
+// migrating or saving anything, the CLI must not change the config files
+func ReadSocketSettings(fileName string) (SocketSettings, error) {
+	configPath, err := getConfigPath()
+	if err != nil {
+		return SocketSettings{}, err
+	}
+
+	jsonStr, err := os.ReadFile(path.Join(configPath, fileName))
+	if err != nil {
+		return SocketSettings{}, err
+	}
+	settings := struct {
+		Socket SocketSettings `json:"socket"`
+	}{}
+	err = json.Unmarshal(jsonStr, &settings)
+	if err != nil {
+		return SocketSettings{}, corruptConfigFileError(fileName, err)
+	}
+	return settings.Socket, nil
+}
+
+func isNameValid(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func AddGatewaySink(gateway *Gateway, sink Sink) error {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	return addSink(gateway, sink)
+}
+
+// the mutex must be held
+func addSink(gateway *Gateway, sink Sink) error {
+	if !isNameValid(sink.Name) {
+		return errors.New("invalid sink name " + sink.Name + " (only letters, digits, - and _ are allowed)")
+	}
+	knownType := false
+	for _, t := range SINK_TYPES {
+		knownType = knownType || t == sink.Type
+	}
+	if !knownType {
+		return errors.New("unknown sink type " + sink.Type + " (must be one of " + strings.Join(SINK_TYPES, ", ") + ")")
+	}
+	if sink.URL == "" {
+		return errors.New("the sink needs a URL")
+	}
+	for _, s := range gateway.Sinks {
+		if s.Name == sink.Name {
+			return errors.New("a sink named " + sink.Name + " already exists")
+		}
+	}
+	if sink.Type == "mqtt" && sink.Topic == "" {
+		sink.Topic = DEFAULT_MQTT_TOPIC
+	}
+	gateway.Sinks = append(gateway.Sinks, sink)
+	return saveSettings(gateway, GATEWAY_FILE)
+}
+
+func RemoveGatewaySink(gateway *Gateway, name string) error {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	sinks := []Sink{}
+	for _, s := range gateway.Sinks {
+		if s.Name != name {
+			sinks = append(sinks, s)
+		}
+	}
+	if len(sinks) == len(gateway.Sinks) {
+		return errors.New("sink " + name + " not found")
+	}
+	gateway.Sinks = sinks
+	return saveSettings(gateway, GATEWAY_FILE)
+}
+
+// GetGatewaySinks returns a copy of the sinks
+func GetGatewaySinks(gateway *Gateway) []Sink {
+	gateway.mutex.RLock()
+	defer gateway.mutex.RUnlock()
+	if gateway.Sinks == nil {
+		return nil
+	}
+	return append([]Sink{}, gateway.Sinks...)
+}
+
+// the sinks are set (but not saved) when there are none yet
+func SetDefaultGatewaySinks(gateway *Gateway, sinks []Sink) {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	if gateway.Sinks == nil {
+		gateway.Sinks = sinks
+	}
+}
+
+// URL of the openPHM sink, empty if there is none
+func GetGatewayHTTPEndpoint(gateway *Gateway) string {
+	gateway.mutex.RLock()
+	defer gateway.mutex.RUnlock()
+	for _, s := range gateway.Sinks {
+		if s.Type == "openphm" {
+			return s.URL
+		}
+	}
+	return ""
+}
+
+// changes the URL of the openPHM sink (it is added if there is none)
 func SetGatewayHTTPEndpoint(gateway *Gateway, endpoint string) error {
-	gateway.HTTPEndpoint = endpoint
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	for i, s := range gateway.Sinks {
+		if s.Type == "openphm" {
+			gateway.Sinks[i].URL = endpoint
+			return saveSettings(gateway, GATEWAY_FILE)
+		}
+	}
+	return addSink(gateway, Sink{Name: "openphm", Type: "openphm", URL: endpoint})
+}
+
+func GetGatewayAPIAddress(gateway *Gateway) string {
+	gateway.mutex.RLock()
+	defer gateway.mutex.RUnlock()
+	return gateway.APIAddress
+}
+
+func SetGatewayAPIAddress(gateway *Gateway, address string) error {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	gateway.APIAddress = address
+	return saveSettings(gateway, GATEWAY_FILE)
+}
+
+// GenerateGatewayAPITokens replaces both tokens of the HTTP API, the old
+// ones stop working
+func GenerateGatewayAPITokens(gateway *Gateway) error {
+	tokens := [2]string{}
+	for i := range tokens {
+		b := make([]byte, 32)
+		_, err := rand.Read(b)
+		if err != nil {
+			return err
+		}
+		tokens[i] = hex.EncodeToString(b)
+	}
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	gateway.APIToken = tokens[0]
+	gateway.APIReadOnlyToken = tokens[1]
+	return saveSettings(gateway, GATEWAY_FILE)
+}
+
+// the full access token and the read-only token of the HTTP API
+func GetGatewayAPITokens(gateway *Gateway) (string, string) {
+	gateway.mutex.RLock()
+	defer gateway.mutex.RUnlock()
+	return gateway.APIToken, gateway.APIReadOnlyToken
+}
+
+func GetSessions(gateway *Gateway) int {
+	if gateway == nil {
+		return DEFAULT_SESSIONS
+	}
+	gateway.mutex.RLock()
+	defer gateway.mutex.RUnlock()
+	if gateway.Sessions == 0 {
+		return DEFAULT_SESSIONS
+	}
+	return gateway.Sessions
+}
+
+func SetGatewaySessions(gateway *Gateway, sessions int) error {
+	if sessions < 1 || sessions > MAX_SESSIONS {
+		return errors.New("invalid number of sessions " + strconv.Itoa(sessions) + " (must be between 1 and " + strconv.Itoa(MAX_SESSIONS) + ")")
+	}
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	gateway.Sessions = sessions
 	return saveSettings(gateway, GATEWAY_FILE)
 }
 
+// days the measurements are stored locally, 0 keeps them forever
+func GetRetention(gateway *Gateway) int {
+	gateway.mutex.RLock()
+	defer gateway.mutex.RUnlock()
+	return gateway.Retention
+}
+
+// 0 keeps the measurements forever
+func SetGatewayRetention(gateway *Gateway, days int) error {
+	if days < 0 || days > MAX_RETENTION {
+		return errors.New("invalid retention " + strconv.Itoa(days) + " (must be between 0 (forever) and " + strconv.Itoa(MAX_RETENTION) + " days)")
+	}
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	gateway.Retention = days
+	return saveSettings(gateway, GATEWAY_FILE)
+}
+
+func GetSocketPath(gateway *Gateway) string {
+	if path := os.Getenv(SOCKET_PATH_ENV); path != "" {
+		return path
+	}
+	if gateway == nil {
+		return DEFAULT_SOCKET_PATH
+	}
+	gateway.mutex.RLock()
+	defer gateway.mutex.RUnlock()
+	if gateway.Socket.Path != "" {
+		return gateway.Socket.Path
+	}
+	return DEFAULT_SOCKET_PATH
+}
+
+func GetSocketMode(gateway *Gateway) (os.FileMode, error) {
+	if gateway == nil {
+		return parseSocketMode(DEFAULT_SOCKET_MODE)
+	}
+	gateway.mutex.RLock()
+	defer gateway.mutex.RUnlock()
+	return parseSocketMode(gateway.Socket.Mode)
+}
+
+// an empty mode is the default one
+func parseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		mode = DEFAULT_SOCKET_MODE
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, errors.New("invalid socket mode " + mode + " (must be octal, e.g. 0660)")
+	}
+	return os.FileMode(m), nil
+}
+
+// GetSocketSettings returns a copy of who can use the control socket
+func GetSocketSettings(gateway *Gateway) SocketSettings {
+	if gateway == nil {
+		return SocketSettings{}
+	}
+	gateway.mutex.RLock()
+	defer gateway.mutex.RUnlock()
+	return copySocketSettings(gateway.Socket)
+}
+
+func copySocketSettings(settings SocketSettings) SocketSettings {
+	settings.Users = append([]uint32(nil), settings.Users...)
+	settings.Groups = append([]uint32(nil), settings.Groups...)
+	settings.ReadOnlyUsers = append([]uint32(nil), settings.ReadOnlyUsers...)
+	settings.ReadOnlyGroups = append([]uint32(nil), settings.ReadOnlyGroups...)
+	return settings
+}
+
+// an empty path resets it to the default, takes effect on restart
+func SetSocketPath(gateway *Gateway, path string) error {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	gateway.Socket.Path = path
+	return saveSettings(gateway, GATEWAY_FILE)
+}
+
+// takes effect on restart
+func SetSocketMode(gateway *Gateway, mode string) error {
+	_, err := parseSocketMode(mode)
+	if err != nil {
+		return err
+	}
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	gateway.Socket.Mode = mode
+	return saveSettings(gateway, GATEWAY_FILE)
+}
+
+func removeId(ids []uint32, id uint32) []uint32 {
+	res := []uint32{}
+	for _, i := range ids {
+		if i != id {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// isGroup selects between a gid and a uid, a peer is either read-only or has full access
+func AllowSocketPeer(gateway *Gateway, id uint32, isGroup bool, readOnly bool) error {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	revokeSocketPeer(gateway, id, isGroup)
+	switch {
+	case isGroup && readOnly:
+		gateway.Socket.ReadOnlyGroups = append(gateway.Socket.ReadOnlyGroups, id)
+	case isGroup:
+		gateway.Socket.Groups = append(gateway.Socket.Groups, id)
+	case readOnly:
+		gateway.Socket.ReadOnlyUsers = append(gateway.Socket.ReadOnlyUsers, id)
+	default:
+		gateway.Socket.Users = append(gateway.Socket.Users, id)
+	}
+	return saveSettings(gateway, GATEWAY_FILE)
+}
+
+func RevokeSocketPeer(gateway *Gateway, id uint32, isGroup bool) error {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+	revokeSocketPeer(gateway, id, isGroup)
+	return saveSettings(gateway, GATEWAY_FILE)
+}
+
+// the mutex must be held
+func revokeSocketPeer(gateway *Gateway, id uint32, isGroup bool) {
+	if isGroup {
+		gateway.Socket.Groups = removeId(gateway.Socket.Groups, id)
+		gateway.Socket.ReadOnlyGroups = removeId(gateway.Socket.ReadOnlyGroups, id)
+	} else {
+		gateway.Socket.Users = removeId(gateway.Socket.Users, id)
+		gateway.Socket.ReadOnlyUsers = removeId(gateway.Socket.ReadOnlyUsers, id)
+	}
+}
+
+// the id and the password of the gateway on openPHM
+func GetGatewayCredentials(gateway *Gateway) (string, string) {
+	gateway.mutex.RLock()
+	defer gateway.mutex.RUnlock()
+	return gateway.Id, gateway.Password
+}
+
 func SetGatewayId(gateway *Gateway, id string) error {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
 	gateway.Id = id
 	return saveSettings(gateway, GATEWAY_FILE)
 }
 
 func SetGatewayPassword(gateway *Gateway, password string) error {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
 	gateway.Password = password
 	return saveSettings(gateway, GATEWAY_FILE)
 }
@@ -60,6 +471,8 @@ func GetDataCharUUID(gateway *Gateway) ([4]uint32, error) {
 	if gateway == nil {
 		return [4]uint32{}, errors.New("gateway is nil")
 	}
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
 	if gateway.DataCharUUID == [4]uint32{0, 0, 0, 0} {
 		var err error
 		gateway.DataCharUUID, err = GenerateUUID()
@@ -78,6 +491,8 @@ func GetSettingsCharUUID(gateway *Gateway) ([4]uint32, error) {
 	if gateway == nil {
 		return [4]uint32{}, errors.New("gateway is nil")
 	}
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
 	if gateway.SettingsCharUUID == [4]uint32{0, 0, 0, 0} {
 		var err error
 		gateway.SettingsCharUUID, err = GenerateUUID()
@@ -92,24 +507,41 @@ func GetSettingsCharUUID(gateway *Gateway) ([4]uint32, error) {
 	return gateway.SettingsCharUUID, nil
 }
 
+// CopyGateway returns a copy of the settings that can be read (or
+// marshaled) without the mutex
+func CopyGateway(gateway *Gateway) *Gateway {
+	gateway.mutex.RLock()
+	defer gateway.mutex.RUnlock()
+	c := &Gateway{
+		Id:               gateway.Id,
+		Password:         gateway.Password,
+		DataCharUUID:     gateway.DataCharUUID,
+		SettingsCharUUID: gateway.SettingsCharUUID,
+		APIAddress:       gateway.APIAddress,
+		APIToken:         gateway.APIToken,
+		APIReadOnlyToken: gateway.APIReadOnlyToken,
+		Socket:           copySocketSettings(gateway.Socket),
+		Sessions:         gateway.Sessions,
+		Retention:        gateway.Retention,
+	}
+	if gateway.Sinks != nil {
+		c.Sinks = append([]Sink{}, gateway.Sinks...)
+	}
+	return c
+}
+
+// the mutex must be held
 func saveSettings(gateway *Gateway, fileName string) error {
 	if gateway == nil {
 		return errors.New("gateway is nil")
 	}
 
-	jsonStr, err := json.Marshal(gateway)
+	jsonStr, err := json.Marshal(struct {
+		SchemaVersion int `json:"schema_version"`
+		*Gateway
+	}{GATEWAY_SCHEMA_VERSION, gateway})
 	if err != nil {
 		return err
 	}
-	configPath, err := os.UserConfigDir()
-	if err != nil {
-		return err
-	}
-
-	err = os.MkdirAll(path.Join(configPath, "ss_machmos"), 0777)
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(path.Join(configPath, "ss_machmos", fileName), jsonStr, 0777)
+	return writeConfigFile(fileName, jsonStr)
 }
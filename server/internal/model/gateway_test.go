@@ -0,0 +1,144 @@
+package model
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// run with go test -race, the server, the socket and the HTTP API change
+// and read the gateway at the same time
+func TestGatewayConcurrentAccess(t *testing.T) {
+	SetConfigDir(t.TempDir())
+	t.Cleanup(func() { SetConfigDir("") })
+	gateway := &Gateway{Id: "gateway"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			err := SetGatewaySessions(gateway, 1+i)
+			if err == nil {
+				err = SetGatewayRetention(gateway, i)
+			}
+			if err == nil {
+				err = AddGatewaySink(gateway, Sink{Name: "sink-" + strconv.Itoa(i), Type: "http", URL: "http://localhost"})
+			}
+			if err == nil {
+				err = AllowSocketPeer(gateway, uint32(i), i%2 == 0, i%3 == 0)
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			err := GenerateGatewayAPITokens(gateway)
+			if err == nil {
+				err = SetGatewayHTTPEndpoint(gateway, "http://localhost/gateway_data")
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			c := CopyGateway(gateway)
+			// the copy is not shared with the gateway
+			for j := range c.Sinks {
+				c.Sinks[j].URL = ""
+			}
+			c.Socket.Users = append(c.Socket.Users, 1000)
+			_, err := json.Marshal(c)
+			if err != nil {
+				t.Error(err)
+			}
+			GetSessions(gateway)
+			GetSocketSettings(gateway)
+			GetGatewayAPITokens(gateway)
+			GetGatewaySinks(gateway)
+		}()
+	}
+	wg.Wait()
+
+	if len(gateway.Sinks) != 9 {
+		t.Errorf("expected 9 sinks, got %d", len(gateway.Sinks))
+	}
+	for _, s := range gateway.Sinks {
+		if s.URL == "" {
+			t.Error("changes to a copy reached the gateway")
+		}
+	}
+
+	saved := &Gateway{}
+	err := LoadSettings(saved, GATEWAY_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Sinks) != len(gateway.Sinks) || saved.APIToken != gateway.APIToken {
+		t.Error("the saved settings do not match the gateway")
+	}
+}
+
+// the CLI reads the socket settings of a file the server has not migrated yet
+// without touching the config dir
+func TestReadSocketSettings(t *testing.T) {
+	dir := t.TempDir()
+	SetConfigDir(dir)
+	t.Cleanup(func() { SetConfigDir("") })
+
+	original, err := os.ReadFile(path.Join("testdata", "v0", GATEWAY_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data map[string]interface{}
+	err = json.Unmarshal(original, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data["socket"] = map[string]interface{}{"path": "/run/ssmachmos.sock", "users": []uint32{1000}}
+	original, err = json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(dir, GATEWAY_FILE), original, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket, err := ReadSocketSettings(GATEWAY_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if socket.Path != "/run/ssmachmos.sock" || len(socket.Users) != 1 || socket.Users[0] != 1000 {
+		t.Errorf("unexpected socket settings %+v", socket)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only %s in the config dir, got %d files", GATEWAY_FILE, len(entries))
+	}
+	saved, err := os.ReadFile(path.Join(dir, GATEWAY_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(saved) != string(original) {
+		t.Error("the gateway file was rewritten")
+	}
+
+	SetConfigDir(path.Join(dir, "missing"))
+	_, err = ReadSocketSettings(GATEWAY_FILE)
+	if err == nil {
+		t.Error("expected an error without a gateway file")
+	}
+	if _, err := os.Stat(path.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Error("the config dir was created")
+	}
+}
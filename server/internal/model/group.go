@@ -0,0 +1,188 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const GROUPS_FILE = "groups.json"
+
+var GROUPS_MIGRATIONS = []migration{}
+
+var GROUPS_SCHEMA_VERSION = len(GROUPS_MIGRATIONS)
+
+// Group is a named set of sensors the settings can be changed for at once,
+// defined by exactly one of a tag, a machine or a list of MAC addresses
+type Group struct {
+	Name    string    `json:"name"`
+	Tag     string    `json:"tag,omitempty"`
+	Machine string    `json:"machine,omitempty"`
+	Macs    [][6]byte `json:"macs,omitempty"`
+}
+
+func (g *Group) ToString() string {
+	switch {
+	case g.Tag != "":
+		return g.Name + ": sensors tagged " + g.Tag
+	case g.Machine != "":
+		return g.Name + ": sensors on machine " + g.Machine
+	}
+	macs := []string{}
+	for _, mac := range g.Macs {
+		macs = append(macs, MacToString(mac))
+	}
+	return g.Name + ": " + strings.Join(macs, ", ")
+}
+
+// Members are the MAC addresses of the paired sensors in the group
+func (g *Group) Members(sensors []Sensor) [][6]byte {
+	members := [][6]byte{}
+	for _, s := range sensors {
+		switch {
+		case g.Tag != "":
+			if s.HasTag(g.Tag) {
+				members = append(members, s.Mac)
+			}
+		case g.Machine != "":
+			if strings.EqualFold(s.Machine, g.Machine) {
+				members = append(members, s.Mac)
+			}
+		default:
+			for _, mac := range g.Macs {
+				if s.Mac == mac {
+					members = append(members, s.Mac)
+					break
+				}
+			}
+		}
+	}
+	return members
+}
+
+// content of the groups file
+type groupsFile struct {
+	SchemaVersion int     `json:"schema_version"`
+	Groups        []Group `json:"groups"`
+}
+
+// GroupRegistry holds the groups of sensors, it is safe for concurrent use
+type GroupRegistry struct {
+	mutex    sync.RWMutex
+	fileName string
+	groups   []Group
+}
+
+func NewGroupRegistry(fileName string) *GroupRegistry {
+	return &GroupRegistry{
+		fileName: fileName,
+		groups:   []Group{},
+	}
+}
+
+// Load replaces the groups with the ones saved in the file of the registry,
+// the registry is left empty if there is no file yet
+func (r *GroupRegistry) Load() error {
+	configPath, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+	jsonStr, err := os.ReadFile(path.Join(configPath, r.fileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	jsonStr, migrated, err := migrateConfigFile(r.fileName, jsonStr, GROUPS_MIGRATIONS)
+	if err != nil {
+		return err
+	}
+	file := groupsFile{}
+	err = json.Unmarshal(jsonStr, &file)
+	if err != nil {
+		return corruptConfigFileError(r.fileName, err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.groups = file.Groups
+	if r.groups == nil {
+		r.groups = []Group{}
+	}
+	if migrated {
+		return r.save()
+	}
+	return nil
+}
+
+// the mutex must be held
+func (r *GroupRegistry) save() error {
+	jsonStr, err := json.Marshal(groupsFile{SchemaVersion: GROUPS_SCHEMA_VERSION, Groups: r.groups})
+	if err != nil {
+		return err
+	}
+	return writeConfigFile(r.fileName, jsonStr)
+}
+
+func (r *GroupRegistry) List() []Group {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return append([]Group{}, r.groups...)
+}
+
+func (r *GroupRegistry) Get(name string) (Group, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, g := range r.groups {
+		if g.Name == name {
+			return g, true
+		}
+	}
+	return Group{}, false
+}
+
+func (r *GroupRegistry) Add(group Group) error {
+	// group names share the argument of "config --sensor" with MAC addresses
+	if !isNameValid(group.Name) {
+		return errors.New("invalid group name " + group.Name + " (only letters, digits, - and _ are allowed)")
+	}
+	criteria := 0
+	if group.Tag != "" {
+		criteria++
+	}
+	if group.Machine != "" {
+		criteria++
+	}
+	if len(group.Macs) > 0 {
+		criteria++
+	}
+	if criteria != 1 {
+		return errors.New("a group is defined by exactly one of a tag, a machine or a list of MAC addresses")
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, g := range r.groups {
+		if g.Name == group.Name {
+			return errors.New("group " + group.Name + " already exists")
+		}
+	}
+	r.groups = append(r.groups, group)
+	return r.save()
+}
+
+func (r *GroupRegistry) Remove(name string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, g := range r.groups {
+		if g.Name == name {
+			r.groups = append(r.groups[:i], r.groups[i+1:]...)
+			return r.save()
+		}
+	}
+	return errors.New("group " + name + " not found")
+}
@@ -0,0 +1,82 @@
+package model
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+// the sensors of a group with different collection capacities, the last
+// one can't take the settings the others accept
+func newTestGroup(t *testing.T) (*SensorRegistry, Group) {
+	t.Helper()
+	registry, macs := newTestRegistry(t, 3)
+	small := getDefaultSensor([6]byte{0x5E, 0, 0, 0, 1, 0}, []string{"vibration", "temperature"}, 100000, &PublicKey{}, 2)
+	err := registry.Add(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mac := range append(macs, small.Mac) {
+		err = registry.Update(mac, func(sensor *Sensor) error {
+			sensor.Tags = []string{"line-2"}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return registry, Group{Name: "line-2", Tag: "line-2"}
+}
+
+func TestGroupUpdateRollsBack(t *testing.T) {
+	registry, group := newTestGroup(t)
+	macs := group.Members(registry.List())
+	if len(macs) != 4 {
+		t.Fatalf("expected 4 members, got %d", len(macs))
+	}
+	before := registry.List()
+	configDir, err := GetConfigDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(path.Join(configDir, SENSORS_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 6 bytes * 1000 Hz * 20 s fits 1 000 000 bytes, not 100 000
+	err = UpdateSensorsSettings(macs, [][2]string{
+		{"name", "renamed"},
+		{"vibration_sampling_duration", "20"},
+		{"vibration_sampling_frequency", "1000"},
+	}, registry, nil)
+	if err == nil {
+		t.Fatal("settings exceeding the collection capacity of a member were accepted")
+	}
+
+	after := registry.List()
+	for i := range before {
+		if after[i].Name != before[i].Name || after[i].Settings["vibration"] != before[i].Settings["vibration"] {
+			t.Errorf("sensor %s was changed by a failed update", MacToString(after[i].Mac))
+		}
+	}
+	current, err := os.ReadFile(path.Join(configDir, SENSORS_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != string(saved) {
+		t.Error("the sensors file was saved by a failed update")
+	}
+
+	// every member but the small one accepts them
+	err = UpdateSensorsSettings(macs[:3], [][2]string{{"vibration_sampling_duration", "20"}, {"vibration_sampling_frequency", "1000"}}, registry, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mac := range macs[:3] {
+		sensor, _ := registry.Get(mac)
+		if sensor.Settings["vibration"].SamplingFrequency != 1000 || sensor.Settings["vibration"].SamplingDuration != 20 {
+			t.Errorf("sensor %s was not updated", MacToString(mac))
+		}
+	}
+}
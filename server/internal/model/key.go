@@ -0,0 +1,164 @@
+package model
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+)
+
+const (
+	KEY_RSA     = "rsa"
+	KEY_ED25519 = "ed25519"
+	KEY_P256    = "p256"
+)
+
+// see protocol.md (key algorithm of the pairing request)
+var KEY_ALGORITHMS = map[byte]string{
+	0x00: KEY_RSA,
+	0x01: KEY_ED25519,
+	0x02: KEY_P256,
+}
+
+// PublicKey is the public key of a sensor, whatever its algorithm.
+// It is stored as {"algorithm": ..., "key": <PKIX DER in base64>}
+type PublicKey struct {
+	Algorithm string
+	key       crypto.PublicKey
+}
+
+type publicKeyJSON struct {
+	Algorithm string `json:"algorithm,omitempty"`
+	Key       []byte `json:"key,omitempty"`
+}
+
+func (k PublicKey) MarshalJSON() ([]byte, error) {
+	if k.key == nil {
+		return json.Marshal(publicKeyJSON{})
+	}
+	der, err := x509.MarshalPKIXPublicKey(k.key)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(publicKeyJSON{Algorithm: k.Algorithm, Key: der})
+}
+
+func (k *PublicKey) UnmarshalJSON(data []byte) error {
+	var j publicKeyJSON
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+
+	if j.Key == nil {
+		*k = PublicKey{}
+		return nil
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(j.Key)
+	if err != nil {
+		return err
+	}
+	parsed, err := newPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	*k = *parsed
+	return nil
+}
+
+func newPublicKey(pub crypto.PublicKey) (*PublicKey, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return &PublicKey{Algorithm: KEY_RSA, key: key}, nil
+	case ed25519.PublicKey:
+		return &PublicKey{Algorithm: KEY_ED25519, key: key}, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("unsupported elliptic curve")
+		}
+		return &PublicKey{Algorithm: KEY_P256, key: key}, nil
+	}
+	return nil, errors.New("unsupported public key algorithm")
+}
+
+// SignatureSize is the length in bytes of the signatures made with the
+// private key (P-256 signatures are r | s, 32 bytes each)
+func (k *PublicKey) SignatureSize() int {
+	switch key := k.key.(type) {
+	case *rsa.PublicKey:
+		return key.Size()
+	case ed25519.PublicKey:
+		return ed25519.SignatureSize
+	case *ecdsa.PublicKey:
+		return 64
+	}
+	return 0
+}
+
+func VerifySignature(data []byte, signature []byte, publicKey *PublicKey) bool {
+	if publicKey == nil || len(signature) != publicKey.SignatureSize() {
+		return false
+	}
+
+	switch key := publicKey.key.(type) {
+	case *rsa.PublicKey:
+		hash := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, data, signature)
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(data)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, hash[:], r, s)
+	}
+	return false
+}
+
+// ParsePublicKey accepts a PEM encoded PKIX public key or, to spare the
+// sensors some bytes, a raw Ed25519 key (32 bytes) or a raw uncompressed
+// P-256 point (65 bytes)
+func ParsePublicKey(algorithm string, value []byte) (*PublicKey, error) {
+	var publicKey *PublicKey
+
+	block, _ := pem.Decode(value)
+	if block != nil {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, err = newPublicKey(pub)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		switch algorithm {
+		case KEY_ED25519:
+			if len(value) != ed25519.PublicKeySize {
+				return nil, errors.New("failed to parse public key")
+			}
+			publicKey = &PublicKey{Algorithm: KEY_ED25519, key: ed25519.PublicKey(append([]byte{}, value...))}
+		case KEY_P256:
+			x, y := elliptic.Unmarshal(elliptic.P256(), value)
+			if x == nil {
+				return nil, errors.New("failed to parse public key")
+			}
+			publicKey = &PublicKey{Algorithm: KEY_P256, key: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}
+		default:
+			return nil, errors.New("failed to parse public key")
+		}
+	}
+
+	if publicKey.Algorithm != algorithm {
+		return nil, errors.New("public key doesn't match the announced algorithm")
+	}
+	return publicKey, nil
+}
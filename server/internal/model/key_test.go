@@ -0,0 +1,177 @@
+package model
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+)
+
+func encodePEM(t *testing.T, pub crypto.PublicKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// signs like the sensors do (see protocol.md)
+func signTestData(t *testing.T, key crypto.Signer, data []byte) []byte {
+	t.Helper()
+	var signature []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		hash := sha256.Sum256(data)
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, data)
+	case *ecdsa.PrivateKey:
+		hash := sha256.Sum256(data)
+		r, s, signErr := ecdsa.Sign(rand.Reader, k, hash[:])
+		signature, err = make([]byte, 64), signErr
+		if err == nil {
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+func TestParsePublicKeyAndVerifySignature(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Public := elliptic.Marshal(elliptic.P256(), p256Key.X, p256Key.Y)
+
+	cases := []struct {
+		name          string
+		algorithm     string
+		value         []byte
+		key           crypto.Signer
+		signatureSize int
+	}{
+		{"rsa pem", KEY_RSA, encodePEM(t, rsaKey.Public()), rsaKey, 256},
+		{"ed25519 pem", KEY_ED25519, encodePEM(t, ed25519Key.Public()), ed25519Key, 64},
+		{"ed25519 raw", KEY_ED25519, ed25519Key.Public().(ed25519.PublicKey), ed25519Key, 64},
+		{"p256 pem", KEY_P256, encodePEM(t, p256Key.Public()), p256Key, 64},
+		{"p256 raw", KEY_P256, p256Public, p256Key, 64},
+	}
+	data := []byte("0123456789")
+	for _, c := range cases {
+		publicKey, err := ParsePublicKey(c.algorithm, c.value)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if publicKey.Algorithm != c.algorithm || publicKey.SignatureSize() != c.signatureSize {
+			t.Errorf("%s: expected a %s key with %d bytes signatures, got %s and %d", c.name, c.algorithm, c.signatureSize, publicKey.Algorithm, publicKey.SignatureSize())
+		}
+
+		signature := signTestData(t, c.key, data)
+		if !VerifySignature(data, signature, publicKey) {
+			t.Errorf("%s: a valid signature was rejected", c.name)
+		}
+		if VerifySignature([]byte("0123456788"), signature, publicKey) {
+			t.Errorf("%s: the signature of other data was accepted", c.name)
+		}
+		tampered := append([]byte{}, signature...)
+		tampered[len(tampered)-1] ^= 0x01
+		if VerifySignature(data, tampered, publicKey) {
+			t.Errorf("%s: a tampered signature was accepted", c.name)
+		}
+		if VerifySignature(data, signature[:len(signature)-1], publicKey) || VerifySignature(data, append(signature, 0x00), publicKey) {
+			t.Errorf("%s: a signature of the wrong size was accepted", c.name)
+		}
+
+		// the key survives the sensors file
+		jsonData, err := json.Marshal(publicKey)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		saved := PublicKey{}
+		err = json.Unmarshal(jsonData, &saved)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if saved.Algorithm != c.algorithm || !VerifySignature(data, signature, &saved) {
+			t.Errorf("%s: the saved key does not verify the signature", c.name)
+		}
+	}
+
+	if VerifySignature(data, signTestData(t, ed25519Key, data), nil) {
+		t.Error("a signature was accepted without a key")
+	}
+	if VerifySignature(data, signTestData(t, ed25519Key, data), &PublicKey{}) {
+		t.Error("a signature was accepted with an empty key")
+	}
+}
+
+func TestParsePublicKeyRejectsUnsupportedKeys(t *testing.T) {
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Public := ed25519Key.Public().(ed25519.PublicKey)
+
+	cases := []struct {
+		name      string
+		algorithm string
+		value     []byte
+	}{
+		{"p384 pem", KEY_P256, encodePEM(t, p384Key.Public())},
+		{"unknown algorithm", "dsa", ed25519Public},
+		{"raw rsa", KEY_RSA, ed25519Public},
+		{"announced as p256", KEY_P256, encodePEM(t, ed25519Public)},
+		{"announced as rsa", KEY_RSA, encodePEM(t, ed25519Public)},
+		{"short ed25519", KEY_ED25519, ed25519Public[:31]},
+		{"compressed p256", KEY_P256, make([]byte, 33)},
+		{"p256 point off the curve", KEY_P256, append([]byte{0x04}, make([]byte, 64)...)},
+		{"invalid pem", KEY_RSA, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("not a key")})},
+	}
+	for _, c := range cases {
+		publicKey, err := ParsePublicKey(c.algorithm, c.value)
+		if err == nil {
+			t.Errorf("%s: expected an error, got a %s key", c.name, publicKey.Algorithm)
+		}
+	}
+
+	// nor loaded from the sensors file
+	der, err := x509.MarshalPKIXPublicKey(p384Key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonData, err := json.Marshal(publicKeyJSON{Algorithm: KEY_P256, Key: der})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json.Unmarshal(jsonData, &PublicKey{}) == nil {
+		t.Error("a P-384 key was loaded")
+	}
+}
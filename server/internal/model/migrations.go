@@ -0,0 +1,176 @@
+package model
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"path"
+	"strconv"
+)
+
+// A migration upgrades the content of a config file from one schema version
+// to the next: migrations[i] turns version i into version i+1. The content is
+// generic JSON (numbers as json.Number) because older versions do not
+// necessarily have the structure of the current one.
+//
+// To change the format of a file, add a migration at the end of its list,
+// never edit the ones that already shipped.
+type migration func(data interface{}) (map[string]interface{}, error)
+
+var SENSORS_MIGRATIONS = []migration{migrateSensorsV0}
+var GATEWAY_MIGRATIONS = []migration{migrateGatewayV0}
+
+var SENSORS_SCHEMA_VERSION = len(SENSORS_MIGRATIONS)
+var GATEWAY_SCHEMA_VERSION = len(GATEWAY_MIGRATIONS)
+
+// files without a schema version are version 0
+func getSchemaVersion(data interface{}) (int, error) {
+	object, ok := data.(map[string]interface{})
+	if !ok || object["schema_version"] == nil {
+		return 0, nil
+	}
+	version, ok := object["schema_version"].(json.Number)
+	if !ok {
+		return 0, errors.New("invalid schema_version")
+	}
+	v, err := strconv.Atoi(version.String())
+	if err != nil || v < 0 {
+		return 0, errors.New("invalid schema_version " + version.String())
+	}
+	return v, nil
+}
+
+// migrateConfigFile upgrades the content of a config file to the latest
+// schema version, returning whether it had to. The original content is kept
+// in <file>.v<version> before anything is changed.
+func migrateConfigFile(fileName string, jsonStr []byte, migrations []migration) ([]byte, bool, error) {
+	decoder := json.NewDecoder(bytes.NewReader(jsonStr))
+	decoder.UseNumber()
+	var data interface{}
+	err := decoder.Decode(&data)
+	if err != nil {
+		return nil, false, corruptConfigFileError(fileName, err)
+	}
+
+	version, err := getSchemaVersion(data)
+	if err != nil {
+		return nil, false, corruptConfigFileError(fileName, err)
+	}
+	if version > len(migrations) {
+		return nil, false, errors.New(fileName + " was written by a newer version of ssmachmos (schema version " + strconv.Itoa(version) + ", this version supports up to " + strconv.Itoa(len(migrations)) + ")")
+	}
+	if version == len(migrations) {
+		return jsonStr, false, nil
+	}
+
+	configPath, err := GetConfigDir()
+	if err != nil {
+		return nil, false, err
+	}
+	err = writeFileAtomic(path.Join(configPath, fileName+".v"+strconv.Itoa(version)), jsonStr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		migrated, err := migrations[i](data)
+		if err != nil {
+			return nil, false, corruptConfigFileError(fileName, errors.New("migrating from schema version "+strconv.Itoa(i)+": "+err.Error()))
+		}
+		migrated["schema_version"] = i + 1
+		data = migrated
+	}
+
+	jsonStr, err = json.Marshal(data)
+	return jsonStr, true, err
+}
+
+// version 0: a bare array of sensors. RSA keys were stored as
+// {"N": ..., "E": ...} before other algorithms were supported and vibration
+// settings had no scale before the compact encoding.
+func migrateSensorsV0(data interface{}) (map[string]interface{}, error) {
+	sensors, ok := data.([]interface{})
+	if !ok {
+		return nil, errors.New("expected an array of sensors")
+	}
+	for _, s := range sensors {
+		sensor, ok := s.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("expected a sensor")
+		}
+
+		if key, ok := sensor["key"].(map[string]interface{}); ok && key["N"] != nil {
+			converted, err := migrateLegacyRSAKey(key)
+			if err != nil {
+				return nil, err
+			}
+			sensor["key"] = converted
+		}
+
+		if settings, ok := sensor["settings"].(map[string]interface{}); ok {
+			if vibration, ok := settings["vibration"].(map[string]interface{}); ok && vibration["scale"] == nil {
+				vibration["scale"] = DEFAULT_VIBRATION_SCALE
+			}
+		}
+	}
+	return map[string]interface{}{"sensors": sensors}, nil
+}
+
+func migrateLegacyRSAKey(key map[string]interface{}) (map[string]interface{}, error) {
+	n, ok := key["N"].(json.Number)
+	if !ok {
+		return nil, errors.New("invalid RSA key")
+	}
+	modulus, ok := new(big.Int).SetString(n.String(), 10)
+	if !ok {
+		return nil, errors.New("invalid RSA key modulus")
+	}
+	e, ok := key["E"].(json.Number)
+	if !ok {
+		return nil, errors.New("invalid RSA key")
+	}
+	exponent, err := strconv.Atoi(e.String())
+	if err != nil {
+		return nil, errors.New("invalid RSA key exponent")
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&rsa.PublicKey{N: modulus, E: exponent})
+	if err != nil {
+		return nil, err
+	}
+	// []byte is marshaled in base64, as in publicKeyJSON
+	return map[string]interface{}{"algorithm": KEY_RSA, "key": der}, nil
+}
+
+// version 0: a single sink configured with flat fields before the gateway
+// supported multiple sinks (files written since then already have "sinks")
+func migrateGatewayV0(data interface{}) (map[string]interface{}, error) {
+	gateway, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("expected an object")
+	}
+
+	if gateway["sinks"] == nil {
+		field := func(name string) string {
+			value, _ := gateway[name].(string)
+			return value
+		}
+		// only the sink that was in use is kept
+		switch {
+		case field("sink") == "mqtt" && field("mqtt_broker") != "":
+			gateway["sinks"] = []Sink{{Name: "mqtt", Type: "mqtt", URL: field("mqtt_broker"), Topic: field("mqtt_topic"), Username: field("mqtt_username"), Password: field("mqtt_password")}}
+		case field("sink") == "influx" && field("influx_url") != "":
+			gateway["sinks"] = []Sink{{Name: "influx", Type: "influx", URL: field("influx_url"), Token: field("influx_token")}}
+		case field("http_endpoint") != "":
+			gateway["sinks"] = []Sink{{Name: "openphm", Type: "openphm", URL: field("http_endpoint")}}
+		}
+	}
+
+	for _, name := range []string{"http_endpoint", "sink", "mqtt_broker", "mqtt_topic", "mqtt_username", "mqtt_password", "influx_url", "influx_token"} {
+		delete(gateway, name)
+	}
+	return gateway, nil
+}
@@ -0,0 +1,120 @@
+package model
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"flag"
+	"os"
+	"path"
+	"testing"
+)
+
+// go test ./internal/model -run Migration -update rewrites the golden files
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// copies testdata/<version>/<file> to a new config dir, loads it with load
+// and compares the file saved by the migration with
+// testdata/<version>/<file>.golden
+func checkMigration(t *testing.T, version string, fileName string, load func() error) {
+	t.Helper()
+	dir := t.TempDir()
+	SetConfigDir(dir)
+	t.Cleanup(func() { SetConfigDir("") })
+
+	original, err := os.ReadFile(path.Join("testdata", version, fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(dir, fileName), original, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := os.ReadFile(path.Join(dir, fileName+"."+version))
+	if err != nil {
+		t.Fatal("the original file was not kept: " + err.Error())
+	}
+	if !bytes.Equal(backup, original) {
+		t.Error(fileName + "." + version + " is not the original file")
+	}
+
+	saved, err := os.ReadFile(path.Join(dir, fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indented bytes.Buffer
+	err = json.Indent(&indented, saved, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	indented.WriteByte('\n')
+
+	goldenPath := path.Join("testdata", version, fileName+".golden")
+	if *update {
+		err = os.WriteFile(goldenPath, indented.Bytes(), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(indented.Bytes(), golden) {
+		t.Errorf("migrated %s does not match %s:\n%s", fileName, goldenPath, indented.String())
+	}
+
+	// the migrated file is loaded as is
+	err = os.Remove(path.Join(dir, fileName+"."+version))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, fileName+"."+version)); err == nil {
+		t.Error(fileName + " was migrated twice")
+	}
+}
+
+func TestSensorsMigrationV0(t *testing.T) {
+	registry := NewSensorRegistry(SENSORS_FILE)
+	checkMigration(t, "v0", SENSORS_FILE, registry.Load)
+
+	sensors := registry.List()
+	if len(sensors) != 2 {
+		t.Fatalf("expected 2 sensors, got %d", len(sensors))
+	}
+	for _, sensor := range sensors {
+		if sensor.PublicKey.Algorithm != KEY_RSA {
+			t.Errorf("sensor %s: expected an %s key, got %q", MacToString(sensor.Mac), KEY_RSA, sensor.PublicKey.Algorithm)
+			continue
+		}
+		if rsaKey, ok := sensor.PublicKey.key.(*rsa.PublicKey); !ok || rsaKey.E != 65537 || rsaKey.N.BitLen() != 1024 {
+			t.Errorf("sensor %s: the RSA key was not kept", MacToString(sensor.Mac))
+		}
+	}
+	if sensors[0].Settings["vibration"].Scale != DEFAULT_VIBRATION_SCALE {
+		t.Errorf("expected the default vibration scale, got %v", sensors[0].Settings["vibration"].Scale)
+	}
+}
+
+func TestGatewayMigrationV0(t *testing.T) {
+	gateway := &Gateway{}
+	checkMigration(t, "v0", GATEWAY_FILE, func() error {
+		*gateway = Gateway{}
+		return LoadSettings(gateway, GATEWAY_FILE)
+	})
+
+	expected := Sink{Name: "mqtt", Type: "mqtt", URL: "tcp://broker.local:1883", Topic: "machmos/measurements", Username: "gateway", Password: "mqtt-secret"}
+	if len(gateway.Sinks) != 1 || gateway.Sinks[0] != expected {
+		t.Errorf("expected only the MQTT sink, got %+v", gateway.Sinks)
+	}
+}
@@ -0,0 +1,358 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const PROFILES_FILE = "profiles.json"
+const BUILTIN_PROFILE_NAME = "builtin"
+
+var PROFILES_MIGRATIONS = []migration{}
+
+var PROFILES_SCHEMA_VERSION = len(PROFILES_MIGRATIONS)
+
+// Profile is a named set of settings applied to sensors at once (on pairing
+// for the default profile, with the "profile" setting or "auto")
+type Profile struct {
+	Name                    string              `json:"name"`
+	WakeUpInterval          int                 `json:"wake_up_interval"`
+	WakeUpIntervalMaxOffset int                 `json:"wake_up_interval_max_offset"`
+	Settings                map[string]settings `json:"settings"` // per data type
+}
+
+// the settings sensors had before profiles existed
+var BUILTIN_PROFILE = Profile{
+	Name:                    BUILTIN_PROFILE_NAME,
+	WakeUpInterval:          3600,
+	WakeUpIntervalMaxOffset: 300,
+	Settings: map[string]settings{
+		"vibration": {
+			Active:            true,
+			SamplingFrequency: 100,
+			SamplingDuration:  1,
+			Scale:             DEFAULT_VIBRATION_SCALE,
+		},
+		"temperature": {
+			Active: true,
+		},
+		"audio": {
+			Active:            true,
+			SamplingFrequency: 8000,
+			SamplingDuration:  1,
+		},
+	},
+}
+
+func (p *Profile) ToString() string {
+	str := p.Name + "\n"
+	str += "\tWake Up Interval: " + strconv.Itoa(p.WakeUpInterval) + " +- " + strconv.Itoa(p.WakeUpIntervalMaxOffset) + " seconds\n"
+	dataTypes := []string{}
+	for dataType := range p.Settings {
+		dataTypes = append(dataTypes, dataType)
+	}
+	sort.Strings(dataTypes)
+	for _, dataType := range dataTypes {
+		value := p.Settings[dataType]
+		str += "\t" + dataType + ": active " + strconv.FormatBool(value.Active)
+		if dataType != "temperature" {
+			str += ", " + strconv.Itoa(int(value.SamplingFrequency)) + " Hz for " + strconv.Itoa(int(value.SamplingDuration)) + " seconds"
+		}
+		if dataType == "vibration" {
+			str += ", full scale +- " + strconv.FormatFloat(value.Scale*32768, 'g', 6, 64) + " G"
+		}
+		str += "\n"
+	}
+	return str
+}
+
+// ParseProfile builds a profile from [<setting>, <value>] pairs using the
+// names of the sensor settings ("wake_up_interval", "vibration_sampling_frequency"...).
+// Only the data types with at least one setting are part of the profile, the
+// settings that are not given are the ones of the built-in profile.
+func ParseProfile(name string, values [][2]string) (Profile, error) {
+	profile := Profile{
+		Name:                    name,
+		WakeUpInterval:          BUILTIN_PROFILE.WakeUpInterval,
+		WakeUpIntervalMaxOffset: BUILTIN_PROFILE.WakeUpIntervalMaxOffset,
+		Settings:                map[string]settings{},
+	}
+	for _, v := range values {
+		setting, value := v[0], v[1]
+		switch setting {
+		case "wake_up_interval", "wake_up_interval_max_offset":
+			intValue, err := strconv.Atoi(value)
+			if err != nil {
+				return Profile{}, errors.New("invalid value for " + setting + " setting (must be an integer (seconds))")
+			}
+			if setting == "wake_up_interval" {
+				profile.WakeUpInterval = intValue
+			} else {
+				profile.WakeUpIntervalMaxOffset = intValue
+			}
+			continue
+		}
+
+		dataType, setting, _ := strings.Cut(setting, "_")
+		s, exists := profile.Settings[dataType]
+		if !exists {
+			s, exists = BUILTIN_PROFILE.Settings[dataType]
+			if !exists {
+				return Profile{}, errors.New("invalid setting data type " + dataType)
+			}
+		}
+		switch setting {
+		case "active":
+			s.Active = value == "true"
+		case "sampling_frequency":
+			intValue, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return Profile{}, errors.New("invalid value for sampling_frequency setting (must an integer between 0 and 4 294 967 295)")
+			}
+			s.SamplingFrequency = uint32(intValue)
+		case "sampling_duration":
+			intValue, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return Profile{}, errors.New("invalid value for sampling_duration setting (must an integer between 0 and 65 535)")
+			}
+			s.SamplingDuration = uint16(intValue)
+		case "scale", "full_scale":
+			if dataType != "vibration" {
+				return Profile{}, errors.New("setting " + setting + " only exists for vibration")
+			}
+			floatValue, err := strconv.ParseFloat(value, 64)
+			if err != nil || floatValue <= 0 {
+				return Profile{}, errors.New("invalid value for " + setting + " setting (must be a number greater than 0 (G))")
+			}
+			if setting == "full_scale" {
+				floatValue /= 32768
+			}
+			s.Scale = floatValue
+		default:
+			return Profile{}, errors.New("setting " + setting + " doesn't exist")
+		}
+		profile.Settings[dataType] = s
+	}
+	return profile, profile.validate()
+}
+
+// the same rules as UpdateSensorSetting, except for the collection capacity
+// which depends on the sensor (see applyProfile)
+func (p *Profile) validate() error {
+	if !isNameValid(p.Name) {
+		return errors.New("invalid profile name " + p.Name + " (only letters, digits, - and _ are allowed)")
+	}
+	if p.WakeUpInterval < 1 || p.WakeUpInterval > 4294967 {
+		return errors.New("invalid value for wake_up_interval (must an integer between 1 and 4 294 967)")
+	}
+	if p.WakeUpIntervalMaxOffset < 0 || p.WakeUpIntervalMaxOffset >= p.WakeUpInterval {
+		return errors.New("invalid value for wake_up_interval_max_offset (must an integer between 0 and wake_up_interval)")
+	}
+	if len(p.Settings) == 0 {
+		return errors.New("the profile has no settings for any data type")
+	}
+	for dataType, s := range p.Settings {
+		if _, exists := BUILTIN_PROFILE.Settings[dataType]; !exists {
+			return errors.New("invalid setting data type " + dataType)
+		}
+		if dataType == "temperature" {
+			continue
+		}
+		if s.SamplingFrequency == 0 || s.SamplingDuration == 0 {
+			return errors.New(dataType + " sampling_duration and sampling_frequency must be greater than 0")
+		}
+		if dataType == "vibration" && s.Scale <= 0 {
+			return errors.New("vibration scale must be greater than 0")
+		}
+	}
+	return nil
+}
+
+// applyProfile sets the wake up interval and the settings of the data types
+// of the profile, the sensor is left unchanged if the profile configures a
+// data type it does not have or exceeds its collection capacity. The
+// built-in profile only configures the data types of the sensor.
+func applyProfile(sensor *Sensor, profile *Profile) error {
+	updated := sensor.clone()
+	for dataType, s := range profile.Settings {
+		supported := false
+		for _, t := range sensor.Types {
+			supported = supported || t == dataType
+		}
+		if !supported {
+			if profile.Name == BUILTIN_PROFILE_NAME {
+				continue
+			}
+			return errors.New("profile " + profile.Name + " configures " + dataType + ", which sensor " + MacToString(sensor.Mac) + " does not have")
+		}
+		updated.Settings[dataType] = s
+	}
+
+	size := getCollectionSize(&updated)
+	if size > int(sensor.CollectionCapacity) {
+		return errors.New("profile " + profile.Name + " exceeds the collection capacity of sensor " + MacToString(sensor.Mac) + " (" + strconv.Itoa(size) + " of " + strconv.Itoa(int(sensor.CollectionCapacity)) + " bytes)")
+	}
+
+	updated.WakeUpInterval = profile.WakeUpInterval
+	updated.WakeUpIntervalMaxOffset = profile.WakeUpIntervalMaxOffset
+	*sensor = updated
+	return nil
+}
+
+// content of the profiles file
+type profilesFile struct {
+	SchemaVersion int       `json:"schema_version"`
+	Default       string    `json:"default,omitempty"` // the built-in profile when empty
+	Profiles      []Profile `json:"profiles"`
+}
+
+// ProfileRegistry holds the settings profiles and which one is the default,
+// it is safe for concurrent use
+type ProfileRegistry struct {
+	mutex          sync.RWMutex
+	fileName       string
+	defaultProfile string
+	profiles       []Profile
+}
+
+func NewProfileRegistry(fileName string) *ProfileRegistry {
+	return &ProfileRegistry{
+		fileName: fileName,
+		profiles: []Profile{},
+	}
+}
+
+// Load replaces the profiles with the ones saved in the file of the registry,
+// the registry is left empty if there is no file yet
+func (r *ProfileRegistry) Load() error {
+	configPath, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+	jsonStr, err := os.ReadFile(path.Join(configPath, r.fileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	jsonStr, migrated, err := migrateConfigFile(r.fileName, jsonStr, PROFILES_MIGRATIONS)
+	if err != nil {
+		return err
+	}
+	file := profilesFile{}
+	err = json.Unmarshal(jsonStr, &file)
+	if err != nil {
+		return corruptConfigFileError(r.fileName, err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.defaultProfile = file.Default
+	r.profiles = file.Profiles
+	if r.profiles == nil {
+		r.profiles = []Profile{}
+	}
+	if migrated {
+		return r.save()
+	}
+	return nil
+}
+
+// the mutex must be held
+func (r *ProfileRegistry) save() error {
+	jsonStr, err := json.Marshal(profilesFile{SchemaVersion: PROFILES_SCHEMA_VERSION, Default: r.defaultProfile, Profiles: r.profiles})
+	if err != nil {
+		return err
+	}
+	return writeConfigFile(r.fileName, jsonStr)
+}
+
+// List returns the built-in profile followed by the others
+func (r *ProfileRegistry) List() []Profile {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return append([]Profile{BUILTIN_PROFILE}, r.profiles...)
+}
+
+func (r *ProfileRegistry) Get(name string) (Profile, bool) {
+	if name == BUILTIN_PROFILE_NAME {
+		return BUILTIN_PROFILE, true
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, p := range r.profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Profile{}, false
+}
+
+// GetDefault returns the profile applied to the sensors when they are paired
+func (r *ProfileRegistry) GetDefault() Profile {
+	r.mutex.RLock()
+	name := r.defaultProfile
+	r.mutex.RUnlock()
+	profile, exists := r.Get(name)
+	if !exists {
+		return BUILTIN_PROFILE
+	}
+	return profile
+}
+
+func (r *ProfileRegistry) SetDefault(name string) error {
+	if _, exists := r.Get(name); !exists {
+		return errors.New("profile " + name + " not found")
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.defaultProfile = name
+	if name == BUILTIN_PROFILE_NAME {
+		r.defaultProfile = ""
+	}
+	return r.save()
+}
+
+func (r *ProfileRegistry) Add(profile Profile) error {
+	if profile.Name == BUILTIN_PROFILE_NAME {
+		return errors.New("the built-in profile cannot be replaced")
+	}
+	err := profile.validate()
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, p := range r.profiles {
+		if p.Name == profile.Name {
+			return errors.New("profile " + profile.Name + " already exists")
+		}
+	}
+	r.profiles = append(r.profiles, profile)
+	return r.save()
+}
+
+// Remove deletes a profile, the sensors keep their settings and the built-in
+// profile becomes the default if it was the default
+func (r *ProfileRegistry) Remove(name string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, p := range r.profiles {
+		if p.Name == name {
+			r.profiles = append(r.profiles[:i], r.profiles[i+1:]...)
+			if r.defaultProfile == name {
+				r.defaultProfile = ""
+			}
+			return r.save()
+		}
+	}
+	return errors.New("profile " + name + " not found")
+}
@@ -0,0 +1,112 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestParseProfileValidation(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		values [][2]string
+		valid  bool
+	}{
+		{"vibration-only", [][2]string{{"vibration_sampling_frequency", "1000"}, {"vibration_full_scale", "8"}}, true},
+		{"hourly", [][2]string{{"wake_up_interval", "3600"}, {"wake_up_interval_max_offset", "0"}, {"temperature_active", "true"}}, true},
+		{"no-settings", [][2]string{{"wake_up_interval", "60"}}, false},
+		{"invalid name!", [][2]string{{"temperature_active", "true"}}, false},
+		{"offset", [][2]string{{"wake_up_interval", "60"}, {"wake_up_interval_max_offset", "60"}, {"temperature_active", "true"}}, false},
+		{"interval", [][2]string{{"wake_up_interval", "0"}, {"wake_up_interval_max_offset", "0"}, {"temperature_active", "true"}}, false},
+		{"frequency", [][2]string{{"vibration_sampling_frequency", "0"}}, false},
+		{"duration", [][2]string{{"audio_sampling_duration", "65536"}}, false},
+		{"scale", [][2]string{{"vibration_scale", "-1"}}, false},
+		{"audio-scale", [][2]string{{"audio_scale", "1"}}, false},
+		{"humidity", [][2]string{{"humidity_active", "true"}}, false},
+		{"setting", [][2]string{{"vibration_gain", "2"}}, false},
+	} {
+		profile, err := ParseProfile(c.name, c.values)
+		if c.valid && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%s: an invalid profile was accepted: %+v", c.name, profile)
+		}
+	}
+}
+
+func newTestProfiles(t *testing.T, profiles ...Profile) *ProfileRegistry {
+	t.Helper()
+	registry := NewProfileRegistry(PROFILES_FILE)
+	for _, p := range profiles {
+		err := registry.Add(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return registry
+}
+
+// a profile is applied to every member of a group or to none of them
+func TestApplyProfileToGroup(t *testing.T) {
+	sensors, group := newTestGroup(t)
+	macs := group.Members(sensors.List())
+	vibration := settings{Active: true, SamplingFrequency: 1000, SamplingDuration: 20, Scale: DEFAULT_VIBRATION_SCALE}
+	profiles := newTestProfiles(t,
+		// 6 bytes * 1000 Hz * 20 s fits 1 000 000 bytes, not 100 000
+		Profile{Name: "heavy", WakeUpInterval: 60, Settings: map[string]settings{"vibration": vibration}},
+		// the sensors of the group have no microphone
+		Profile{Name: "audio", WakeUpInterval: 60, Settings: map[string]settings{"audio": {Active: true, SamplingFrequency: 8000, SamplingDuration: 1}}},
+		Profile{Name: "light", WakeUpInterval: 60, Settings: map[string]settings{"vibration": {Active: true, SamplingFrequency: 1000, SamplingDuration: 2, Scale: DEFAULT_VIBRATION_SCALE}}},
+	)
+	before := sensors.List()
+
+	for _, name := range []string{"heavy", "audio", "missing"} {
+		err := UpdateSensorsSettings(macs, [][2]string{{"profile", name}}, sensors, profiles)
+		if err == nil {
+			t.Errorf("profile %s: expected an error", name)
+		}
+		after := sensors.List()
+		for i := range before {
+			if after[i].WakeUpInterval != before[i].WakeUpInterval || len(after[i].Settings) != len(before[i].Settings) || after[i].Settings["vibration"] != before[i].Settings["vibration"] {
+				t.Errorf("profile %s: sensor %s was changed by a failed update", name, MacToString(after[i].Mac))
+			}
+		}
+	}
+
+	// the heavy profile fits the members with a large collection capacity
+	err := UpdateSensorsSettings(macs[:3], [][2]string{{"profile", "heavy"}}, sensors, profiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = UpdateSensorsSettings(macs, [][2]string{{"profile", "light"}, {"temperature_active", "false"}}, sensors, profiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mac := range macs {
+		sensor, _ := sensors.Get(mac)
+		if sensor.WakeUpInterval != 60 || sensor.Settings["vibration"].SamplingDuration != 2 || sensor.Settings["temperature"].Active {
+			t.Errorf("sensor %s: the profile was not applied", MacToString(mac))
+		}
+	}
+}
+
+// a sensor paired with a default profile it can't take gets the built-in one
+func TestAddSensorWithUnfitProfile(t *testing.T) {
+	sensors, _ := newTestRegistry(t, 0)
+	profile := Profile{Name: "audio", WakeUpInterval: 60, Settings: map[string]settings{"audio": {Active: true, SamplingFrequency: 8000, SamplingDuration: 1}}}
+	mac := [6]byte{0x5E, 0, 0, 0, 2, 0}
+
+	err := AddSensor(mac, []string{"vibration", "temperature"}, 1000000, &PublicKey{}, 2, &profile, sensors)
+	if err == nil {
+		t.Error("expected an error for a profile the sensor can't take")
+	}
+	sensor, exists := sensors.Get(mac)
+	if !exists {
+		t.Fatal("the sensor was not added")
+	}
+	if sensor.WakeUpInterval != BUILTIN_PROFILE.WakeUpInterval || sensor.Settings["vibration"] != BUILTIN_PROFILE.Settings["vibration"] {
+		t.Error("the sensor was not given the built-in profile")
+	}
+	if _, exists := sensor.Settings["audio"]; exists {
+		t.Error("the sensor was given settings for a data type it does not have")
+	}
+}
@@ -0,0 +1,25 @@
+package model
+
+import "encoding/json"
+
+// the JSON messages of the socket (see the api package), shared with the cli
+
+const (
+	STATUS_OK    = "ok"
+	STATUS_ERROR = "error"
+)
+
+type Request struct {
+	Id      uint64        `json:"id"`
+	Command string        `json:"command"`
+	Args    []interface{} `json:"args"` // strings, numbers or booleans
+}
+
+type Response struct {
+	Id        uint64          `json:"id"`
+	Command   string          `json:"command"`
+	Status    string          `json:"status"`
+	ErrorCode string          `json:"error_code,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
@@ -0,0 +1,286 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"sync"
+)
+
+const (
+	SENSOR_ADDED   = "added"
+	SENSOR_UPDATED = "updated"
+	SENSOR_REMOVED = "removed"
+)
+
+// content of the sensors file
+type sensorsFile struct {
+	SchemaVersion int      `json:"schema_version"`
+	Sensors       []Sensor `json:"sensors"`
+}
+
+type SensorEvent struct {
+	Type string // SENSOR_ADDED, SENSOR_UPDATED or SENSOR_REMOVED
+	Mac  [6]byte
+}
+
+// SensorRegistry holds the paired sensors, it is safe for concurrent use.
+// The sensors it returns are copies: changes go through Update so that they
+// are saved and the listeners are notified.
+type SensorRegistry struct {
+	mutex     sync.RWMutex
+	fileName  string
+	sensors   []*Sensor // in the order they were paired
+	index     map[[6]byte]*Sensor
+	listeners []func(SensorEvent)
+	dirty     bool // changed by UpdateInMemory since the last save
+}
+
+func NewSensorRegistry(fileName string) *SensorRegistry {
+	return &SensorRegistry{
+		fileName: fileName,
+		sensors:  []*Sensor{},
+		index:    map[[6]byte]*Sensor{},
+	}
+}
+
+func (s *Sensor) clone() Sensor {
+	c := *s
+	c.Types = append([]string{}, s.Types...)
+	if s.Tags != nil {
+		c.Tags = append([]string{}, s.Tags...)
+	}
+	c.Settings = make(map[string]settings, len(s.Settings))
+	for t, settings := range s.Settings {
+		c.Settings[t] = settings
+	}
+	return c
+}
+
+// Load replaces the sensors with the ones saved in the file of the registry,
+// the registry is left empty if there is no file yet
+func (r *SensorRegistry) Load() error {
+	configPath, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+	jsonStr, err := os.ReadFile(path.Join(configPath, r.fileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	jsonStr, migrated, err := migrateConfigFile(r.fileName, jsonStr, SENSORS_MIGRATIONS)
+	if err != nil {
+		return err
+	}
+	file := sensorsFile{}
+	err = json.Unmarshal(jsonStr, &file)
+	if err != nil {
+		return corruptConfigFileError(r.fileName, err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sensors = []*Sensor{}
+	r.index = map[[6]byte]*Sensor{}
+	for i := range file.Sensors {
+		// the messages accepted since the last save are not known, every
+		// counter that could have been accepted is rejected
+		if file.Sensors[i].MessageCounter < file.Sensors[i].ReservedMessageCounter {
+			file.Sensors[i].MessageCounter = file.Sensors[i].ReservedMessageCounter
+		}
+		r.sensors = append(r.sensors, &file.Sensors[i])
+		r.index[file.Sensors[i].Mac] = &file.Sensors[i]
+	}
+
+	if migrated {
+		return r.save()
+	}
+	return nil
+}
+
+// the mutex must be held
+func (r *SensorRegistry) save() error {
+	file := sensorsFile{SchemaVersion: SENSORS_SCHEMA_VERSION, Sensors: make([]Sensor, len(r.sensors))}
+	for i, s := range r.sensors {
+		file.Sensors[i] = *s
+	}
+	jsonStr, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	err = writeConfigFile(r.fileName, jsonStr)
+	if err == nil {
+		r.dirty = false
+	}
+	return err
+}
+
+// Flush saves the changes made by UpdateInMemory, if any
+func (r *SensorRegistry) Flush() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.dirty {
+		return nil
+	}
+	return r.save()
+}
+
+// Subscribe calls listener after every change, outside of the lock
+func (r *SensorRegistry) Subscribe(listener func(SensorEvent)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.listeners = append(r.listeners, listener)
+}
+
+func (r *SensorRegistry) notify(event SensorEvent) {
+	r.mutex.RLock()
+	listeners := r.listeners
+	r.mutex.RUnlock()
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
+
+func (r *SensorRegistry) Get(mac [6]byte) (Sensor, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	sensor, exists := r.index[mac]
+	if !exists {
+		return Sensor{}, false
+	}
+	return sensor.clone(), true
+}
+
+func (r *SensorRegistry) Contains(mac [6]byte) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	_, exists := r.index[mac]
+	return exists
+}
+
+// List returns every sensor in the order they were paired
+func (r *SensorRegistry) List() []Sensor {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	sensors := make([]Sensor, len(r.sensors))
+	for i, s := range r.sensors {
+		sensors[i] = s.clone()
+	}
+	return sensors
+}
+
+func (r *SensorRegistry) Add(sensor Sensor) error {
+	r.mutex.Lock()
+	if _, exists := r.index[sensor.Mac]; exists {
+		r.mutex.Unlock()
+		return errors.New("sensor " + MacToString(sensor.Mac) + " already exists")
+	}
+	s := sensor.clone()
+	r.sensors = append(r.sensors, &s)
+	r.index[s.Mac] = &s
+	err := r.save()
+	r.mutex.Unlock()
+
+	r.notify(SensorEvent{Type: SENSOR_ADDED, Mac: sensor.Mac})
+	return err
+}
+
+func (r *SensorRegistry) Remove(mac [6]byte) error {
+	r.mutex.Lock()
+	if _, exists := r.index[mac]; !exists {
+		r.mutex.Unlock()
+		return nil
+	}
+	for i, s := range r.sensors {
+		if s.Mac == mac {
+			r.sensors = append(r.sensors[:i], r.sensors[i+1:]...)
+			break
+		}
+	}
+	delete(r.index, mac)
+	err := r.save()
+	r.mutex.Unlock()
+
+	r.notify(SensorEvent{Type: SENSOR_REMOVED, Mac: mac})
+	return err
+}
+
+// Update applies update to a copy of the sensor and keeps it only if update
+// succeeds and the registry is saved
+func (r *SensorRegistry) Update(mac [6]byte, update func(sensor *Sensor) error) error {
+	r.mutex.Lock()
+	sensor, exists := r.index[mac]
+	if !exists {
+		r.mutex.Unlock()
+		return errors.New("sensor not found")
+	}
+	updated := sensor.clone()
+	err := update(&updated)
+	if err != nil {
+		r.mutex.Unlock()
+		return err
+	}
+	previous := *sensor
+	*sensor = updated
+	err = r.save()
+	if err != nil {
+		*sensor = previous
+		r.mutex.Unlock()
+		return err
+	}
+	r.mutex.Unlock()
+
+	r.notify(SensorEvent{Type: SENSOR_UPDATED, Mac: mac})
+	return err
+}
+
+// UpdateInMemory applies update to the sensor without saving nor notifying,
+// for changes too frequent to be written every time. The change is saved by
+// the next save or Flush if update returns true, otherwise only if something
+// else changes.
+func (r *SensorRegistry) UpdateInMemory(mac [6]byte, update func(sensor *Sensor) bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	sensor, exists := r.index[mac]
+	if !exists {
+		return errors.New("sensor not found")
+	}
+	if update(sensor) {
+		r.dirty = true
+	}
+	return nil
+}
+
+// UpdateAll applies update to a copy of every sensor and keeps the changes
+// only if update succeeds for all of them
+func (r *SensorRegistry) UpdateAll(macs [][6]byte, update func(sensor *Sensor) error) error {
+	r.mutex.Lock()
+	updated := make([]Sensor, len(macs))
+	for i, mac := range macs {
+		sensor, exists := r.index[mac]
+		if !exists {
+			r.mutex.Unlock()
+			return errors.New("sensor " + MacToString(mac) + " not found")
+		}
+		updated[i] = sensor.clone()
+		err := update(&updated[i])
+		if err != nil {
+			r.mutex.Unlock()
+			return errors.New(MacToString(mac) + ": " + err.Error())
+		}
+	}
+	for i, mac := range macs {
+		*r.index[mac] = updated[i]
+	}
+	err := r.save()
+	r.mutex.Unlock()
+
+	for _, mac := range macs {
+		r.notify(SensorEvent{Type: SENSOR_UPDATED, Mac: mac})
+	}
+	return err
+}
@@ -0,0 +1,223 @@
+package model
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func newTestRegistry(t *testing.T, count int) (*SensorRegistry, [][6]byte) {
+	t.Helper()
+	SetConfigDir(t.TempDir())
+	t.Cleanup(func() { SetConfigDir("") })
+
+	registry := NewSensorRegistry(SENSORS_FILE)
+	macs := [][6]byte{}
+	for i := 0; i < count; i++ {
+		mac := [6]byte{0x5E, 0, 0, 0, 0, byte(i)}
+		err := registry.Add(getDefaultSensor(mac, []string{"vibration", "temperature"}, 1000000, &PublicKey{}, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		macs = append(macs, mac)
+	}
+	return registry, macs
+}
+
+// run with go test -race
+func TestSensorRegistryConcurrentAccess(t *testing.T) {
+	registry, macs := newTestRegistry(t, 8)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(4)
+		mac := macs[i]
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				err := registry.Update(mac, func(sensor *Sensor) error {
+					sensor.BatteryLevel = j
+					sensor.Settings["vibration"] = settings{Active: true, SamplingFrequency: uint32(j + 1), SamplingDuration: 1}
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				sensor, exists := registry.Get(mac)
+				if !exists {
+					t.Error("sensor " + MacToString(mac) + " not found")
+					return
+				}
+				// the copy is not shared with the registry
+				sensor.Settings["vibration"] = settings{}
+				sensor.Types[0] = "audio"
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				for _, sensor := range registry.List() {
+					_ = sensor.Settings["vibration"].SamplingFrequency
+				}
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			// every other sensor is removed while the others use it
+			if i%2 == 0 {
+				registry.Remove([6]byte{0x5E, 0, 0, 0, 1, byte(i)})
+				return
+			}
+			err := registry.Add(getDefaultSensor([6]byte{0x5E, 0, 0, 0, 1, byte(i)}, []string{"audio"}, 1000000, &PublicKey{}, 2))
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, mac := range macs {
+		sensor, exists := registry.Get(mac)
+		if !exists {
+			t.Fatal("sensor " + MacToString(mac) + " not found")
+		}
+		if sensor.BatteryLevel != 49 || sensor.Settings["vibration"].SamplingFrequency != 50 {
+			t.Error("sensor " + MacToString(mac) + " lost updates: battery " + strconv.Itoa(sensor.BatteryLevel))
+		}
+		if sensor.Types[0] != "vibration" {
+			t.Error("changes to a copy reached the registry")
+		}
+	}
+}
+
+func TestSensorRegistryConcurrentRemove(t *testing.T) {
+	registry, macs := newTestRegistry(t, 4)
+
+	removed := 0
+	var removedMutex sync.Mutex
+	registry.Subscribe(func(event SensorEvent) {
+		if event.Type == SENSOR_REMOVED {
+			removedMutex.Lock()
+			removed++
+			removedMutex.Unlock()
+		}
+	})
+
+	var wg sync.WaitGroup
+	for _, mac := range macs {
+		for i := 0; i < 4; i++ {
+			wg.Add(2)
+			go func(mac [6]byte) {
+				defer wg.Done()
+				registry.Remove(mac)
+			}(mac)
+			go func(mac [6]byte) {
+				defer wg.Done()
+				// fails once the sensor is removed, never panics
+				registry.Update(mac, func(sensor *Sensor) error {
+					sensor.RejectedMessages++
+					return nil
+				})
+			}(mac)
+		}
+	}
+	wg.Wait()
+
+	if len(registry.List()) != 0 {
+		t.Error("sensors left after being removed")
+	}
+	if removed != len(macs) {
+		t.Error("expected " + strconv.Itoa(len(macs)) + " removals, got " + strconv.Itoa(removed))
+	}
+}
+
+func TestSensorRegistryUpdateAllIsAtomic(t *testing.T) {
+	registry, macs := newTestRegistry(t, 4)
+
+	err := UpdateSensorsSettings(macs, [][2]string{{"vibration_sampling_frequency", "50000"}, {"vibration_sampling_duration", "10"}}, registry, nil)
+	if err == nil {
+		t.Fatal("settings exceeding the collection capacity were accepted")
+	}
+	for _, sensor := range registry.List() {
+		if sensor.Settings["vibration"].SamplingFrequency != BUILTIN_PROFILE.Settings["vibration"].SamplingFrequency {
+			t.Error("sensor " + MacToString(sensor.Mac) + " was changed by a failed update")
+		}
+	}
+
+	reloaded := NewSensorRegistry(SENSORS_FILE)
+	err = reloaded.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.List()) != len(macs) {
+		t.Error("the saved sensors do not match the registry")
+	}
+}
+
+// the process crashes (the registry is never flushed) and starts again
+func reloadSensors(t *testing.T) *SensorRegistry {
+	t.Helper()
+	reloaded := NewSensorRegistry(SENSORS_FILE)
+	err := reloaded.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reloaded
+}
+
+func TestCheckMessageCounterSurvivesCrash(t *testing.T) {
+	registry, macs := newTestRegistry(t, 1)
+
+	check := func(registry *SensorRegistry, counters []uint32, expected []bool) {
+		t.Helper()
+		for i, counter := range counters {
+			accepted, err := CheckMessageCounter(macs[0], counter, registry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accepted != expected[i] {
+				t.Errorf("counter %d: expected accepted %v, got %v", counter, expected[i], accepted)
+			}
+		}
+	}
+
+	check(registry, []uint32{1, 2, 2, 1, 10}, []bool{true, true, false, false, true})
+	sensor, _ := registry.Get(macs[0])
+	if sensor.MessageCounter != 10 || sensor.RejectedMessages != 2 {
+		t.Fatal("expected counter 10 with 2 rejected messages, got " + strconv.Itoa(int(sensor.MessageCounter)) + " with " + strconv.Itoa(sensor.RejectedMessages))
+	}
+
+	// every counter accepted before the crash is rejected after it, the
+	// sensor is given the reservation as its counter and goes on from there
+	reloaded := reloadSensors(t)
+	check(reloaded, []uint32{2, 10, MESSAGE_COUNTER_RESERVATION + 1, MESSAGE_COUNTER_RESERVATION + 2}, []bool{false, false, false, true})
+	check(reloadSensors(t), []uint32{MESSAGE_COUNTER_RESERVATION + 2, 2*MESSAGE_COUNTER_RESERVATION + 2, 2*MESSAGE_COUNTER_RESERVATION + 3}, []bool{false, false, true})
+}
+
+func TestCheckMessageCounterIsSavedOnFlush(t *testing.T) {
+	registry, macs := newTestRegistry(t, 1)
+
+	for _, counter := range []uint32{1, 2, 2, 1} {
+		_, err := CheckMessageCounter(macs[0], counter, registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sensor, _ := reloadSensors(t).Get(macs[0]); sensor.RejectedMessages != 0 {
+		t.Error("the rejected messages were saved before the registry was flushed")
+	}
+
+	err := registry.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sensor, _ := reloadSensors(t).Get(macs[0]); sensor.RejectedMessages != 2 {
+		t.Error("the rejected messages were not saved by Flush")
+	}
+}
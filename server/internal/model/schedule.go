@@ -0,0 +1,25 @@
+package model
+
+import "time"
+
+// WakeUp is a projected wake up of a sensor (see server.GetSchedule)
+type WakeUp struct {
+	Mac      [6]byte   `json:"mac"`
+	Name     string    `json:"name"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Overlaps [][6]byte `json:"overlaps,omitempty"` // the sensors awake at the same time
+	// more sensors than sessions are awake at some point of the wake up
+	OverCapacity bool `json:"over_capacity"`
+}
+
+type Schedule struct {
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	WakeUps  []WakeUp  `json:"wake_ups"`
+	Sessions int       `json:"sessions"`
+	// air time of the wake ups over the length of the schedule times the
+	// sessions, above 1 the gateway cannot serve every wake up
+	Utilisation  float64 `json:"utilisation"`
+	OverCapacity float64 `json:"over_capacity"` // seconds during which more sensors than sessions are awake
+}
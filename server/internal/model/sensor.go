@@ -1,12 +1,9 @@
 package model
 
 import (
-	"crypto/rsa"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
-	"path"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -14,21 +11,37 @@ import (
 
 const SENSORS_FILE = "sensors.json"
 
+const DEFAULT_VIBRATION_FULL_SCALE = 16.0                            // +- G
+const DEFAULT_VIBRATION_SCALE = DEFAULT_VIBRATION_FULL_SCALE / 32768 // G per unit of the compact encoding
+
 var DATA_SIZE = map[string]int{
 	"temperature": 2,
-	"audio":       2,
+	"audio":       3, // pcm24
 	"vibration":   4 * 3,
 }
 
+// size of a vibration sample in the compact encoding (int16 per axis), which
+// the sensors must use from protocol version 2
+const COMPACT_VIBRATION_DATA_SIZE = 2 * 3
+
+// compact vibration data starts with the scale the sensor sampled with (float32)
+const COMPACT_VIBRATION_SCALE_SIZE = 4
+
 type settings struct {
-	Active            bool   `json:"active"`
-	SamplingFrequency uint32 `json:"sampling_frequency"`
-	SamplingDuration  uint16 `json:"sampling_duration"`
+	Active            bool    `json:"active"`
+	SamplingFrequency uint32  `json:"sampling_frequency"`
+	SamplingDuration  uint16  `json:"sampling_duration"`
+	Scale             float64 `json:"scale,omitempty"` // G per unit for compact vibration data
 }
 
 type Sensor struct {
 	Mac                     [6]byte             `json:"mac"`
 	Name                    string              `json:"name"`
+	Description             string              `json:"description"`
+	Location                string              `json:"location"`  // e.g. "building A, line 2"
+	Machine                 string              `json:"machine"`   // e.g. "pump 3"
+	Component               string              `json:"component"` // e.g. "motor DE bearing"
+	Tags                    []string            `json:"tags"`
 	Types                   []string            `json:"types"`
 	BatteryLevel            int                 `json:"battery_level"`
 	CollectionCapacity      uint32              `json:"collection_capacity"`
@@ -36,11 +49,30 @@ type Sensor struct {
 	WakeUpIntervalMaxOffset int                 `json:"wake_up_interval_max_offset"`
 	NextWakeUp              time.Time           `json:"next_wake_up"`
 	Settings                map[string]settings `json:"settings"`
-	PublicKey               rsa.PublicKey       `json:"key"`
+	PublicKey               PublicKey           `json:"key"`
+	ProtocolVersion         byte                `json:"protocol_version"`
+	MessageCounter          uint32              `json:"message_counter"`          // counter of the last accepted message
+	ReservedMessageCounter  uint32              `json:"reserved_message_counter"` // saved before a counter above it is accepted
+	RejectedMessages        int                 `json:"rejected_messages"`        // replayed or stale messages
 }
 
 func (s *Sensor) ToString() string {
 	str := s.Name + " - " + MacToString(s.Mac) + "\n"
+	if s.Description != "" {
+		str += "Description: " + s.Description + "\n"
+	}
+	if s.Location != "" {
+		str += "Location: " + s.Location + "\n"
+	}
+	if s.Machine != "" {
+		str += "Machine: " + s.Machine + "\n"
+	}
+	if s.Component != "" {
+		str += "Component: " + s.Component + "\n"
+	}
+	if len(s.Tags) > 0 {
+		str += "Tags: " + strings.Join(s.Tags, ", ") + "\n"
+	}
 	str += "Sensor Types: "
 	for i, t := range s.Types {
 		if i < len(s.Types)-1 {
@@ -58,6 +90,9 @@ func (s *Sensor) ToString() string {
 	str += "Collection Capacity: " + strconv.Itoa(int(s.CollectionCapacity)) + " bytes\n"
 	str += "Wake Up Interval: " + strconv.Itoa(s.WakeUpInterval) + " +- " + strconv.Itoa(s.WakeUpIntervalMaxOffset) + " seconds\n"
 	str += "Next Wake Up: " + s.NextWakeUp.Local().Format(time.RFC3339) + "\n"
+	str += "Protocol Version: " + strconv.Itoa(int(s.GetProtocolVersion())) + "\n"
+	str += "Key Algorithm: " + s.PublicKey.Algorithm + "\n"
+	str += "Rejected Messages: " + strconv.Itoa(s.RejectedMessages) + "\n"
 	str += "Settings:\n"
 	for setting, value := range s.Settings {
 		str += "\t" + setting + ":\n"
@@ -67,10 +102,29 @@ func (s *Sensor) ToString() string {
 		}
 		str += "\t\tSampling Frequency: " + strconv.Itoa(int(value.SamplingFrequency)) + " Hz\n"
 		str += "\t\tSampling Duration: " + strconv.Itoa(int(value.SamplingDuration)) + " seconds\n"
+		if setting == "vibration" && value.Scale != 0 {
+			str += "\t\tScale: " + strconv.FormatFloat(value.Scale, 'g', -1, 64) + " G (full scale +- " + strconv.FormatFloat(value.Scale*32768, 'g', 6, 64) + " G)\n"
+		}
 	}
 	return str
 }
 
+// sensors paired before the protocol was versioned use version 1
+func (s *Sensor) GetProtocolVersion() byte {
+	if s.ProtocolVersion == 0 {
+		return 1
+	}
+	return s.ProtocolVersion
+}
+
+// G per unit of the compact vibration data, sent to the sensor with its settings
+func (s *Sensor) GetVibrationScale() float64 {
+	if scale := s.Settings["vibration"].Scale; scale > 0 {
+		return scale
+	}
+	return DEFAULT_VIBRATION_SCALE
+}
+
 func (s *Sensor) IsMacEqual(mac string) bool {
 	m, err := StringToMac(mac)
 	if err != nil {
@@ -79,6 +133,54 @@ func (s *Sensor) IsMacEqual(mac string) bool {
 	return s.Mac == m
 }
 
+// ParseTags splits a comma separated list of tags, an empty string clears them
+func ParseTags(value string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// HasTag is true if the sensor has the tag (ignoring case)
+func (s *Sensor) HasTag(tag string) bool {
+	for _, t := range s.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// what the sensors can be listed by (see Matches)
+var SENSOR_FILTERS = []string{"location", "machine", "component", "tag"}
+
+// Matches is true if the sensor matches every filter (ignoring case)
+func (s *Sensor) Matches(filters map[string]string) (bool, error) {
+	for filter, value := range filters {
+		var matches bool
+		switch filter {
+		case "location":
+			matches = strings.EqualFold(s.Location, value)
+		case "machine":
+			matches = strings.EqualFold(s.Machine, value)
+		case "component":
+			matches = strings.EqualFold(s.Component, value)
+		case "tag":
+			matches = s.HasTag(value)
+		default:
+			return false, errors.New("cannot filter sensors by " + filter + " (must be one of " + strings.Join(SENSOR_FILTERS, ", ") + ")")
+		}
+		if !matches {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
 func StringToMac(mac string) ([6]byte, error) {
 	var m [6]byte
 	_, err := fmt.Sscanf(mac, "%02X:%02X:%02X:%02X:%02X:%02X", &m[0], &m[1], &m[2], &m[3], &m[4], &m[5])
@@ -92,116 +194,208 @@ func MacToString(mac [6]byte) string {
 	return fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5])
 }
 
-func LoadSensors(fileName string, sensors *[]Sensor) error {
-	configPath, err := os.UserConfigDir()
-	if err != nil {
-		return err
-	}
-
-	err = os.MkdirAll(path.Join(configPath, "ss_machmos"), 0777)
-	if err != nil {
-		return err
-	}
-
-	jsonStr, err := os.ReadFile(path.Join(configPath, "ss_machmos", fileName))
-	if err != nil {
-		*sensors = make([]Sensor, 0)
-		return err
-	}
-	err = json.Unmarshal(jsonStr, sensors)
-	if err != nil {
-		*sensors = make([]Sensor, 0)
-		return err
-	}
-	return nil
-}
-
-func RemoveSensor(mac [6]byte, sensors *[]Sensor) error {
+func RemoveSensor(mac [6]byte, sensors *SensorRegistry) error {
 	if sensors == nil {
 		return errors.New("sensors is nil")
 	}
-	for i, s := range *sensors {
-		if s.Mac == mac {
-			*sensors = append((*sensors)[:i], (*sensors)[i+1:]...)
-			err := saveSensors(SENSORS_FILE, sensors)
-			return err
-		}
-	}
-	return nil
+	return sensors.Remove(mac)
 }
 
-func getDefaultSensor(mac [6]byte, types []string, collectionCapacity uint32, publicKey *rsa.PublicKey) Sensor {
+// the sensor as it is paired, with the settings of the built-in profile
+func getDefaultSensor(mac [6]byte, types []string, collectionCapacity uint32, publicKey *PublicKey, protocolVersion byte) Sensor {
 	sensor := Sensor{
 		Mac:                     mac,
 		Name:                    "Sensor " + MacToString(mac),
 		Types:                   types,
 		BatteryLevel:            -1,
 		CollectionCapacity:      collectionCapacity,
-		WakeUpInterval:          3600,
-		WakeUpIntervalMaxOffset: 300,
-		NextWakeUp:              time.Now().Add(3600 * time.Second),
+		WakeUpInterval:          BUILTIN_PROFILE.WakeUpInterval,
+		WakeUpIntervalMaxOffset: BUILTIN_PROFILE.WakeUpIntervalMaxOffset,
+		NextWakeUp:              time.Now().Add(time.Duration(BUILTIN_PROFILE.WakeUpInterval) * time.Second),
 		Settings:                map[string]settings{},
 		PublicKey:               *publicKey,
+		ProtocolVersion:         protocolVersion,
 	}
 
 	for _, t := range types {
-		switch t {
-		case "vibration":
-			sensor.Settings["vibration"] = settings{
-				Active:            true,
-				SamplingFrequency: 100,
-				SamplingDuration:  1,
-			}
-		case "temperature":
-			sensor.Settings["temperature"] = settings{
-				Active: true,
-			}
-		case "audio":
-			sensor.Settings["audio"] = settings{
-				Active:            true,
-				SamplingFrequency: 8000,
-				SamplingDuration:  1,
-			}
+		if s, exists := BUILTIN_PROFILE.Settings[t]; exists {
+			sensor.Settings[t] = s
 		}
 	}
 
 	return sensor
 }
 
-func AddSensor(mac [6]byte, types []string, collectionCapacity uint32, publicKey *rsa.PublicKey, sensors *[]Sensor) error {
+// AddSensor pairs a sensor with the settings of the profile. If the profile
+// does not fit the sensor, the sensor is still added with the settings of the
+// built-in profile and the error says why.
+func AddSensor(mac [6]byte, types []string, collectionCapacity uint32, publicKey *PublicKey, protocolVersion byte, profile *Profile, sensors *SensorRegistry) error {
 	if sensors == nil {
 		return errors.New("sensors is nil")
 	}
-
-	*sensors = append(*sensors, getDefaultSensor(mac, types, collectionCapacity, publicKey))
-	err := saveSensors(SENSORS_FILE, sensors)
-	return err
+	sensor := getDefaultSensor(mac, types, collectionCapacity, publicKey, protocolVersion)
+	var profileErr error
+	if profile != nil && profile.Name != BUILTIN_PROFILE_NAME {
+		profileErr = applyProfile(&sensor, profile)
+		if profileErr != nil {
+			profileErr = errors.New("sensor " + MacToString(mac) + " was paired with the built-in profile: " + profileErr.Error())
+		}
+	}
+	err := sensors.Add(sensor)
+	if err != nil {
+		return err
+	}
+	return profileErr
 }
 
-func UpdateSensorSetting(mac [6]byte, setting string, value string, sensors *[]Sensor) error {
+// counters reserved by a write of the sensors file, see CheckMessageCounter
+const MESSAGE_COUNTER_RESERVATION = 1024
+
+// CheckMessageCounter accepts the counter of a message only if it is greater
+// than the counter of the last message accepted from the sensor. The counter
+// is checked on every message, so it is only kept in memory until the
+// registry is flushed (see SensorRegistry.Flush) and rejected messages never
+// cause a write. The counters are reserved in blocks instead: a counter above
+// ReservedMessageCounter is only accepted once a new reservation is saved,
+// and the sensors are loaded with their reservation as the last counter, so
+// that no message accepted before a crash can be accepted again.
+func CheckMessageCounter(mac [6]byte, counter uint32, sensors *SensorRegistry) (bool, error) {
 	if sensors == nil {
-		return errors.New("sensors is nil")
+		return false, errors.New("sensors is nil")
 	}
 
-	var sensor *Sensor
-	for i, s := range *sensors {
-		if s.Mac == mac {
-			sensor = &(*sensors)[i]
-			break
+	accepted, reserve := false, false
+	err := sensors.UpdateInMemory(mac, func(sensor *Sensor) bool {
+		if counter <= sensor.MessageCounter {
+			sensor.RejectedMessages++
+			return false
+		}
+		if counter > sensor.ReservedMessageCounter {
+			reserve = true
+			return false
+		}
+		sensor.MessageCounter = counter
+		accepted = true
+		return true
+	})
+	if err != nil || !reserve {
+		return accepted, err
+	}
+
+	err = sensors.Update(mac, func(sensor *Sensor) error {
+		// checked again, another message may have been accepted meanwhile
+		if counter <= sensor.MessageCounter {
+			sensor.RejectedMessages++
+			return nil
+		}
+		if counter > sensor.ReservedMessageCounter {
+			sensor.ReservedMessageCounter = counter + MESSAGE_COUNTER_RESERVATION
+			if sensor.ReservedMessageCounter < counter {
+				sensor.ReservedMessageCounter = math.MaxUint32
+			}
 		}
+		sensor.MessageCounter = counter
+		accepted = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return accepted, nil
+}
+
+// the profiles are needed by the "auto" and "profile" settings, without them
+// only the built-in profile exists
+func UpdateSensorSetting(mac [6]byte, setting string, value string, sensors *SensorRegistry, profiles *ProfileRegistry) error {
+	if sensors == nil {
+		return errors.New("sensors is nil")
 	}
-	if sensor == nil {
-		return errors.New("sensor not found")
+	return sensors.Update(mac, func(sensor *Sensor) error {
+		return updateSensorSetting(sensor, setting, value, profiles)
+	})
+}
+
+// UpdateSensorsSettings applies the settings ([setting, value] pairs, in
+// order) to every sensor, or to none of them if a setting is invalid for any
+// sensor (e.g. it would exceed its collection capacity)
+func UpdateSensorsSettings(macs [][6]byte, settings [][2]string, sensors *SensorRegistry, profiles *ProfileRegistry) error {
+	if sensors == nil {
+		return errors.New("sensors is nil")
 	}
+	return sensors.UpdateAll(macs, func(sensor *Sensor) error {
+		for _, s := range settings {
+			err := updateSensorSetting(sensor, s[0], s[1], profiles)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
+// called by SensorRegistry.Update, which discards the changes on error
+func updateSensorSetting(sensor *Sensor, setting string, value string, profiles *ProfileRegistry) error {
 	if setting == "auto" {
-		*sensor = getDefaultSensor(mac, sensor.Types, sensor.CollectionCapacity, &sensor.PublicKey)
-		return saveSensors(SENSORS_FILE, sensors)
+		defaultSensor := getDefaultSensor(sensor.Mac, sensor.Types, sensor.CollectionCapacity, &sensor.PublicKey, sensor.ProtocolVersion)
+		// what the sensor told the gateway is not a setting
+		defaultSensor.BatteryLevel = sensor.BatteryLevel
+		defaultSensor.MessageCounter = sensor.MessageCounter
+		defaultSensor.ReservedMessageCounter = sensor.ReservedMessageCounter
+		defaultSensor.RejectedMessages = sensor.RejectedMessages
+		// neither is where the sensor is installed
+		defaultSensor.Description = sensor.Description
+		defaultSensor.Location = sensor.Location
+		defaultSensor.Machine = sensor.Machine
+		defaultSensor.Component = sensor.Component
+		defaultSensor.Tags = sensor.Tags
+		if profiles != nil {
+			profile := profiles.GetDefault()
+			if profile.Name != BUILTIN_PROFILE_NAME {
+				err := applyProfile(&defaultSensor, &profile)
+				if err != nil {
+					return errors.New("default " + err.Error())
+				}
+			}
+		}
+		*sensor = defaultSensor
+		return nil
+	}
+
+	if setting == "profile" {
+		profile := BUILTIN_PROFILE
+		if value != BUILTIN_PROFILE_NAME {
+			exists := false
+			if profiles != nil {
+				profile, exists = profiles.Get(value)
+			}
+			if !exists {
+				return errors.New("profile " + value + " not found")
+			}
+		}
+		return applyProfile(sensor, &profile)
 	}
 
 	if setting == "name" {
 		sensor.Name = value
-		return saveSensors(SENSORS_FILE, sensors)
+		return nil
+	}
+
+	switch setting {
+	case "description":
+		sensor.Description = value
+		return nil
+	case "location":
+		sensor.Location = value
+		return nil
+	case "machine":
+		sensor.Machine = value
+		return nil
+	case "component":
+		sensor.Component = value
+		return nil
+	case "tags":
+		sensor.Tags = ParseTags(value)
+		return nil
 	}
 
 	if setting == "wake_up_interval" {
@@ -209,12 +403,13 @@ func UpdateSensorSetting(mac [6]byte, setting string, value string, sensors *[]S
 		if err != nil {
 			return errors.New("invalid value for wake_up_interval setting (must be an integer (seconds))")
 		}
-		// when converted to milliseconds it will not be a uint32
-		if intValue < sensor.WakeUpIntervalMaxOffset || intValue > 4294967 {
-			return errors.New("invalid value for wake_up_interval setting (must an integer between wake_up_interval_max_offset and 4 294 967)")
+		// the max offset must be smaller than the wake up interval and when
+		// converted to milliseconds it will not be a uint32
+		if intValue < 1 || intValue <= sensor.WakeUpIntervalMaxOffset || intValue > 4294967 {
+			return errors.New("invalid value for wake_up_interval setting (must an integer greater than wake_up_interval_max_offset and at most 4 294 967)")
 		}
 		sensor.WakeUpInterval = intValue
-		return saveSensors(SENSORS_FILE, sensors)
+		return nil
 	}
 	if setting == "wake_up_interval_max_offset" {
 		intValue, err := strconv.Atoi(value)
@@ -226,7 +421,7 @@ func UpdateSensorSetting(mac [6]byte, setting string, value string, sensors *[]S
 			return errors.New("invalid value for wake_up_interval_max_offset setting (must an integer between 0 and wake_up_interval)")
 		}
 		sensor.WakeUpIntervalMaxOffset = intValue
-		return saveSensors(SENSORS_FILE, sensors)
+		return nil
 	}
 
 	settingParts := strings.Split(setting, "_")
@@ -279,11 +474,34 @@ func UpdateSensorSetting(mac [6]byte, setting string, value string, sensors *[]S
 		setting := sensor.Settings[dataType]
 		setting.SamplingDuration = uint16(intValue)
 		sensor.Settings[dataType] = setting
+	case "scale", "full_scale":
+		if dataType != "vibration" {
+			return errors.New("setting " + setting + " only exists for vibration")
+		}
+		floatValue, err := strconv.ParseFloat(value, 64)
+		if err != nil || floatValue <= 0 {
+			return errors.New("invalid value for " + setting + " setting (must be a number greater than 0 (G))")
+		}
+		if setting == "full_scale" {
+			floatValue /= 32768
+		}
+
+		setting := sensor.Settings[dataType]
+		setting.Scale = floatValue
+		sensor.Settings[dataType] = setting
 	default:
 		return errors.New("setting " + setting + " doesn't exist")
 	}
 
-	return saveSensors(SENSORS_FILE, sensors)
+	return nil
+}
+
+// size in bytes of a sample of the data type sent by the sensor
+func getDataSize(sensor *Sensor, dataType string) int {
+	if dataType == "vibration" && sensor.GetProtocolVersion() >= 2 {
+		return COMPACT_VIBRATION_DATA_SIZE
+	}
+	return DATA_SIZE[dataType]
 }
 
 func getCollectionSize(sensor *Sensor) int {
@@ -295,7 +513,10 @@ func getCollectionSize(sensor *Sensor) int {
 		}
 
 		term := int(settings.SamplingFrequency) * int(settings.SamplingDuration)
-		term *= DATA_SIZE[dataType]
+		term *= getDataSize(sensor, dataType)
+		if dataType == "vibration" && sensor.GetProtocolVersion() >= 2 {
+			term += COMPACT_VIBRATION_SCALE_SIZE
+		}
 		result += term
 	}
 	return result
@@ -311,7 +532,7 @@ func isExceedingCollectionCapacity(sensor *Sensor, setting string, value int, da
 		return errors.New("sampling_duration and sampling_frequency must be greater than 0")
 	}
 
-	sizeOfData := DATA_SIZE[dataType]
+	sizeOfData := getDataSize(sensor, dataType)
 	var thisFactor int
 	var otherFactor int
 	if setting == "sampling_frequency" {
@@ -328,26 +549,3 @@ func isExceedingCollectionCapacity(sensor *Sensor, setting string, value int, da
 	}
 	return nil
 }
-
-func saveSensors(fileName string, sensors *[]Sensor) error {
-	if sensors == nil {
-		return errors.New("sensors is nil")
-	}
-
-	jsonStr, err := json.Marshal(sensors)
-	if err != nil {
-		return err
-	}
-
-	configPath, err := os.UserConfigDir()
-	if err != nil {
-		return err
-	}
-
-	err = os.MkdirAll(path.Join(configPath, "ss_machmos"), 0777)
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(path.Join(configPath, "ss_machmos", fileName), jsonStr, 0777)
-}
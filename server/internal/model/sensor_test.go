@@ -0,0 +1,80 @@
+package model
+
+import (
+	"strconv"
+	"testing"
+)
+
+// the sensors and the profiles accept the same wake up intervals and offsets
+func TestWakeUpOffsetRule(t *testing.T) {
+	for _, c := range []struct {
+		interval int
+		offset   int
+		valid    bool
+	}{
+		{600, 0, true},
+		{600, 599, true},
+		{600, 600, false},
+		{600, 601, false},
+		{600, -1, false},
+		{1, 0, true},
+	} {
+		name := strconv.Itoa(c.interval) + " +- " + strconv.Itoa(c.offset)
+
+		_, err := ParseProfile("test", [][2]string{{"wake_up_interval", strconv.Itoa(c.interval)}, {"wake_up_interval_max_offset", strconv.Itoa(c.offset)}, {"temperature_active", "true"}})
+		if (err == nil) != c.valid {
+			t.Error("profile " + name + ": expected valid " + strconv.FormatBool(c.valid) + ", got " + errorString(err))
+		}
+
+		// the offset is set first, then the interval, and the other way around
+		for _, order := range [][2]string{{"wake_up_interval", "wake_up_interval_max_offset"}, {"wake_up_interval_max_offset", "wake_up_interval"}} {
+			sensor := getDefaultSensor([6]byte{}, []string{"vibration"}, 1000000, &PublicKey{}, 2)
+			sensor.WakeUpInterval = 4294967
+			sensor.WakeUpIntervalMaxOffset = 0
+			values := map[string]int{"wake_up_interval": c.interval, "wake_up_interval_max_offset": c.offset}
+			err = nil
+			for _, setting := range order {
+				err = updateSensorSetting(&sensor, setting, strconv.Itoa(values[setting]), nil)
+				if err != nil {
+					break
+				}
+			}
+			if (err == nil) != c.valid {
+				t.Error("sensor " + name + " (" + order[0] + " first): expected valid " + strconv.FormatBool(c.valid) + ", got " + errorString(err))
+			}
+		}
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return "no error"
+	}
+	return err.Error()
+}
+
+// version 2 sensors send 6 bytes per vibration sample after the scale, version 1 sensors 12
+func TestVibrationCollectionSize(t *testing.T) {
+	for _, c := range []struct {
+		version byte
+		size    int
+		header  int
+	}{{1, DATA_SIZE["vibration"], 0}, {2, COMPACT_VIBRATION_DATA_SIZE, COMPACT_VIBRATION_SCALE_SIZE}} {
+		capacity := 1200000 + c.header
+		sensor := getDefaultSensor([6]byte{}, []string{"vibration"}, uint32(capacity), &PublicKey{}, c.version)
+		sensor.Settings = map[string]settings{"vibration": {Active: true, SamplingFrequency: 1, SamplingDuration: 10}}
+
+		maxFrequency := 1200000 / 10 / c.size
+		err := updateSensorSetting(&sensor, "vibration_sampling_frequency", strconv.Itoa(maxFrequency), nil)
+		if err != nil {
+			t.Error("version " + strconv.Itoa(int(c.version)) + ": " + err.Error())
+		}
+		if getCollectionSize(&sensor) != capacity {
+			t.Error("version " + strconv.Itoa(int(c.version)) + ": expected a collection of " + strconv.Itoa(capacity) + " bytes, got " + strconv.Itoa(getCollectionSize(&sensor)))
+		}
+		err = updateSensorSetting(&sensor, "vibration_sampling_frequency", strconv.Itoa(maxFrequency+1), nil)
+		if err == nil {
+			t.Error("version " + strconv.Itoa(int(c.version)) + ": a sampling frequency exceeding the collection capacity was accepted")
+		}
+	}
+}
@@ -1,41 +1,46 @@
 package model
 
 import (
-	"crypto"
-	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/x509"
 	"encoding/binary"
-	"encoding/pem"
 	"errors"
 	"fmt"
+	"os"
+	"path"
 
 	"github.com/google/uuid"
 )
 
-func VerifySignature(data []byte, signature []byte, publicKey *rsa.PublicKey) bool {
-	hash := sha256.Sum256(data)
-	err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], signature)
-	return err == nil
+var configDir = ""
+
+// SetConfigDir overrides the directory in which the gateway and sensors
+// files are stored (the default is <user config dir>/ss_machmos)
+func SetConfigDir(dir string) {
+	configDir = dir
 }
 
-func ParsePublicKey(value []byte) (*rsa.PublicKey, error) {
-	block, _ := pem.Decode(value)
-	if block == nil {
-		return nil, errors.New("failed to parse public key")
+func GetConfigDir() (string, error) {
+	dir, err := getConfigPath()
+	if err != nil {
+		return "", err
 	}
 
-	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	err = os.MkdirAll(dir, 0700)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	return dir, nil
+}
 
-	rsaPub, ok := pub.(*rsa.PublicKey)
-	if !ok {
-		return nil, errors.New("failed to parse public key")
+// same as GetConfigDir without creating the directory
+func getConfigPath() (string, error) {
+	if configDir != "" {
+		return configDir, nil
 	}
-
-	return rsaPub, nil
+	configPath, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(configPath, "ss_machmos"), nil
 }
 
 func UuidToBytes(uuid [4]uint32) []byte {
@@ -0,0 +1,209 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Minimal MQTT 3.1.1 client, only what the gateway needs to publish
+// measurements: CONNECT (with username and password), PUBLISH with QoS 1
+// and DISCONNECT, over TCP or TLS.
+
+const TIMEOUT = 30 * time.Second
+const KEEP_ALIVE = 60 // seconds
+
+const (
+	CONNECT    byte = 0x10
+	CONNACK    byte = 0x20
+	PUBLISH    byte = 0x30
+	PUBACK     byte = 0x40
+	DISCONNECT byte = 0xE0
+)
+
+var CONNACK_ERRORS = map[byte]string{
+	0x01: "unacceptable protocol version",
+	0x02: "identifier rejected",
+	0x03: "server unavailable",
+	0x04: "bad user name or password",
+	0x05: "not authorized",
+}
+
+type Options struct {
+	Broker   string // mqtt://host:port, mqtts://host:port (TLS), tcp:// and ssl:// are accepted as well
+	ClientId string
+	Username string
+	Password string
+}
+
+type Client struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	packetId uint16
+}
+
+func Connect(options Options) (*Client, error) {
+	u, err := url.Parse(options.Broker)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: TIMEOUT}
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "1883")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "mqtts", "ssl", "tls":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "8883")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, errors.New("unsupported broker scheme " + u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{conn: conn, reader: bufio.NewReader(conn)}
+	err = client.connect(options)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func appendString(packet []byte, str string) []byte {
+	packet = binary.BigEndian.AppendUint16(packet, uint16(len(str)))
+	return append(packet, str...)
+}
+
+func (c *Client) write(packetType byte, content []byte) error {
+	packet := []byte{packetType}
+	// remaining length
+	length := len(content)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	packet = append(packet, content...)
+
+	c.conn.SetWriteDeadline(time.Now().Add(TIMEOUT))
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+func (c *Client) read() (byte, []byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(TIMEOUT))
+	packetType, err := c.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := 0
+	for multiplier := 1; ; multiplier *= 128 {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		if multiplier > 128*128*128 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+	}
+	content := make([]byte, length)
+	_, err = io.ReadFull(c.reader, content)
+	return packetType, content, err
+}
+
+func (c *Client) connect(options Options) error {
+	content := appendString([]byte{}, "MQTT")
+	content = append(content, 0x04) // protocol level 3.1.1
+	flags := byte(0x02)             // clean session
+	if options.Username != "" {
+		flags |= 0x80
+		if options.Password != "" {
+			flags |= 0x40
+		}
+	}
+	content = append(content, flags)
+	content = binary.BigEndian.AppendUint16(content, KEEP_ALIVE)
+	content = appendString(content, options.ClientId)
+	if options.Username != "" {
+		content = appendString(content, options.Username)
+		if options.Password != "" {
+			content = appendString(content, options.Password)
+		}
+	}
+
+	err := c.write(CONNECT, content)
+	if err != nil {
+		return err
+	}
+	packetType, res, err := c.read()
+	if err != nil {
+		return err
+	}
+	if packetType&0xF0 != CONNACK || len(res) != 2 {
+		return errors.New("unexpected response from broker")
+	}
+	if res[1] != 0x00 {
+		if msg, exists := CONNACK_ERRORS[res[1]]; exists {
+			return errors.New("connection refused by broker: " + msg)
+		}
+		return errors.New("connection refused by broker (code " + strconv.Itoa(int(res[1])) + ")")
+	}
+	return nil
+}
+
+// Publish sends the payload with QoS 1 and waits for the broker to acknowledge it
+func (c *Client) Publish(topic string, payload []byte) error {
+	c.packetId++
+	if c.packetId == 0 {
+		c.packetId = 1
+	}
+
+	content := appendString([]byte{}, topic)
+	content = binary.BigEndian.AppendUint16(content, c.packetId)
+	content = append(content, payload...)
+	err := c.write(PUBLISH|0x02, content) // QoS 1
+	if err != nil {
+		return err
+	}
+
+	for {
+		packetType, res, err := c.read()
+		if err != nil {
+			return err
+		}
+		if packetType&0xF0 == PUBACK && len(res) == 2 && binary.BigEndian.Uint16(res) == c.packetId {
+			return nil
+		}
+	}
+}
+
+func (c *Client) Close() error {
+	c.write(DISCONNECT, []byte{})
+	return c.conn.Close()
+}
@@ -0,0 +1,265 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type message struct {
+	clientId string
+	topic    string
+	packetId uint16
+	payload  []byte
+}
+
+// fakeBroker accepts connections on a loopback port and acknowledges what
+// the client sends. The fields can be changed between connections.
+type fakeBroker struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	username string
+	password string
+	// closes the connection instead of acknowledging the next publish
+	dropNextPublish bool
+	// a PUBACK with another packet id is sent before the real one
+	strayPuback bool
+	connections int
+	messages    []message
+	errors      []string
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{listener: listener}
+	t.Cleanup(func() {
+		listener.Close()
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		for _, err := range b.errors {
+			t.Error("broker: " + err)
+		}
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) url() string {
+	return "mqtt://" + b.listener.Addr().String()
+}
+
+func (b *fakeBroker) fail(err string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.errors = append(b.errors, err)
+}
+
+func readPacket(reader *bufio.Reader) (byte, []byte, error) {
+	packetType, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := 0
+	for multiplier := 1; ; multiplier *= 128 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	content := make([]byte, length)
+	_, err = io.ReadFull(reader, content)
+	return packetType, content, err
+}
+
+func readString(content []byte) (string, []byte) {
+	if len(content) < 2 || len(content) < 2+int(binary.BigEndian.Uint16(content)) {
+		return "", nil
+	}
+	length := int(binary.BigEndian.Uint16(content))
+	return string(content[2 : 2+length]), content[2+length:]
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	packetType, content, err := readPacket(reader)
+	if err != nil || packetType != CONNECT {
+		b.fail("expected CONNECT")
+		return
+	}
+	protocol, rest := readString(content)
+	if protocol != "MQTT" || len(rest) < 4 || rest[0] != 0x04 {
+		b.fail("expected MQTT 3.1.1")
+		return
+	}
+	flags := rest[1]
+	clientId, rest := readString(rest[4:])
+	username, password := "", ""
+	if flags&0x80 != 0 {
+		username, rest = readString(rest)
+	}
+	if flags&0x40 != 0 {
+		password, _ = readString(rest)
+	}
+
+	b.mutex.Lock()
+	b.connections++
+	code := byte(0x00)
+	if username != b.username || password != b.password {
+		code = 0x04
+	}
+	b.mutex.Unlock()
+	conn.Write([]byte{CONNACK, 0x02, 0x00, code})
+	if code != 0x00 {
+		return
+	}
+
+	for {
+		packetType, content, err := readPacket(reader)
+		if err != nil || packetType == DISCONNECT {
+			return
+		}
+		if packetType != PUBLISH|0x02 {
+			b.fail("expected PUBLISH with QoS 1")
+			return
+		}
+		topic, rest := readString(content)
+		if len(rest) < 2 {
+			b.fail("PUBLISH without packet id")
+			return
+		}
+		packetId := binary.BigEndian.Uint16(rest)
+
+		b.mutex.Lock()
+		drop := b.dropNextPublish
+		b.dropNextPublish = false
+		stray := b.strayPuback
+		if !drop {
+			b.messages = append(b.messages, message{clientId: clientId, topic: topic, packetId: packetId, payload: rest[2:]})
+		}
+		b.mutex.Unlock()
+		if drop {
+			return
+		}
+		if stray {
+			conn.Write([]byte{PUBACK, 0x02, byte((packetId + 1) >> 8), byte(packetId + 1)})
+		}
+		conn.Write([]byte{PUBACK, 0x02, byte(packetId >> 8), byte(packetId)})
+	}
+}
+
+func (b *fakeBroker) received() []message {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]message{}, b.messages...)
+}
+
+func TestPublish(t *testing.T) {
+	broker := newFakeBroker(t)
+	broker.username, broker.password = "gateway", "secret"
+	broker.strayPuback = true
+
+	client, err := Connect(Options{Broker: broker.url(), ClientId: "ssmachmos-test", Username: "gateway", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// more than 127 bytes so the remaining length takes two bytes
+	payloads := [][]byte{[]byte(`{"value":1}`), bytes.Repeat([]byte("x"), 300)}
+	for _, payload := range payloads {
+		err = client.Publish("machmos/measurements", payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages := broker.received()
+	if len(messages) != len(payloads) {
+		t.Fatalf("expected %d messages, got %d", len(payloads), len(messages))
+	}
+	for i, m := range messages {
+		if m.clientId != "ssmachmos-test" || m.topic != "machmos/measurements" || !bytes.Equal(m.payload, payloads[i]) {
+			t.Errorf("message %d was not received as sent", i)
+		}
+		if m.packetId != uint16(i+1) {
+			t.Errorf("expected packet id %d, got %d", i+1, m.packetId)
+		}
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	broker := newFakeBroker(t)
+	broker.username, broker.password = "gateway", "secret"
+
+	_, err := Connect(Options{Broker: broker.url(), ClientId: "ssmachmos-test", Username: "gateway", Password: "wrong"})
+	if err == nil || !strings.Contains(err.Error(), CONNACK_ERRORS[0x04]) {
+		t.Fatalf("expected the connection to be refused, got %v", err)
+	}
+}
+
+// the sinks connect again for every batch, a publish that was never
+// acknowledged fails and is sent again on a new connection
+func TestPublishAfterReconnect(t *testing.T) {
+	broker := newFakeBroker(t)
+	broker.dropNextPublish = true
+
+	client, err := Connect(Options{Broker: broker.url(), ClientId: "ssmachmos-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Publish("machmos/measurements", []byte("batch"))
+	client.Close()
+	if err == nil {
+		t.Fatal("a publish that was not acknowledged succeeded")
+	}
+
+	client, err = Connect(Options{Broker: broker.url(), ClientId: "ssmachmos-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	err = client.Publish("machmos/measurements", []byte("batch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := broker.received()
+	if len(messages) != 1 || string(messages[0].payload) != "batch" {
+		t.Errorf("expected the batch to be received once, got %d messages", len(messages))
+	}
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	if broker.connections != 2 {
+		t.Errorf("expected 2 connections, got %d", broker.connections)
+	}
+}
+
+func TestUnsupportedScheme(t *testing.T) {
+	_, err := Connect(Options{Broker: "ws://127.0.0.1:1883"})
+	if err == nil {
+		t.Fatal("a websocket broker was accepted")
+	}
+}
@@ -1,32 +1,115 @@
 package out
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"sync"
 )
 
 type logWriter struct{}
 
 var Logger *log.Logger = log.New(logWriter{}, "", log.Lshortfile|log.LstdFlags)
-var PairingConnections map[*net.Conn]bool = make(map[*net.Conn]bool)
-var LoggingConnections map[*net.Conn]bool = make(map[*net.Conn]bool)
 
-func (writer logWriter) Write(bytes []byte) (int, error) {
-	log.Writer().Write(bytes)
-	for conn := range LoggingConnections {
+// the connections are added and removed by the socket handlers while the
+// server logs from other goroutines
+var connectionsMutex sync.Mutex
+var pairingConnections map[*net.Conn]bool = make(map[*net.Conn]bool)
+var loggingConnections map[*net.Conn]bool = make(map[*net.Conn]bool)
+var jsonConnections map[*net.Conn]bool = make(map[*net.Conn]bool) // connections using the JSON protocol
+
+// what the connections using the JSON protocol receive instead of "LOG:" and "MSG:"
+type Event struct {
+	Event   string `json:"event"` // "log" or "pairing"
+	Message string `json:"message"`
+}
+
+func SetJSONConnection(conn *net.Conn) {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	jsonConnections[conn] = true
+}
+
+func AddPairingConnection(conn *net.Conn) {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	pairingConnections[conn] = true
+}
+
+// RemovePairingConnection returns how many connections are still in pairing mode
+func RemovePairingConnection(conn *net.Conn) int {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	delete(pairingConnections, conn)
+	return len(pairingConnections)
+}
+
+func CountPairingConnections() int {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	return len(pairingConnections)
+}
+
+func AddLoggingConnection(conn *net.Conn) {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	loggingConnections[conn] = true
+}
+
+func RemoveLoggingConnection(conn *net.Conn) {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	delete(loggingConnections, conn)
+}
+
+func RemoveConnection(conn *net.Conn) {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	delete(pairingConnections, conn)
+	delete(loggingConnections, conn)
+	delete(jsonConnections, conn)
+}
+
+// broadcast writes the message to a copy of the connections, so a slow
+// connection does not hold the lock, and removes the ones that failed
+func broadcast(connections map[*net.Conn]bool, name string, event string, prefix string, message string) {
+	connectionsMutex.Lock()
+	frames := map[*net.Conn][]byte{}
+	for conn := range connections {
 		if conn == nil || (*conn) == nil {
-			delete(LoggingConnections, conn)
-			fmt.Printf("Removing connection %v from LoggingConnections\n", conn)
+			delete(connections, conn)
+			fmt.Printf("Removing connection %v from %s\n", conn, name)
 			continue
 		}
-		_, err := (*conn).Write([]byte("LOG:" + string(bytes) + "\x00"))
+		frames[conn] = frame(conn, event, prefix, message)
+	}
+	connectionsMutex.Unlock()
+
+	for conn, f := range frames {
+		_, err := (*conn).Write(f)
 		if err != nil {
-			delete(LoggingConnections, conn)
+			connectionsMutex.Lock()
+			delete(connections, conn)
+			connectionsMutex.Unlock()
 			fmt.Println("Error:", err)
-			fmt.Printf("Removing connection %v from LoggingConnections\n", conn)
+			fmt.Printf("Removing connection %v from %s\n", conn, name)
 		}
 	}
+}
+
+// called with connectionsMutex held
+func frame(conn *net.Conn, event string, prefix string, message string) []byte {
+	if jsonConnections[conn] {
+		jsonStr, _ := json.Marshal(Event{Event: event, Message: message})
+		return append(jsonStr, '\x00')
+	}
+	return []byte(prefix + message + "\x00")
+}
+
+func (writer logWriter) Write(bytes []byte) (int, error) {
+	log.Writer().Write(bytes)
+	broadcast(loggingConnections, "LoggingConnections", "log", "LOG:", string(bytes))
 	return len(bytes), nil
 }
 
@@ -35,18 +118,6 @@ func SetLogger(logger *log.Logger) {
 }
 
 func PairingLog(msg string) {
-	for conn := range PairingConnections {
-		if conn == nil || (*conn) == nil {
-			delete(PairingConnections, conn)
-			fmt.Printf("Removing connection %v from PairingConnections\n", conn)
-			continue
-		}
-		_, err := (*conn).Write([]byte("MSG:" + msg + "\x00"))
-		if err != nil {
-			delete(PairingConnections, conn)
-			fmt.Println("Error:", err)
-			fmt.Printf("Removing connection %v from PairingConnections\n", conn)
-		}
-	}
+	broadcast(pairingConnections, "PairingConnections", "pairing", "MSG:", msg)
 	Logger.Println(msg)
 }
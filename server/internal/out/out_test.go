@@ -0,0 +1,46 @@
+package out
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// run with go test -race
+func TestConnectionsConcurrentAccess(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		client, server := net.Pipe()
+		go io.Copy(io.Discard, client)
+		conn := &server
+
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				SetJSONConnection(conn)
+			}
+			for j := 0; j < 50; j++ {
+				AddLoggingConnection(conn)
+				AddPairingConnection(conn)
+				RemoveLoggingConnection(conn)
+				RemovePairingConnection(conn)
+			}
+			RemoveConnection(conn)
+			server.Close()
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				Logger.Println("log")
+				PairingLog("pairing")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if CountPairingConnections() != 0 {
+		t.Error("connections left after being removed")
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const INFLUX_MEASUREMENT = "ssmachmos"
+const INFLUX_BATCH_SIZE = 5000 // lines per write request (recommended by InfluxDB)
+
+var influxTagEscaper = strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ")
+
+// converts the measurements built in handleData to InfluxDB line protocol
+// every sample becomes its own point, sample i being taken at
+// time + i / sampling_frequency
+func toLineProtocol(measurements []map[string]interface{}, gatewayId string) ([]string, error) {
+	lines := []string{}
+	for _, m := range measurements {
+		sensorId, _ := m["sensor_id"].(string)
+		measurementType, _ := m["measurement_type"].(string)
+		axis, _ := m["axis"].(string)
+		timestamp, _ := m["time"].(string)
+		samplingFrequency, _ := m["sampling_frequency"].(float64)
+
+		t, err := time.Parse(ISO8601, timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		var samples []float64
+		switch data := m["raw_data"].(type) {
+		case float64:
+			samples = []float64{data}
+		case []interface{}:
+			for _, sample := range data {
+				value, ok := sample.(float64)
+				if !ok {
+					return nil, errors.New("invalid sample in " + measurementType + " data from " + sensorId)
+				}
+				samples = append(samples, value)
+			}
+		default:
+			// raw bytes of an unknown data type
+			continue
+		}
+
+		tags := INFLUX_MEASUREMENT +
+			",gateway_id=" + influxTagEscaper.Replace(gatewayId) +
+			",sensor_id=" + influxTagEscaper.Replace(sensorId)
+		for _, key := range []string{"sensor_name", "location", "machine", "component"} {
+			if value, _ := m[key].(string); value != "" {
+				tags += "," + key + "=" + influxTagEscaper.Replace(value)
+			}
+		}
+		tags += ",type=" + influxTagEscaper.Replace(measurementType)
+		if axis != "" {
+			tags += ",axis=" + influxTagEscaper.Replace(axis)
+		}
+
+		for i, sample := range samples {
+			sampleTime := t.UnixNano()
+			if samplingFrequency > 0 {
+				sampleTime += int64(float64(i) * float64(time.Second) / samplingFrequency)
+			}
+			lines = append(lines, tags+" value="+strconv.FormatFloat(sample, 'g', -1, 64)+" "+strconv.FormatInt(sampleTime, 10))
+		}
+	}
+	return lines, nil
+}
+
+func (s influxSink) send(jsonData []byte) error {
+	measurements, err := decodeBatch(jsonData)
+	if err != nil {
+		return err
+	}
+	lines, err := toLineProtocol(measurements, s.gatewayId)
+	if err != nil {
+		return permanentError{err}
+	}
+
+	for start := 0; start < len(lines); start += INFLUX_BATCH_SIZE {
+		end := start + INFLUX_BATCH_SIZE
+		if end > len(lines) {
+			end = len(lines)
+		}
+		err = s.write(strings.Join(lines[start:end], "\n"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s influxSink) write(body string) error {
+	req, err := http.NewRequest(http.MethodPost, s.config.URL, bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.config.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.config.Token)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// InfluxDB answers 204 No Content when the points are written
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return statusError(resp, "error writing data to InfluxDB")
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// the measurements go through JSON like they do through the spool
+func toTestBatch(t *testing.T, measurements []map[string]interface{}) []map[string]interface{} {
+	t.Helper()
+	jsonData, err := json.Marshal(measurements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := decodeBatch(jsonData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return batch
+}
+
+// a message of a sensor as built by handleData
+func TestLineProtocolGolden(t *testing.T) {
+	sensor := &model.Sensor{
+		Mac:       [6]byte{0x5E, 0, 0, 0, 0, 1},
+		Name:      "pump-3",
+		Location:  "building A, line 2",
+		Machine:   "pump 3",
+		Component: "motor=DE bearing",
+	}
+	sensorId := model.MacToString(sensor.Mac)
+	timestamp := "2024-05-01T12:00:00Z"
+	measurements := []map[string]interface{}{
+		{"sensor_id": sensorId, "time": timestamp, "measurement_type": "battery", "sampling_frequency": 0, "raw_data": [1]int{87}},
+		{"sensor_id": sensorId, "time": timestamp, "measurement_type": "vibration", "sampling_frequency": uint32(4), "axis": "x", "raw_data": []float32{0.5, -0.25, 1, 0}},
+		{"sensor_id": sensorId, "time": timestamp, "measurement_type": "vibration", "sampling_frequency": uint32(4), "axis": "y", "raw_data": []float32{0, 0, 0, 0}},
+		{"sensor_id": sensorId, "time": timestamp, "measurement_type": "vibration", "sampling_frequency": uint32(4), "axis": "z", "raw_data": []float32{1, 1.0625, 0.9375, 1}},
+		{"sensor_id": sensorId, "time": timestamp, "measurement_type": "temperature", "sampling_frequency": uint32(0), "raw_data": 21.5},
+		{"sensor_id": sensorId, "time": timestamp, "measurement_type": "audio", "sampling_frequency": uint32(3), "raw_data": []float32{0.5, -0.5, 0}, "pcm24": []int32{1 << 22, -1 << 22, 0}},
+		{"sensor_id": sensorId, "time": timestamp, "measurement_type": "unknown", "sampling_frequency": uint32(1), "raw_data": []byte{1, 2, 3}},
+	}
+	addSensorMetadata(measurements, sensor)
+
+	lines, err := toLineProtocol(toTestBatch(t, measurements), "gateway 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := strings.Join(lines, "\n") + "\n"
+
+	goldenPath := path.Join("testdata", "line_protocol.golden")
+	if *update {
+		err = os.MkdirAll("testdata", 0755)
+		if err == nil {
+			err = os.WriteFile(goldenPath, []byte(result), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != string(golden) {
+		t.Errorf("the line protocol does not match %s (run with -update to rewrite it):\n%s", goldenPath, result)
+	}
+}
+
+// commas, equal signs and spaces are escaped in the tags
+func TestLineProtocolEscaping(t *testing.T) {
+	measurements := toTestBatch(t, []map[string]interface{}{{
+		"sensor_id":          "5E:00:00:00:00:01",
+		"sensor_name":        "pump, line=2",
+		"location":           "a b",
+		"machine":            "x=y",
+		"component":          "c,d",
+		"time":               "2024-05-01T12:00:00Z",
+		"measurement_type":   "temperature",
+		"sampling_frequency": 0,
+		"raw_data":           -3.5,
+	}})
+	lines, err := toLineProtocol(measurements, "gateway,1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `ssmachmos,gateway_id=gateway\,1,sensor_id=5E:00:00:00:00:01,sensor_name=pump\,\ line\=2,location=a\ b,machine=x\=y,component=c\,d,type=temperature value=-3.5 1714564800000000000`
+	if len(lines) != 1 || lines[0] != expected {
+		t.Errorf("expected\n%s\ngot\n%v", expected, lines)
+	}
+}
+
+// sample i is taken at time + i / sampling_frequency
+func TestLineProtocolTimestamps(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 123000000, time.UTC)
+	for _, c := range []struct {
+		samplingFrequency uint32
+		samples           int
+		spacing           time.Duration
+	}{
+		{1, 3, time.Second},
+		{4, 5, 250 * time.Millisecond},
+		{3, 4, time.Second / 3},
+		{25600, 3, time.Second / 25600},
+		// no sampling frequency, every sample at the time of the message
+		{0, 2, 0},
+	} {
+		measurements := toTestBatch(t, []map[string]interface{}{{
+			"sensor_id":          "5E:00:00:00:00:01",
+			"time":               start.Format(ISO8601),
+			"measurement_type":   "vibration",
+			"axis":               "x",
+			"sampling_frequency": c.samplingFrequency,
+			"raw_data":           make([]float32, c.samples),
+		}})
+		lines, err := toLineProtocol(measurements, "gateway")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) != c.samples {
+			t.Errorf("%d Hz: expected %d lines, got %d", c.samplingFrequency, c.samples, len(lines))
+			continue
+		}
+		for i, line := range lines {
+			fields := strings.Split(line, " ")
+			timestamp, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := start.UnixNano() + int64(i)*int64(c.spacing)
+			// the spacing is rounded to the nanosecond
+			if timestamp < expected-int64(i) || timestamp > expected+int64(i) {
+				t.Errorf("%d Hz: sample %d: expected %d, got %d", c.samplingFrequency, i, expected, timestamp)
+			}
+		}
+	}
+}
+
+func TestLineProtocolInvalidBatch(t *testing.T) {
+	for _, m := range []map[string]interface{}{
+		{"sensor_id": "5E:00:00:00:00:01", "time": "yesterday", "measurement_type": "temperature", "raw_data": 20},
+		{"sensor_id": "5E:00:00:00:00:01", "time": "2024-05-01T12:00:00Z", "measurement_type": "audio", "raw_data": []interface{}{0.5, "loud"}},
+	} {
+		_, err := toLineProtocol(toTestBatch(t, []map[string]interface{}{m}), "gateway")
+		if err == nil {
+			t.Errorf("expected an error for %v", m)
+		}
+	}
+}
+
+// the name is the one the sensor had when its data was received
+func TestLineProtocolSensorNameAtEnqueue(t *testing.T) {
+	newTestServer(t)
+	mac := [6]byte{0x5E, 0, 0, 0, 0, 1}
+	err := Sensors.Add(model.Sensor{Mac: mac, Name: "before"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sensor, _ := Sensors.Get(mac)
+	measurements := []map[string]interface{}{{"sensor_id": model.MacToString(mac), "time": "2024-05-01T12:00:00Z", "measurement_type": "temperature", "raw_data": 20.0}}
+	addSensorMetadata(measurements, &sensor)
+	batch := toTestBatch(t, measurements)
+
+	err = Sensors.Update(mac, func(s *model.Sensor) error {
+		s.Name = "after"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, err := toLineProtocol(batch, "gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || !strings.Contains(lines[0], ",sensor_name=before,") {
+		t.Errorf("expected the name before the rename, got %v", lines)
+	}
+}
@@ -2,73 +2,173 @@ package server
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"math"
 	"net/http"
-	"os"
-	"path"
+	"strconv"
+	"time"
 
 	"github.com/jukuly/ss_machmos/server/internal/model"
 	"github.com/jukuly/ss_machmos/server/internal/out"
+	"github.com/jukuly/ss_machmos/server/internal/store"
 )
 
+var httpClient = &http.Client{Timeout: time.Minute}
+
 type requestBody struct {
 	GatewayId       string                   `json:"gateway_id"`
 	GatewayPassword string                   `json:"gateway_password"`
 	Measurements    []map[string]interface{} `json:"measurements"`
 }
 
-func sendMeasurements(jsonData []byte, gateway *model.Gateway) (*http.Response, error) {
-	body := requestBody{
-		GatewayId:       gateway.Id,
-		GatewayPassword: gateway.Password,
+// the measurements describe the asset the sensor is installed on, so that
+// the data can be interpreted without the sensors file of the gateway
+func addSensorMetadata(measurements []map[string]interface{}, sensor *model.Sensor) {
+	for _, m := range measurements {
+		// the name when the data was received, the sensor can be renamed before the upload
+		m["sensor_name"] = sensor.Name
+		if sensor.Description != "" {
+			m["description"] = sensor.Description
+		}
+		if sensor.Location != "" {
+			m["location"] = sensor.Location
+		}
+		if sensor.Machine != "" {
+			m["machine"] = sensor.Machine
+		}
+		if sensor.Component != "" {
+			m["component"] = sensor.Component
+		}
+		if len(sensor.Tags) > 0 {
+			m["tags"] = sensor.Tags
+		}
+	}
+}
+
+// keeps a local copy of every measurement (see the store package)
+func storeMeasurements(mac [6]byte, t time.Time, measurements []map[string]interface{}) {
+	for _, m := range measurements {
+		measurement := store.Measurement{
+			Sensor: mac,
+			Time:   t,
+		}
+		measurement.Type, _ = m["measurement_type"].(string)
+		measurement.Axis, _ = m["axis"].(string)
+		if samplingFrequency, ok := m["sampling_frequency"].(uint32); ok {
+			measurement.SamplingFrequency = samplingFrequency
+		}
+
+		switch data := m["raw_data"].(type) {
+		case []float32:
+			measurement.Samples = data
+		case float64:
+			measurement.Samples = []float32{float32(data)}
+		case [1]int:
+			measurement.Samples = []float32{float32(data[0])}
+		case []byte:
+			measurement.Samples = make([]float32, len(data))
+			for i, b := range data {
+				measurement.Samples[i] = float32(b)
+			}
+		default:
+			continue
+		}
+
+		err := store.Append(measurement)
+		if err != nil {
+			out.Logger.Println("Error:", err)
+		}
+	}
+}
+
+func SetRetention(days int) error {
+	err := model.SetGatewayRetention(Gateway, days)
+	if err != nil {
+		return err
+	}
+	pruneStore()
+	return nil
+}
+
+// deletes the stored measurements older than the retention of the gateway
+func pruneStore() {
+	days := model.GetRetention(Gateway)
+	if days == 0 {
+		return
 	}
+	removed, err := store.Prune(time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		out.Logger.Println("Error:", err)
+	}
+	if removed > 0 {
+		out.Logger.Println("Deleted " + strconv.Itoa(removed) + " files of measurements older than " + strconv.Itoa(days) + " days")
+	}
+}
+
+func sendMeasurements(jsonData []byte, endpoint string, gateway *model.Gateway) (*http.Response, error) {
+	body := requestBody{}
+	body.GatewayId, body.GatewayPassword = model.GetGatewayCredentials(gateway)
 	err := json.Unmarshal(jsonData, &body.Measurements)
 	if err != nil {
-		return nil, err
+		return nil, permanentError{errors.New("invalid batch of measurements: " + err.Error())}
 	}
 	json, err := json.Marshal(body)
 	if err != nil {
 		return nil, err
 	}
 
-	return http.Post(gateway.HTTPEndpoint, "application/json", bytes.NewBuffer([]byte(json)))
+	return httpClient.Post(endpoint, "application/json", bytes.NewBuffer([]byte(json)))
 }
 
-func saveUnsentMeasurements(data []byte, timestamp string) error {
-	err := os.MkdirAll(path.Join(os.TempDir(), "ss_machmos", UNSENT_DATA_PATH), 0777)
-	if err != nil {
-		return err
+// 3 axes, 4 bytes per axis (32 bits float in G) => 12 bytes per measurement
+func parseVibrationData(data []byte) ([]float32, []float32, []float32) {
+	numberOfMeasurements := len(data) / 12
+	x, y, z := make([]float32, numberOfMeasurements), make([]float32, numberOfMeasurements), make([]float32, numberOfMeasurements)
+	for i := 0; i < numberOfMeasurements; i++ {
+		x[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[i*12 : 4+i*12]))
+		y[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4+i*12 : 8+i*12]))
+		z[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[8+i*12 : 12+i*12]))
 	}
-
-	return os.WriteFile(path.Join(os.TempDir(), "ss_machmos", UNSENT_DATA_PATH, timestamp+".json"), data, 0777)
+	return x, y, z
 }
 
-func sendUnsentMeasurements() {
-	files, err := os.ReadDir(path.Join(os.TempDir(), "ss_machmos", UNSENT_DATA_PATH))
-	if err != nil {
-		out.Logger.Println("Error:", err)
-		return
+// scale (32 bits float, G per unit) | 3 axes, 2 bytes per axis (16 bits signed integer multiplied by the scale to get G) => 6 bytes per measurement
+// the scale is the one the sensor sampled with, the setting may have changed since
+func parseCompactVibrationData(data []byte) ([]float32, []float32, []float32, error) {
+	if len(data) < model.COMPACT_VIBRATION_SCALE_SIZE {
+		return nil, nil, nil, errors.New("compact vibration data without scale")
+	}
+	scale := float64(math.Float32frombits(binary.LittleEndian.Uint32(data[:model.COMPACT_VIBRATION_SCALE_SIZE])))
+	if math.IsNaN(scale) || math.IsInf(scale, 0) || scale <= 0 {
+		return nil, nil, nil, errors.New("invalid scale in compact vibration data")
+	}
+	data = data[model.COMPACT_VIBRATION_SCALE_SIZE:]
+	if len(data)%model.COMPACT_VIBRATION_DATA_SIZE != 0 {
+		return nil, nil, nil, errors.New("invalid length of compact vibration data (" + strconv.Itoa(len(data)) + " bytes)")
 	}
 
-	for _, file := range files {
-		data, err := os.ReadFile(path.Join(os.TempDir(), "ss_machmos", UNSENT_DATA_PATH, file.Name()))
-		if err != nil {
-			out.Logger.Println("Error:", err)
-			continue
-		}
-
-		resp, err := sendMeasurements(data, Gateway)
-		if err != nil {
-			out.Logger.Println("Error:", err)
-			continue
-		}
+	numberOfMeasurements := len(data) / 6
+	x, y, z := make([]float32, numberOfMeasurements), make([]float32, numberOfMeasurements), make([]float32, numberOfMeasurements)
+	for i := 0; i < numberOfMeasurements; i++ {
+		x[i] = float32(float64(int16(binary.LittleEndian.Uint16(data[i*6:2+i*6]))) * scale)
+		y[i] = float32(float64(int16(binary.LittleEndian.Uint16(data[2+i*6:4+i*6]))) * scale)
+		z[i] = float32(float64(int16(binary.LittleEndian.Uint16(data[4+i*6:6+i*6]))) * scale)
+	}
+	return x, y, z, nil
+}
 
-		if resp.StatusCode == 200 {
-			os.Remove(path.Join(os.TempDir(), "ss_machmos", UNSENT_DATA_PATH, file.Name()))
-		}
+// 24 bit signed little endian samples, returned as integers and normalized to [-1, 1)
+func parsePCM24Data(data []byte) ([]int32, []float32) {
+	numberOfSamples := len(data) / 3
+	samples, normalized := make([]int32, numberOfSamples), make([]float32, numberOfSamples)
+	for i := 0; i < numberOfSamples; i++ {
+		// shift left then right to extend the sign bit
+		samples[i] = int32(uint32(data[i*3])<<8|uint32(data[i*3+1])<<16|uint32(data[i*3+2])<<24) >> 8
+		normalized[i] = float32(samples[i]) / (1 << 23)
 	}
+	return samples, normalized
 }
 
 func parseTemperatureData(data uint16) (float64, error) {
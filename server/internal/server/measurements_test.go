@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func float32Bytes(values ...float32) []byte {
+	data := []byte{}
+	for _, v := range values {
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(v))
+	}
+	return data
+}
+
+func int16Bytes(values ...int16) []byte {
+	data := []byte{}
+	for _, v := range values {
+		data = binary.LittleEndian.AppendUint16(data, uint16(v))
+	}
+	return data
+}
+
+func TestParseVibrationData(t *testing.T) {
+	x, y, z := parseVibrationData(append(float32Bytes(0.5, -1.25, 1, 2, 0, -0.125), 0xFF))
+	if len(x) != 2 || len(y) != 2 || len(z) != 2 {
+		t.Fatalf("expected 2 samples, got %d", len(x))
+	}
+	expected := [][3]float32{{0.5, -1.25, 1}, {2, 0, -0.125}}
+	for i, e := range expected {
+		if x[i] != e[0] || y[i] != e[1] || z[i] != e[2] {
+			t.Errorf("sample %d: expected %v, got [%v %v %v]", i, e, x[i], y[i], z[i])
+		}
+	}
+}
+
+func TestParseCompactVibrationData(t *testing.T) {
+	cases := []struct {
+		name    string
+		data    []byte
+		samples [][3]float32
+		valid   bool
+	}{
+		{"default scale", append(float32Bytes(16.0/32768), int16Bytes(2048, -2048, 32767)...), [][3]float32{{1, -1, 16.0 * 32767 / 32768}}, true},
+		// the scale of the frame is used, whatever the setting of the sensor is now
+		{"other scale", append(float32Bytes(0.5), int16Bytes(1, -2, 0, -32768, 4, 3)...), [][3]float32{{0.5, -1, 0}, {-16384, 2, 1.5}}, true},
+		{"no sample", float32Bytes(1), [][3]float32{}, true},
+		{"no scale", []byte{0x00, 0x01}, nil, false},
+		{"zero scale", append(float32Bytes(0), int16Bytes(1, 1, 1)...), nil, false},
+		{"negative scale", append(float32Bytes(-1), int16Bytes(1, 1, 1)...), nil, false},
+		{"infinite scale", append(float32Bytes(float32(math.Inf(1))), int16Bytes(1, 1, 1)...), nil, false},
+		{"NaN scale", append(float32Bytes(float32(math.NaN())), int16Bytes(1, 1, 1)...), nil, false},
+		{"odd length", append(float32Bytes(1), int16Bytes(1, 1, 1, 1)...), nil, false},
+	}
+	for _, c := range cases {
+		x, y, z, err := parseCompactVibrationData(c.data)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("%s: invalid data was accepted", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if len(x) != len(c.samples) || len(y) != len(c.samples) || len(z) != len(c.samples) {
+			t.Errorf("%s: expected %d samples, got %d", c.name, len(c.samples), len(x))
+			continue
+		}
+		for i, e := range c.samples {
+			if x[i] != e[0] || y[i] != e[1] || z[i] != e[2] {
+				t.Errorf("%s: sample %d: expected %v, got [%v %v %v]", c.name, i, e, x[i], y[i], z[i])
+			}
+		}
+	}
+}
+
+func TestParsePCM24Data(t *testing.T) {
+	cases := []struct {
+		name       string
+		data       []byte
+		samples    []int32
+		normalized []float32
+	}{
+		{"zero", []byte{0x00, 0x00, 0x00}, []int32{0}, []float32{0}},
+		{"little endian", []byte{0x56, 0x34, 0x12}, []int32{0x123456}, []float32{float32(0x123456) / (1 << 23)}},
+		{"maximum", []byte{0xFF, 0xFF, 0x7F}, []int32{8388607}, []float32{float32(8388607) / (1 << 23)}},
+		// the sign bit of the third byte is extended
+		{"minus one", []byte{0xFF, 0xFF, 0xFF}, []int32{-1}, []float32{-1.0 / (1 << 23)}},
+		{"minimum", []byte{0x00, 0x00, 0x80}, []int32{-8388608}, []float32{-1}},
+		{"half", []byte{0x00, 0x00, 0x40, 0x00, 0x00, 0xC0}, []int32{1 << 22, -1 << 22}, []float32{0.5, -0.5}},
+		// the bytes that do not make a whole sample are ignored
+		{"odd length", []byte{0x01, 0x00, 0x00, 0xFF, 0xFF}, []int32{1}, []float32{1.0 / (1 << 23)}},
+		{"shorter than a sample", []byte{0xFF}, []int32{}, []float32{}},
+		{"empty", []byte{}, []int32{}, []float32{}},
+	}
+	for _, c := range cases {
+		samples, normalized := parsePCM24Data(c.data)
+		if len(samples) != len(c.samples) || len(normalized) != len(c.normalized) {
+			t.Errorf("%s: expected %d samples, got %d", c.name, len(c.samples), len(samples))
+			continue
+		}
+		for i := range samples {
+			if samples[i] != c.samples[i] {
+				t.Errorf("%s: sample %d: expected %d, got %d", c.name, i, c.samples[i], samples[i])
+			}
+			if normalized[i] != c.normalized[i] {
+				t.Errorf("%s: sample %d: expected %v normalized, got %v", c.name, i, c.normalized[i], normalized[i])
+			}
+			if normalized[i] < -1 || normalized[i] >= 1 {
+				t.Errorf("%s: sample %d: %v is not in [-1, 1)", c.name, i, normalized[i])
+			}
+		}
+	}
+}
@@ -1,8 +1,8 @@
 package server
 
 import (
-	"crypto/rsa"
 	"encoding/binary"
+	"sync"
 	"time"
 
 	"github.com/jukuly/ss_machmos/server/internal/model"
@@ -10,40 +10,75 @@ import (
 )
 
 type request struct {
-	publicKey          *rsa.PublicKey
+	publicKey          *model.PublicKey
 	dataTypes          []string
 	collectionCapacity uint32
+	protocolVersion    byte
 }
 
+// the state is changed by the bluetooth callbacks, the socket and the timeouts
 type pairingState struct {
+	mutex     sync.Mutex
 	active    bool
 	requested map[[6]byte]request
 	pairing   [6]byte
 }
 
-var state pairingState
+var state = pairingState{
+	requested: make(map[[6]byte]request),
+}
+
+func resetPairing() {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.active = false
+	state.requested = make(map[[6]byte]request)
+	state.pairing = [6]byte{}
+}
 
 func EnablePairing() {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
 	state.active = true
 }
 
 func DisablePairing() {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
 	state.active = false
 }
 
+func IsPairingEnabled() bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.active
+}
+
+// MAC addresses of the sensors waiting to be paired
+func GetPairingRequests() []string {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	requests := []string{}
+	for mac := range state.requested {
+		requests = append(requests, model.MacToString(mac))
+	}
+	return requests
+}
+
 // see protocol.md to understand what is going on here
 func pairRequest(value []byte) {
-	if len(value) < 12 || !state.active {
+	if len(value) < 13 || !IsPairingEnabled() {
 		return
 	}
 	mac := [6]byte(value[1:7])
-	for _, s := range *Sensors {
-		if s.Mac == mac {
-			out.PairingLog("REQUEST-SENSOR-EXISTS:" + model.MacToString(mac))
-			return
-		}
+	if Sensors.Contains(mac) {
+		out.PairingLog("REQUEST-SENSOR-EXISTS:" + model.MacToString(mac))
+		return
 	}
-	if _, exists := state.requested[mac]; exists {
+	state.mutex.Lock()
+	_, exists := state.requested[mac]
+	state.mutex.Unlock()
+	if exists {
 		return
 	}
 
@@ -59,21 +94,53 @@ func pairRequest(value []byte) {
 	}
 
 	collectionCapacity := binary.LittleEndian.Uint32(value[8:12])
-	publicKey, err := model.ParsePublicKey(value[12:])
+
+	// sensors that predate the protocol version send a PEM encoded RSA key right away
+	protocolVersion := byte(1)
+	algorithm := model.KEY_RSA
+	key := value[12:]
+	if key[0] != '-' {
+		if len(key) < 3 || key[0] < 2 {
+			out.Logger.Println("Invalid pairing request from " + model.MacToString(mac))
+			return
+		}
+		protocolVersion = key[0]
+		if protocolVersion > PROTOCOL_VERSION {
+			protocolVersion = PROTOCOL_VERSION
+		}
+		var known bool
+		algorithm, known = model.KEY_ALGORITHMS[key[1]]
+		if !known {
+			out.Logger.Println("Unsupported key algorithm in pairing request from " + model.MacToString(mac))
+			return
+		}
+		key = key[2:]
+	}
+	publicKey, err := model.ParsePublicKey(algorithm, key)
 	if err != nil {
+		out.Logger.Println("Error:", err)
 		return
 	}
 
+	state.mutex.Lock()
 	state.requested[mac] = request{
 		publicKey:          publicKey,
 		dataTypes:          dataTypes,
 		collectionCapacity: collectionCapacity,
+		protocolVersion:    protocolVersion,
 	}
+	state.mutex.Unlock()
 
 	go func() {
 		time.Sleep(30 * time.Second)
-		if _, exists := state.requested[mac]; exists && state.pairing != mac {
+		state.mutex.Lock()
+		_, exists := state.requested[mac]
+		timedOut := exists && state.pairing != mac
+		if timedOut {
 			delete(state.requested, mac)
+		}
+		state.mutex.Unlock()
+		if timedOut {
 			out.PairingLog("REQUEST-TIMEOUT:" + model.MacToString(mac))
 		}
 	}()
@@ -83,17 +150,25 @@ func pairRequest(value []byte) {
 
 // see protocol.md to understand what is going on here
 func pairConfirmation(value []byte) {
-	if len(value) != 295 || !state.active {
+	if len(value) < 39 {
+		return
+	}
+
+	mac := [6]byte(value[1:7])
+	state.mutex.Lock()
+	req, exists := state.requested[mac]
+	valid := state.active && exists && state.pairing == mac
+	state.mutex.Unlock()
+	if !valid || len(value) != 39+req.publicKey.SignatureSize() {
 		return
 	}
 
 	data := value[:39]
-	mac := [6]byte(data[1:7])
 	dataUuid := model.BytesToUuid([16]byte(data[7:23]))
 	settingsUuid := model.BytesToUuid([16]byte(data[23:39]))
-	signature := value[len(value)-256:]
+	signature := value[39:]
 
-	if _, exists := state.requested[mac]; !exists || state.pairing != mac || !model.VerifySignature(data, signature, state.requested[mac].publicKey) {
+	if !model.VerifySignature(data, signature, req.publicKey) {
 		return
 	}
 
@@ -105,31 +180,53 @@ func pairConfirmation(value []byte) {
 	if err != nil || settingsCharUUID != settingsUuid {
 		return
 	}
+
+	state.mutex.Lock()
+	if state.pairing != mac {
+		// timed out or canceled while the signature was being verified
+		state.mutex.Unlock()
+		return
+	}
 	state.pairing = [6]byte{}
-	pairResponseCharacteristic.Write([]byte{})
-	model.AddSensor(mac, state.requested[mac].dataTypes, state.requested[mac].collectionCapacity, state.requested[mac].publicKey, Sensors)
 	delete(state.requested, mac)
+	state.mutex.Unlock()
+
+	ble.Write(PAIR_RESPONSE_CHARACTERISTIC_UUID, []byte{})
+	profile := Profiles.GetDefault()
+	err = model.AddSensor(mac, req.dataTypes, req.collectionCapacity, req.publicKey, req.protocolVersion, &profile, Sensors)
+	if err != nil {
+		out.Logger.Println("Error:", err)
+	}
 
 	out.PairingLog("PAIR-SUCCESS:" + model.MacToString(mac))
 }
 
 // see protocol.md to understand what is going on here
 func Pair(mac [6]byte) {
+	state.mutex.Lock()
 	if !state.active {
+		state.mutex.Unlock()
 		out.PairingLog("PAIRING-DISABLED")
 		return
 	}
 
 	if _, exists := state.requested[mac]; !exists {
+		state.mutex.Unlock()
 		out.PairingLog("REQUEST-NOT-FOUND:" + model.MacToString(mac))
 		return
 	}
 
+	canceled := [6]byte{}
 	if state.pairing != [6]byte{} && state.pairing != mac {
-		out.PairingLog("PAIRING-CANCELED:" + model.MacToString(state.pairing))
-		delete(state.requested, mac)
+		canceled = state.pairing
+		delete(state.requested, canceled)
 	}
 	state.pairing = mac
+	req := state.requested[mac]
+	state.mutex.Unlock()
+	if canceled != [6]byte{} {
+		out.PairingLog("PAIRING-CANCELED:" + model.MacToString(canceled))
+	}
 
 	dataCharUUID, err := model.GetDataCharUUID(Gateway)
 	if err != nil {
@@ -143,15 +240,24 @@ func Pair(mac [6]byte) {
 	}
 	dataUuid := model.UuidToBytes(dataCharUUID)
 	settingsUuid := model.UuidToBytes(settingsCharUUID)
-	pairResponseCharacteristic.Write(append(append(append([]byte{0x01}, mac[:]...), dataUuid...), settingsUuid...))
+	response := append(append(append([]byte{0x01}, mac[:]...), dataUuid...), settingsUuid...)
+	if req.protocolVersion >= 2 {
+		response = append(response, req.protocolVersion)
+	}
+	ble.Write(PAIR_RESPONSE_CHARACTERISTIC_UUID, response)
 	out.PairingLog("PAIRING-WITH:" + model.MacToString(mac))
 
 	go func() {
 		time.Sleep(30 * time.Second)
-		if state.pairing == mac {
+		state.mutex.Lock()
+		timedOut := state.pairing == mac
+		if timedOut {
 			state.pairing = [6]byte{}
-			pairResponseCharacteristic.Write([]byte{})
 			delete(state.requested, mac)
+		}
+		state.mutex.Unlock()
+		if timedOut {
+			ble.Write(PAIR_RESPONSE_CHARACTERISTIC_UUID, []byte{})
 			out.PairingLog("PAIRING-TIMEOUT:" + model.MacToString(mac))
 		}
 	}()
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+)
+
+const CHUNK_HEADER_SIZE = 18         // 0x00 | mac address | message id | offset | length of message
+const MESSAGE_OVERHEAD = 4 + 1 + 9*3 // counter | battery level | 3 * (data type | sampling frequency | length of data) (+ signature)
+const INCOMPLETE_MESSAGE_TIMEOUT = 60 * time.Second
+
+// a sensor sends its messages one after the other, a new message beyond
+// these replaces the one it last sent a chunk of the longest ago
+const MAX_MESSAGES_PER_SENSOR = 2
+
+// the collection capacity is given by the sensor, the buffers of every
+// sensor together never take more memory than this
+const MAX_BUFFERED_BYTES = 64 * 1024 * 1024
+
+type chunk struct {
+	offset uint32
+	length uint32
+}
+
+type partialMessage struct {
+	data     []byte
+	chunks   []chunk
+	received uint32
+	updated  time.Time // last chunk
+	timer    *time.Timer
+}
+
+// messagesMutex protects messages and bufferedBytes
+var messagesMutex sync.Mutex
+var messages = map[[6]byte]map[uint32]*partialMessage{}
+var bufferedBytes int
+
+// see protocol.md to understand what is going on here
+func handleChunk(sensor *model.Sensor, value []byte) {
+	if len(value) <= CHUNK_HEADER_SIZE {
+		out.Logger.Println("Invalid data format received")
+		return
+	}
+
+	message, err := addChunk(sensor, value)
+	if err != nil {
+		out.Logger.Println("Error: "+model.MacToString(sensor.Mac)+":", err)
+		return
+	}
+	if message != nil {
+		handleData(sensor, message)
+	}
+}
+
+// addChunk stores the chunk in the reassembly buffer of the sensor and
+// returns the full message (0x00 | mac address | content) once every byte
+// of it has been received
+func addChunk(sensor *model.Sensor, value []byte) ([]byte, error) {
+	mac := sensor.Mac
+	messageId := uint32(value[7]) | uint32(value[8])<<8 | uint32(value[9])<<16
+	offset := binary.LittleEndian.Uint32(value[10:14])
+	length := binary.LittleEndian.Uint32(value[14:18])
+	content := value[CHUNK_HEADER_SIZE:]
+
+	if uint64(length) > uint64(sensor.CollectionCapacity)+MESSAGE_OVERHEAD+uint64(sensor.PublicKey.SignatureSize()) {
+		return nil, errors.New("message " + strconv.Itoa(int(messageId)) + " exceeds the collection capacity of the sensor")
+	}
+	if uint64(offset)+uint64(len(content)) > uint64(length) {
+		return nil, errors.New("chunk of message " + strconv.Itoa(int(messageId)) + " is out of bounds")
+	}
+
+	messagesMutex.Lock()
+	defer messagesMutex.Unlock()
+
+	if messages[mac] == nil {
+		messages[mac] = map[uint32]*partialMessage{}
+	}
+	msg, exists := messages[mac][messageId]
+	if exists && uint32(len(msg.data)) != length {
+		// the sensor reused the message id for a new message
+		dropMessage(mac, messageId)
+		exists = false
+	}
+	if !exists {
+		if len(messages[mac]) >= MAX_MESSAGES_PER_SENSOR {
+			var oldestId uint32
+			var oldest *partialMessage
+			for id, m := range messages[mac] {
+				if oldest == nil || m.updated.Before(oldest.updated) {
+					oldestId, oldest = id, m
+				}
+			}
+			dropMessage(mac, oldestId)
+			out.Logger.Println("Incomplete message " + strconv.Itoa(int(oldestId)) + " from " + model.MacToString(mac) + " replaced by message " + strconv.Itoa(int(messageId)))
+		}
+		if bufferedBytes+int(length) > MAX_BUFFERED_BYTES {
+			return nil, errors.New("message " + strconv.Itoa(int(messageId)) + " dropped, too many incomplete messages are buffered")
+		}
+
+		msg = &partialMessage{
+			data: make([]byte, length),
+		}
+		bufferedBytes += int(length)
+		msg.timer = time.AfterFunc(INCOMPLETE_MESSAGE_TIMEOUT, func() {
+			messagesMutex.Lock()
+			defer messagesMutex.Unlock()
+			if messages[mac][messageId] == msg {
+				dropMessage(mac, messageId)
+				out.Logger.Println("Incomplete message " + strconv.Itoa(int(messageId)) + " from " + model.MacToString(mac) + " expired")
+			}
+		})
+		messages[mac][messageId] = msg
+	} else {
+		msg.timer.Reset(INCOMPLETE_MESSAGE_TIMEOUT)
+	}
+	msg.updated = time.Now()
+
+	for _, c := range msg.chunks {
+		if c.offset == offset && c.length == uint32(len(content)) {
+			// duplicate, the bytes have already been received
+			return nil, nil
+		}
+		if offset < c.offset+c.length && c.offset < offset+uint32(len(content)) {
+			// the chunks do not split the message the same way, one of them
+			// is wrong
+			dropMessage(mac, messageId)
+			return nil, errors.New("chunk of message " + strconv.Itoa(int(messageId)) + " overlaps another one, message dropped")
+		}
+	}
+	copy(msg.data[offset:], content)
+	msg.chunks = append(msg.chunks, chunk{offset: offset, length: uint32(len(content))})
+	msg.received += uint32(len(content))
+
+	if msg.received < length {
+		return nil, nil
+	}
+
+	dropMessage(mac, messageId)
+	return append(append([]byte{0x00}, mac[:]...), msg.data...), nil
+}
+
+// messagesMutex must be held
+func dropMessage(mac [6]byte, messageId uint32) {
+	msg, exists := messages[mac][messageId]
+	if !exists {
+		return
+	}
+	msg.timer.Stop()
+	bufferedBytes -= len(msg.data)
+	delete(messages[mac], messageId)
+}
+
+// dropMessages discards the partial messages of a sensor
+func dropMessages(mac [6]byte) {
+	messagesMutex.Lock()
+	defer messagesMutex.Unlock()
+	for messageId := range messages[mac] {
+		dropMessage(mac, messageId)
+	}
+	delete(messages, mac)
+}
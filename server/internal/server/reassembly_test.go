@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+)
+
+func newChunk(mac [6]byte, messageId uint32, offset uint32, length uint32, content []byte) []byte {
+	value := append([]byte{0x00}, mac[:]...)
+	value = append(value, byte(messageId), byte(messageId>>8), byte(messageId>>16))
+	value = binary.LittleEndian.AppendUint32(value, offset)
+	value = binary.LittleEndian.AppendUint32(value, length)
+	return append(value, content...)
+}
+
+func newReassemblySensor(t *testing.T, index byte, collectionCapacity uint32) *model.Sensor {
+	t.Helper()
+	sensor := &model.Sensor{Mac: [6]byte{0x5E, 0, 0, 0, 0, index}, CollectionCapacity: collectionCapacity}
+	t.Cleanup(func() { dropMessages(sensor.Mac) })
+	return sensor
+}
+
+func getBufferedBytes() int {
+	messagesMutex.Lock()
+	defer messagesMutex.Unlock()
+	return bufferedBytes
+}
+
+func TestAddChunkOutOfOrderAndDuplicates(t *testing.T) {
+	sensor := newReassemblySensor(t, 1, 100)
+	message := []byte("0123456789")
+
+	for _, c := range [][2]uint32{{6, 10}, {0, 3}, {6, 10}, {0, 3}} {
+		res, err := addChunk(sensor, newChunk(sensor.Mac, 1, c[0], 10, message[c[0]:c[1]]))
+		if err != nil || res != nil {
+			t.Fatal("unexpected result for chunk", c, res, err)
+		}
+	}
+	res, err := addChunk(sensor, newChunk(sensor.Mac, 1, 3, 10, message[3:6]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, append(append([]byte{0x00}, sensor.Mac[:]...), message...)) {
+		t.Errorf("wrong message %q", res)
+	}
+	if getBufferedBytes() != 0 {
+		t.Errorf("%d bytes still buffered after the message was completed", getBufferedBytes())
+	}
+}
+
+func TestAddChunkOverlapDropsMessage(t *testing.T) {
+	sensor := newReassemblySensor(t, 2, 100)
+	message := []byte("0123456789")
+
+	_, err := addChunk(sensor, newChunk(sensor.Mac, 1, 0, 10, message[0:5]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = addChunk(sensor, newChunk(sensor.Mac, 1, 3, 10, message[3:8]))
+	if err == nil {
+		t.Fatal("an overlapping chunk was accepted")
+	}
+	// the message starts over
+	res, err := addChunk(sensor, newChunk(sensor.Mac, 1, 5, 10, message[5:10]))
+	if err != nil || res != nil {
+		t.Error("the message was completed with the chunks received before the overlap")
+	}
+}
+
+func TestAddChunkLimits(t *testing.T) {
+	sensor := newReassemblySensor(t, 3, 100)
+
+	_, err := addChunk(sensor, newChunk(sensor.Mac, 1, 0, 100+MESSAGE_OVERHEAD+1, []byte{0}))
+	if err == nil {
+		t.Error("a message exceeding the collection capacity was accepted")
+	}
+
+	// a new message replaces the oldest incomplete one
+	for id := uint32(1); id <= MAX_MESSAGES_PER_SENSOR+1; id++ {
+		_, err := addChunk(sensor, newChunk(sensor.Mac, id, 0, 10, []byte{0}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	messagesMutex.Lock()
+	_, oldestExists := messages[sensor.Mac][1]
+	count := len(messages[sensor.Mac])
+	messagesMutex.Unlock()
+	if oldestExists || count != MAX_MESSAGES_PER_SENSOR {
+		t.Errorf("expected the %d newest messages, got %d", MAX_MESSAGES_PER_SENSOR, count)
+	}
+	if getBufferedBytes() != 10*MAX_MESSAGES_PER_SENSOR {
+		t.Errorf("expected %d bytes buffered, got %d", 10*MAX_MESSAGES_PER_SENSOR, getBufferedBytes())
+	}
+
+	// sensors claiming a large collection capacity
+	large := uint32(MAX_BUFFERED_BYTES / 4)
+	accepted := 0
+	for i := byte(0); i < 8; i++ {
+		s := newReassemblySensor(t, 0x10+i, large)
+		_, err := addChunk(s, newChunk(s.Mac, 1, 0, large, []byte{0}))
+		if err == nil {
+			accepted++
+		}
+	}
+	if accepted != 3 {
+		t.Errorf("expected 3 large messages buffered, got %d", accepted)
+	}
+	if getBufferedBytes() > MAX_BUFFERED_BYTES {
+		t.Errorf("%d bytes buffered", getBufferedBytes())
+	}
+}
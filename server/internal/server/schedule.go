@@ -0,0 +1,253 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+)
+
+// The air is modelled as a timeline of reservations: a sensor is awake
+// (sampling, then sending) from each of its wake ups for getWakeUpDuration,
+// and its wake ups repeat every WakeUpInterval from its NextWakeUp. A sensor
+// asking for its settings is given the wake up closest to one interval from
+// now, within its max offset, during which fewer than Gateway.Sessions other
+// sensors are ever awake (the adapter serves that many sensors at the same
+// time). Its own reservations are ignored, so asking again (after a lost
+// response for example) gives the same wake up.
+
+// time the sensors take to transmit, on top of their sampling duration
+const WAKE_UP_DURATION_BASELINE = 30 * time.Second
+
+// the sensors are given their wake up in milliseconds
+const SCHEDULE_RESOLUTION = time.Millisecond
+
+type reservation struct {
+	mac   [6]byte
+	start time.Time
+	end   time.Time
+}
+
+func (r *reservation) overlaps(start time.Time, end time.Time) bool {
+	return r.start.Before(end) && start.Before(r.end)
+}
+
+// projectWakeUps returns the reservations of the sensors overlapping
+// [from, to), sorted by start
+func projectWakeUps(sensors []model.Sensor, from time.Time, to time.Time) []reservation {
+	reservations := []reservation{}
+	for i := range sensors {
+		s := &sensors[i]
+		interval := time.Duration(s.WakeUpInterval) * time.Second
+		// never scheduled
+		if interval <= 0 || s.NextWakeUp.IsZero() {
+			continue
+		}
+		duration := getWakeUpDuration(s)
+
+		start := s.NextWakeUp
+		// a sensor that missed its wake ups is assumed to still follow them
+		if missed := from.Sub(start.Add(duration)); missed > 0 {
+			start = start.Add(missed / interval * interval)
+		}
+		for ; start.Before(to); start = start.Add(interval) {
+			if start.Add(duration).After(from) {
+				reservations = append(reservations, reservation{mac: s.Mac, start: start, end: start.Add(duration)})
+			}
+		}
+	}
+
+	sort.Slice(reservations, func(i, j int) bool {
+		if !reservations[i].start.Equal(reservations[j].start) {
+			return reservations[i].start.Before(reservations[j].start)
+		}
+		return bytes.Compare(reservations[i].mac[:], reservations[j].mac[:]) < 0
+	})
+	return reservations
+}
+
+// sweep returns the most reservations awake at the same time within
+// [from, to) and for how long more than sessions of them are
+func sweep(reservations []reservation, from time.Time, to time.Time, sessions int) (int, time.Duration) {
+	type event struct {
+		at    time.Time
+		delta int
+	}
+	events := []event{}
+	for i := range reservations {
+		r := &reservations[i]
+		if r.overlaps(from, to) {
+			events = append(events, event{maxTime(r.start, from), 1}, event{minTime(r.end, to), -1})
+		}
+	}
+	// ends before starts, so touching reservations do not overlap
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].at.Equal(events[j].at) {
+			return events[i].at.Before(events[j].at)
+		}
+		return events[i].delta < events[j].delta
+	})
+
+	most := 0
+	var overCapacity time.Duration
+	awake := 0
+	for i, e := range events {
+		if awake > sessions {
+			overCapacity += e.at.Sub(events[i-1].at)
+		}
+		awake += e.delta
+		if awake > most {
+			most = awake
+		}
+	}
+	return most, overCapacity
+}
+
+// a wake up from start to end is free if another sensor can be awake during
+// all of it
+func isFree(reservations []reservation, start time.Time, end time.Time, sessions int) bool {
+	most, _ := sweep(reservations, start, end, sessions)
+	return most < sessions
+}
+
+// nextWakeUp finds the free wake up of the sensor closest to one interval
+// after now, the earliest one if two are as close. If no wake up within the
+// max offset is free, it returns the wake up after exactly one interval with
+// an error.
+func nextWakeUp(sensor *model.Sensor, sensors []model.Sensor, sessions int, now time.Time) (time.Time, error) {
+	now = now.Truncate(SCHEDULE_RESOLUTION)
+	duration := getWakeUpDuration(sensor)
+	maxOffset := time.Duration(sensor.WakeUpIntervalMaxOffset) * time.Second
+	center := now.Add(time.Duration(sensor.WakeUpInterval) * time.Second)
+	earliest := center.Add(-maxOffset)
+	latest := center.Add(maxOffset)
+
+	others := []model.Sensor{}
+	for _, s := range sensors {
+		if s.Mac != sensor.Mac {
+			others = append(others, s)
+		}
+	}
+	reservations := projectWakeUps(others, earliest, latest.Add(duration))
+
+	// the free wake ups form intervals, the one closest to the center is
+	// either the center or one of their bounds: right after a reservation,
+	// right before one or a bound of the max offset (how many sensors are
+	// awake during a wake up only changes when a reservation starts to or
+	// stops overlapping it)
+	candidates := []time.Time{center, earliest, latest}
+	for _, r := range reservations {
+		after := r.end.Truncate(SCHEDULE_RESOLUTION)
+		if after.Before(r.end) {
+			after = after.Add(SCHEDULE_RESOLUTION)
+		}
+		candidates = append(candidates, after, r.start.Add(-duration).Truncate(SCHEDULE_RESOLUTION))
+	}
+
+	found := false
+	var best time.Time
+	for _, c := range candidates {
+		if c.Before(earliest) || c.After(latest) || !isFree(reservations, c, c.Add(duration), sessions) {
+			continue
+		}
+		distance, bestDistance := absDuration(c.Sub(center)), absDuration(best.Sub(center))
+		if !found || distance < bestDistance || distance == bestDistance && c.Before(best) {
+			best = c
+			found = true
+		}
+	}
+	if !found {
+		return center, errors.New("no free wake up for sensor " + model.MacToString(sensor.Mac) + " within its max offset (" + strconv.Itoa(sensor.WakeUpIntervalMaxOffset) + " seconds), more than " + strconv.Itoa(sessions) + " sensors will be awake at the same time")
+	}
+	return best, nil
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func getWakeUpDuration(sensor *model.Sensor) time.Duration {
+	var maxSamplingDuration uint16 = 0
+	for _, setting := range sensor.Settings {
+		if setting.SamplingDuration > maxSamplingDuration {
+			maxSamplingDuration = setting.SamplingDuration
+		}
+	}
+	return time.Duration(maxSamplingDuration)*time.Second + WAKE_UP_DURATION_BASELINE
+}
+
+// the schedule is projected for at most a week
+const MAX_SCHEDULE_DURATION = 7 * 24 * time.Hour
+
+// GetSchedule projects the wake ups of every sensor from now until duration
+// from now
+func GetSchedule(duration time.Duration) (model.Schedule, error) {
+	if duration <= 0 || duration > MAX_SCHEDULE_DURATION {
+		return model.Schedule{}, errors.New("the schedule can be projected for 1 to " + strconv.Itoa(int(MAX_SCHEDULE_DURATION.Hours())) + " hours")
+	}
+	from := time.Now().Truncate(SCHEDULE_RESOLUTION)
+	to := from.Add(duration)
+	sensors := Sensors.List()
+	names := map[[6]byte]string{}
+	for _, s := range sensors {
+		names[s.Mac] = s.Name
+	}
+
+	scheduleMutex.Lock()
+	sessions := model.GetSessions(Gateway)
+	scheduleMutex.Unlock()
+
+	reservations := projectWakeUps(sensors, from, to)
+	schedule := model.Schedule{From: from, To: to, WakeUps: []model.WakeUp{}, Sessions: sessions}
+	var airTime, longest time.Duration
+	for _, r := range reservations {
+		schedule.WakeUps = append(schedule.WakeUps, model.WakeUp{Mac: r.mac, Name: names[r.mac], Start: r.start, End: r.end})
+		airTime += minTime(r.end, to).Sub(maxTime(r.start, from))
+		if r.end.Sub(r.start) > longest {
+			longest = r.end.Sub(r.start)
+		}
+	}
+	// sorted by start, so a reservation can only overlap the ones after it
+	// until one starts after its end
+	for i := range reservations {
+		j := i + 1
+		for ; j < len(reservations) && reservations[j].start.Before(reservations[i].end); j++ {
+			schedule.WakeUps[i].Overlaps = append(schedule.WakeUps[i].Overlaps, reservations[j].mac)
+			schedule.WakeUps[j].Overlaps = append(schedule.WakeUps[j].Overlaps, reservations[i].mac)
+		}
+		if len(schedule.WakeUps[i].Overlaps) >= sessions {
+			// the reservations overlapping this one start less than the
+			// longest wake up before it
+			k := i
+			for k > 0 && reservations[i].start.Sub(reservations[k-1].start) < longest {
+				k--
+			}
+			most, _ := sweep(reservations[k:j], reservations[i].start, reservations[i].end, sessions)
+			schedule.WakeUps[i].OverCapacity = most > sessions
+		}
+	}
+	_, overCapacity := sweep(reservations, from, to, sessions)
+	schedule.OverCapacity = overCapacity.Seconds()
+	schedule.Utilisation = float64(airTime) / float64(duration) / float64(sessions)
+	return schedule, nil
+}
+
+func minTime(a time.Time, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
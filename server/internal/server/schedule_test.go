@@ -0,0 +1,371 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+)
+
+// newTestFleet pairs the sensors with the given wake up intervals, max
+// offsets and audio sampling durations (seconds)
+func newTestFleet(t *testing.T, intervals []int, offsets []int, durations []int) []model.Sensor {
+	t.Helper()
+	model.SetConfigDir(t.TempDir())
+	t.Cleanup(func() { model.SetConfigDir("") })
+
+	registry := model.NewSensorRegistry(model.SENSORS_FILE)
+	for i := range intervals {
+		mac := [6]byte{0x5E, 0, 0, 0, byte(i >> 8), byte(i)}
+		err := model.AddSensor(mac, []string{"audio"}, 4000000000, &model.PublicKey{}, 2, nil, registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = model.UpdateSensorsSettings([][6]byte{mac}, [][2]string{
+			{"wake_up_interval", strconv.Itoa(intervals[i])},
+			{"wake_up_interval_max_offset", strconv.Itoa(offsets[i])},
+			{"audio_sampling_duration", strconv.Itoa(durations[i])},
+		}, registry, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return registry.List()
+}
+
+// simulateFleet runs the sensors for the given time: every sensor asks for
+// its settings when it goes back to sleep (after its wake up duration) and
+// is given its next wake up. check is called with every answer and returns
+// false to stop. It returns how many wake ups could not be scheduled
+// without exceeding the sessions.
+func simulateFleet(fleet []model.Sensor, sessions int, start time.Time, duration time.Duration, r *rand.Rand, check func(i int, now time.Time, next time.Time, err error) bool) int {
+	// the sensors are paired at random times over their first interval
+	asks := make([]time.Time, len(fleet))
+	for i := range fleet {
+		fleet[i].NextWakeUp = time.Time{}
+		asks[i] = start.Add(time.Duration(r.Int63n(int64(fleet[i].WakeUpInterval))) * time.Second)
+	}
+
+	failures := 0
+	for {
+		i := 0
+		for j := range asks {
+			if asks[j].Before(asks[i]) {
+				i = j
+			}
+		}
+		now := asks[i]
+		if now.After(start.Add(duration)) {
+			return failures
+		}
+		next, err := nextWakeUp(&fleet[i], fleet, sessions, now)
+		if err != nil {
+			failures++
+		}
+		if !check(i, now, next, err) {
+			return failures
+		}
+		fleet[i].NextWakeUp = next
+		asks[i] = next.Add(getWakeUpDuration(&fleet[i]))
+	}
+}
+
+func others(fleet []model.Sensor, i int) []model.Sensor {
+	o := append([]model.Sensor{}, fleet[:i]...)
+	return append(o, fleet[i+1:]...)
+}
+
+// random fleets (intervals of 10 minutes to a bit more than 2 hours),
+// checked on every wake up given by nextWakeUp
+func TestNextWakeUpProperties(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for seed := int64(1); seed <= 20; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		n := 5 + r.Intn(25)
+		intervals, offsets, durations := make([]int, n), make([]int, n), make([]int, n)
+		for i := 0; i < n; i++ {
+			intervals[i] = 600 + r.Intn(7200)
+			offsets[i] = r.Intn(intervals[i] / 3)
+			durations[i] = 1 + r.Intn(60)
+		}
+		fleet := newTestFleet(t, intervals, offsets, durations)
+		sessions := 1 + r.Intn(3)
+		name := "seed " + strconv.FormatInt(seed, 10) + " (" + strconv.Itoa(n) + " sensors, " + strconv.Itoa(sessions) + " sessions)"
+
+		simulateFleet(fleet, sessions, start, 12*time.Hour, r, func(i int, now time.Time, next time.Time, err error) bool {
+			s := &fleet[i]
+			center := now.Add(time.Duration(s.WakeUpInterval) * time.Second)
+			maxOffset := time.Duration(s.WakeUpIntervalMaxOffset) * time.Second
+			if absDuration(next.Sub(center)) > maxOffset {
+				t.Errorf("%s: wake up %v of %s is more than its max offset from %v", name, next, model.MacToString(s.Mac), center)
+				return false
+			}
+			if err == nil {
+				end := next.Add(getWakeUpDuration(s))
+				if !isFree(projectWakeUps(others(fleet, i), next, end), next, end, sessions) {
+					t.Errorf("%s: wake up %v of %s is not free", name, next, model.MacToString(s.Mac))
+					return false
+				}
+			} else if next != center {
+				t.Errorf("%s: a wake up that could not be scheduled is not after exactly one interval", name)
+				return false
+			}
+
+			// asking again (e.g. the response was lost) gives the same wake
+			// up, whether the first one was saved or not
+			saved := s.NextWakeUp
+			for _, previous := range []time.Time{saved, next} {
+				s.NextWakeUp = previous
+				again, _ := nextWakeUp(s, fleet, sessions, now)
+				if !again.Equal(next) {
+					t.Errorf("%s: asking again gave %v instead of %v", name, again, next)
+					return false
+				}
+			}
+			s.NextWakeUp = saved
+			return true
+		})
+	}
+}
+
+// the reservations of random fleets against the wake ups counted one by one
+func TestProjectWakeUpsProperties(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for seed := int64(1); seed <= 20; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		n := 1 + r.Intn(20)
+		intervals, offsets, durations := make([]int, n), make([]int, n), make([]int, n)
+		for i := 0; i < n; i++ {
+			intervals[i] = 600 + r.Intn(7200)
+			durations[i] = 1 + r.Intn(60)
+		}
+		fleet := newTestFleet(t, intervals, offsets, durations)
+		for i := range fleet {
+			// some sensors missed their wake ups long ago
+			fleet[i].NextWakeUp = start.Add(time.Duration(r.Int63n(int64(48*time.Hour))) - 24*time.Hour).Truncate(SCHEDULE_RESOLUTION)
+		}
+		from := start.Add(time.Duration(r.Int63n(int64(time.Hour))))
+		to := from.Add(time.Duration(1 + r.Int63n(int64(12*time.Hour))))
+		name := "seed " + strconv.FormatInt(seed, 10)
+
+		reservations := projectWakeUps(fleet, from, to)
+		for i := 1; i < len(reservations); i++ {
+			if reservations[i].start.Before(reservations[i-1].start) {
+				t.Errorf("%s: the reservations are not sorted by start", name)
+			}
+		}
+		for i := range fleet {
+			s := &fleet[i]
+			interval := time.Duration(s.WakeUpInterval) * time.Second
+			duration := getWakeUpDuration(s)
+			expected := 0
+			// the sensor only wakes up from its next wake up
+			for wakeUp := s.NextWakeUp; wakeUp.Before(to); wakeUp = wakeUp.Add(interval) {
+				if wakeUp.Add(duration).After(from) {
+					expected++
+				}
+			}
+			got := 0
+			for _, res := range reservations {
+				if res.mac != s.Mac {
+					continue
+				}
+				got++
+				if res.end.Sub(res.start) != duration || (res.start.Sub(s.NextWakeUp))%interval != 0 || !res.overlaps(from, to) {
+					t.Errorf("%s: reservation %v to %v is not a wake up of %s", name, res.start, res.end, model.MacToString(s.Mac))
+				}
+			}
+			if got != expected {
+				t.Errorf("%s: expected %d reservations for %s, got %d", name, expected, model.MacToString(s.Mac), got)
+			}
+		}
+
+		// sweep against the number of reservations at every point where it
+		// can change
+		for sessions := 1; sessions <= 3; sessions++ {
+			most, overCapacity := sweep(reservations, from, to, sessions)
+			points := []time.Time{from, to}
+			for _, res := range reservations {
+				points = append(points, maxTime(res.start, from), minTime(res.end, to))
+			}
+			sort.Slice(points, func(i, j int) bool { return points[i].Before(points[j]) })
+			expectedMost := 0
+			var expectedOverCapacity time.Duration
+			for p := 0; p+1 < len(points); p++ {
+				if !points[p].Before(points[p+1]) {
+					continue
+				}
+				awake := 0
+				for _, res := range reservations {
+					if res.overlaps(points[p], points[p+1]) {
+						awake++
+					}
+				}
+				if awake > expectedMost {
+					expectedMost = awake
+				}
+				if awake > sessions {
+					expectedOverCapacity += points[p+1].Sub(points[p])
+				}
+			}
+			if most != expectedMost || overCapacity != expectedOverCapacity {
+				t.Errorf("%s, %d sessions: expected %d awake at most and %v over capacity, got %d and %v", name, sessions, expectedMost, expectedOverCapacity, most, overCapacity)
+			}
+			if isFree(reservations, from, to, sessions) != (expectedMost < sessions) {
+				t.Errorf("%s, %d sessions: isFree does not match the sweep", name, sessions)
+			}
+		}
+	}
+}
+
+// 12 sensors awake 90 seconds every 10 minutes need 18 minutes of air time
+// per 10 minutes: one session cannot serve them, three can once every
+// sensor has been given its first wake up
+func TestSessionsIncreaseFleetCapacity(t *testing.T) {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	n := 12
+	intervals, offsets, durations := make([]int, n), make([]int, n), make([]int, n)
+	for i := 0; i < n; i++ {
+		intervals[i], offsets[i], durations[i] = 600, 120, 60
+	}
+	fleet := newTestFleet(t, intervals, offsets, durations)
+	if getWakeUpDuration(&fleet[0]) != 90*time.Second {
+		t.Fatal("expected wake ups of 90 seconds, got " + getWakeUpDuration(&fleet[0]).String())
+	}
+
+	for _, c := range []struct {
+		sessions int
+		fits     bool
+	}{{1, false}, {2, false}, {3, true}, {4, true}} {
+		failures := 0
+		simulateFleet(fleet, c.sessions, start, 24*time.Hour, rand.New(rand.NewSource(1)), func(i int, now time.Time, next time.Time, err error) bool {
+			// the sensors are paired at random over the first interval
+			if err != nil && now.After(start.Add(time.Hour)) {
+				failures++
+			}
+			return true
+		})
+		if c.fits && failures > 0 {
+			t.Errorf("%d sessions: %d wake ups could not be scheduled", c.sessions, failures)
+		}
+		if !c.fits && failures == 0 {
+			t.Errorf("%d sessions: every wake up was scheduled although the fleet needs more air time than the sessions have", c.sessions)
+		}
+	}
+}
+
+// wake ups of 30 seconds (no sampling), in seconds after start
+func newTestSchedule(t *testing.T, start time.Time) {
+	t.Helper()
+	newTestServer(t)
+	for i, s := range []struct {
+		name     string
+		offset   int
+		interval int
+	}{
+		{"a", 0, 86400},
+		{"b", 10, 86400},
+		{"c", 20, 86400},
+		{"d", 120, 86400},
+		{"e", 140, 86400},
+		// right after e, touching is not overlapping
+		{"f", 170, 86400},
+		// twice within the schedule
+		{"g", 1800, 3600},
+		// never scheduled
+		{"h", -1, 86400},
+	} {
+		sensor := model.Sensor{Mac: [6]byte{0x5E, 0, 0, 0, 3, byte(i)}, Name: s.name, WakeUpInterval: s.interval}
+		if s.offset >= 0 {
+			sensor.NextWakeUp = start.Add(time.Duration(s.offset) * time.Second)
+		}
+		err := Sensors.Add(sensor)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetSchedule(t *testing.T) {
+	start := time.Now().Add(time.Hour).Truncate(time.Second)
+	newTestSchedule(t, start)
+	if getWakeUpDuration(&model.Sensor{}) != 30*time.Second {
+		t.Fatal("expected wake ups of 30 seconds, got " + getWakeUpDuration(&model.Sensor{}).String())
+	}
+	names := map[[6]byte]string{}
+	for _, s := range Sensors.List() {
+		names[s.Mac] = s.Name
+	}
+
+	// 8 wake ups of 30 seconds over 3 hours
+	airTime := 8 * 30 / (3 * time.Hour).Seconds()
+	for _, c := range []struct {
+		sessions     int
+		overCapacity []string
+		seconds      float64
+	}{
+		// two of a, b and c from 10 to 40, d and e from 140 to 150
+		{1, []string{"a", "b", "c", "d", "e"}, 40},
+		// a, b and c from 20 to 30
+		{2, []string{"a", "b", "c"}, 10},
+		{3, []string{}, 0},
+	} {
+		err := model.SetGatewaySessions(Gateway, c.sessions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schedule, err := GetSchedule(3 * time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wakeUps := []string{}
+		overlaps := map[string][]string{}
+		overCapacity := []string{}
+		for _, w := range schedule.WakeUps {
+			wakeUps = append(wakeUps, w.Name)
+			if w.End.Sub(w.Start) != 30*time.Second {
+				t.Errorf("%d sessions: wake up of %s from %s to %s", c.sessions, w.Name, w.Start, w.End)
+			}
+			for _, mac := range w.Overlaps {
+				overlaps[w.Name] = append(overlaps[w.Name], names[mac])
+			}
+			if w.OverCapacity {
+				overCapacity = append(overCapacity, w.Name)
+			}
+		}
+		if strings.Join(wakeUps, ",") != "a,b,c,d,e,f,g,g" {
+			t.Errorf("%d sessions: expected the wake ups a,b,c,d,e,f,g,g, got %v", c.sessions, wakeUps)
+		}
+		expected := map[string][]string{"a": {"b", "c"}, "b": {"a", "c"}, "c": {"a", "b"}, "d": {"e"}, "e": {"d"}}
+		if len(overlaps) != len(expected) {
+			t.Errorf("%d sessions: expected the overlaps %v, got %v", c.sessions, expected, overlaps)
+		}
+		for name, macs := range expected {
+			if strings.Join(overlaps[name], ",") != strings.Join(macs, ",") {
+				t.Errorf("%d sessions: expected %s to overlap %v, got %v", c.sessions, name, macs, overlaps[name])
+			}
+		}
+		if strings.Join(overCapacity, ",") != strings.Join(c.overCapacity, ",") {
+			t.Errorf("%d sessions: expected %v over capacity, got %v", c.sessions, c.overCapacity, overCapacity)
+		}
+		if schedule.OverCapacity != c.seconds {
+			t.Errorf("%d sessions: expected %v seconds over capacity, got %v", c.sessions, c.seconds, schedule.OverCapacity)
+		}
+		if schedule.Sessions != c.sessions || math.Abs(schedule.Utilisation-airTime/float64(c.sessions)) > 1e-9 {
+			t.Errorf("%d sessions: expected a utilisation of %v, got %v", c.sessions, airTime/float64(c.sessions), schedule.Utilisation)
+		}
+	}
+
+	for _, duration := range []time.Duration{0, MAX_SCHEDULE_DURATION + time.Hour} {
+		_, err := GetSchedule(duration)
+		if err == nil {
+			t.Errorf("expected an error for a schedule of %s", duration)
+		}
+	}
+}
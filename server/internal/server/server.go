@@ -3,22 +3,19 @@ package server
 import (
 	"encoding/binary"
 	"encoding/json"
-	"errors"
-	"math"
 	"os"
 	"os/signal"
+	"strconv"
 	"time"
 
 	"github.com/jukuly/ss_machmos/server/internal/model"
 	"github.com/jukuly/ss_machmos/server/internal/out"
-	"tinygo.org/x/bluetooth"
+	"github.com/jukuly/ss_machmos/server/internal/transport"
 )
 
 const ISO8601 = "2006-01-02T15:04:05.999Z"
 const DEFAULT_GATEWAY_HTTP_ENDPOINT = "https://openphm.org/gateway_data"
 
-var adapter = bluetooth.DefaultAdapter
-
 var SERVICE_UUID = [4]uint32{0xA07498CA, 0xAD5B474E, 0x940D16F1, 0xFBE7E8CD}                      // same for every gateway fbe7e8cd-940d-16f1-ad5b-474ea07498ca
 var PAIR_REQUEST_CHARACTERISTIC_UUID = [4]uint32{0x37ecbcb9, 0xe2514c40, 0xa1613de1, 0x1ea8c363}  // same for every gateway 1ea8c363-a161-3de1-e251-4c4037ecbcb9
 var PAIR_RESPONSE_CHARACTERISTIC_UUID = [4]uint32{0x0598acc3, 0x8564405a, 0xaf67823f, 0x029c79b6} // same for every gateway 029c79b6-af67-823f-8564-405a0598acc3
@@ -30,97 +27,119 @@ var DATA_TYPES = map[byte]string{
 	0x03: "battery",
 }
 
-const UNSENT_DATA_PATH = "unsent_data/"
+const UNSENT_DATA_PATH = "unsent_data/" // in the temp directory, before the spool existed
+
+// how often the counters of the accepted and rejected messages are saved, the
+// replay protection does not depend on it (see model.CheckMessageCounter)
+const SENSORS_FLUSH_INTERVAL = time.Minute
+
+// how often the measurements older than the retention are deleted
+const STORE_PRUNE_INTERVAL = time.Hour
+
+// latest version of the protocol supported by the gateway (see protocol.md)
+const PROTOCOL_VERSION byte = 2
 
-var pairResponseCharacteristic bluetooth.Characteristic
-var settingsCharacteristic bluetooth.Characteristic
+var ble transport.Transport
+var settingsCharUUID [4]uint32
 var Gateway *model.Gateway
-var Sensors *[]model.Sensor
+var Sensors *model.SensorRegistry
+var Groups *model.GroupRegistry
+var Profiles *model.ProfileRegistry
 
-func Init(ss *[]model.Sensor, g *model.Gateway) error {
+func Init(ss *model.SensorRegistry, gs *model.GroupRegistry, ps *model.ProfileRegistry, g *model.Gateway, t transport.Transport) error {
 	Gateway = g
 	Sensors = ss
+	Groups = gs
+	Profiles = ps
+	ble = t
+
+	// a forgotten sensor must not complete a message it started
+	Sensors.Subscribe(func(event model.SensorEvent) {
+		if event.Type == model.SENSOR_REMOVED {
+			dropMessages(event.Mac)
+		}
+	})
 
-	err := adapter.Enable()
+	go func() {
+		for range time.Tick(SENSORS_FLUSH_INTERVAL) {
+			err := Sensors.Flush()
+			if err != nil {
+				out.Logger.Println("Error:", err)
+			}
+		}
+	}()
+
+	go func() {
+		pruneStore()
+		for range time.Tick(STORE_PRUNE_INTERVAL) {
+			pruneStore()
+		}
+	}()
+
+	err := ble.Enable()
 	if err != nil {
 		return err
 	}
 
-	state = pairingState{
-		active:    false,
-		requested: make(map[[6]byte]request),
-		pairing:   [6]byte{},
+	err = startUploader()
+	if err != nil {
+		return err
 	}
+
+	resetPairing()
+	return addService()
+}
+
+// the characteristics the sensors write to (see protocol.md)
+func addService() error {
 	dataCharUUID, err := model.GetDataCharUUID(Gateway)
 	if err != nil {
 		return err
 	}
-	settingsCharUUID, err := model.GetSettingsCharUUID(Gateway)
+	settingsCharUUID, err = model.GetSettingsCharUUID(Gateway)
 	if err != nil {
 		return err
 	}
 
-	service := bluetooth.Service{
-		UUID: SERVICE_UUID,
-		Characteristics: []bluetooth.CharacteristicConfig{
-			{
-				UUID:  dataCharUUID,
-				Flags: bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
-				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-					if len(value) > 0 && value[0] == 0x00 {
-						handleData(client, offset, value)
-					}
-				},
+	err = ble.AddService(SERVICE_UUID, []transport.Characteristic{
+		{
+			UUID: dataCharUUID,
+			WriteEvent: func(value []byte) {
+				if len(value) > 0 && value[0] == 0x00 {
+					receiveData(value)
+				}
 			},
-			{
-				Handle: &settingsCharacteristic,
-				UUID:   settingsCharUUID,
-				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
-				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-					if len(value) > 0 && value[0] == 0x00 {
-						sendSettings(value)
-					}
-				},
+		},
+		{
+			UUID: settingsCharUUID,
+			WriteEvent: func(value []byte) {
+				if len(value) > 0 && value[0] == 0x00 {
+					sendSettings(value)
+				}
 			},
-			{
-				UUID:  PAIR_REQUEST_CHARACTERISTIC_UUID,
-				Flags: bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
-				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-					if len(value) > 0 && value[0] == 0x00 {
-						pairRequest(value)
-					}
-				},
+		},
+		{
+			UUID: PAIR_REQUEST_CHARACTERISTIC_UUID,
+			WriteEvent: func(value []byte) {
+				if len(value) > 0 && value[0] == 0x00 {
+					pairRequest(value)
+				}
 			},
-			{
-				Handle: &pairResponseCharacteristic,
-				UUID:   PAIR_RESPONSE_CHARACTERISTIC_UUID,
-				Value:  []byte{},
-				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
-				WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-					if len(value) > 0 && value[0] == 0x00 {
-						pairConfirmation(value)
-					}
-				},
+		},
+		{
+			UUID: PAIR_RESPONSE_CHARACTERISTIC_UUID,
+			WriteEvent: func(value []byte) {
+				if len(value) > 0 && value[0] == 0x00 {
+					pairConfirmation(value)
+				}
 			},
 		},
-	}
-	err = adapter.AddService(&service)
-	if err != nil {
-		return err
-	}
-
-	adv := adapter.DefaultAdvertisement()
-	if adv == nil {
-		return errors.New("advertisement is nil")
-	}
-	err = adv.Configure(bluetooth.AdvertisementOptions{
-		LocalName:    "Gateway Server",
-		ServiceUUIDs: []bluetooth.UUID{service.UUID},
 	})
 	if err != nil {
 		return err
 	}
-	return nil
+
+	return ble.ConfigureAdvertisement("Gateway Server", [][4]uint32{SERVICE_UUID})
 }
 
 func StartAdvertising() error {
@@ -129,65 +148,116 @@ func StartAdvertising() error {
 	go func() {
 		for sig := range c {
 			if sig == os.Interrupt {
-				err := adapter.DefaultAdvertisement().Stop()
+				err := ble.StopAdvertising()
 				if err != nil {
 					out.Logger.Println("Error:", err)
 				}
+				flushSensors()
 				out.Logger.Println("Stopping server")
 				os.Exit(0)
 				return
 			}
 		}
 	}()
-	adv := adapter.DefaultAdvertisement()
-	if adv == nil {
-		return errors.New("advertisement is nil")
-	}
-	return adv.Start()
+	return ble.StartAdvertising()
 }
 
 func StopAdvertising() {
-	adapter.DefaultAdvertisement().Stop()
+	if ble != nil {
+		ble.StopAdvertising()
+	}
+	flushSensors()
 	out.Logger.Println("Stopping server")
 	os.Exit(0)
 }
 
-// see protocol.md to understand what is going on here
-func handleData(_ bluetooth.Connection, _ int, value []byte) {
+// saves the message counters before the server stops
+func flushSensors() {
+	if Sensors == nil {
+		return
+	}
+	err := Sensors.Flush()
+	if err != nil {
+		out.Logger.Println("Error:", err)
+	}
+}
 
-	if len(value) < 264 {
+// see protocol.md to understand what is going on here
+func receiveData(value []byte) {
+	if len(value) < 7 {
 		out.Logger.Println("Invalid data format received")
 		return
 	}
-	data := value[:len(value)-256]
-	signature := value[len(value)-256:]
-
-	macAddress := [6]byte(data[1:7])
-	var sensor *model.Sensor
-	for i, s := range *Sensors {
-		if s.Mac == macAddress {
-			sensor = &(*Sensors)[i]
-			break
-		}
-	}
-	if sensor == nil {
+
+	macAddress := [6]byte(value[1:7])
+	sensor, exists := Sensors.Get(macAddress)
+	if !exists {
 		out.Logger.Println("Device " + model.MacToString(macAddress) + " tried to send data, but it is not paired with this gateway")
 		return
 	}
 
+	// version 1 sensors send the whole message in a single write
+	if sensor.GetProtocolVersion() == 1 {
+		handleData(&sensor, value)
+	} else {
+		handleChunk(&sensor, value)
+	}
+}
+
+// see protocol.md to understand what is going on here
+// value is a complete message (every chunk has been received)
+func handleData(sensor *model.Sensor, value []byte) {
+	macAddress := sensor.Mac
+	version := sensor.GetProtocolVersion()
+
+	headerSize := 8 // 0x00 | mac address | battery level
+	if version >= 2 {
+		headerSize += 4 // counter
+	}
+	signatureSize := sensor.PublicKey.SignatureSize()
+	if len(value) < headerSize+signatureSize {
+		out.Logger.Println("Invalid data format received")
+		return
+	}
+	data := value[:len(value)-signatureSize]
+	signature := value[len(value)-signatureSize:]
+
 	if !model.VerifySignature(data, signature, &sensor.PublicKey) {
 		out.Logger.Println("Invalid signature received from " + model.MacToString(macAddress))
 		return
 	}
 
-	batteryLevel := int(int8(data[7]))
-	timestamp := time.Now().UTC().Format(ISO8601)
+	// reject replayed and stale messages
+	if version >= 2 {
+		counter := binary.LittleEndian.Uint32(data[7:11])
+		accepted, err := model.CheckMessageCounter(macAddress, counter, Sensors)
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return
+		}
+		if !accepted {
+			out.Logger.Println("Replayed or stale message (counter " + strconv.FormatUint(uint64(counter), 10) + ") received from " + model.MacToString(macAddress))
+			return
+		}
+	}
+
+	batteryLevel := int(int8(data[headerSize-1]))
+	now := time.Now().UTC()
+	timestamp := now.Format(ISO8601)
 
 	measurements := []map[string]interface{}{}
 
 	if batteryLevel != -1 {
 		out.Logger.Println("Received battery data from " + model.MacToString(macAddress) + " (" + sensor.Name + ")")
-		sensor.BatteryLevel = batteryLevel
+		// sent with every message, saved with the counters (see SENSORS_FLUSH_INTERVAL)
+		err := Sensors.UpdateInMemory(macAddress, func(s *model.Sensor) bool {
+			changed := s.BatteryLevel != batteryLevel
+			s.BatteryLevel = batteryLevel
+			return changed
+		})
+		if err != nil {
+			out.Logger.Println("Error:", err)
+		}
 		measurements = []map[string]interface{}{
 			{
 				"sensor_id":          model.MacToString(macAddress),
@@ -198,11 +268,17 @@ func handleData(_ bluetooth.Connection, _ int, value []byte) {
 			},
 		}
 	}
-	if len(data) > 16 {
-		measurementData := data[8:]
+	if len(data) > headerSize+8 {
+		measurementData := data[headerSize:]
 		var i uint32 = 0
 		for i <= uint32(len(measurementData))-9 {
 			dataType := DATA_TYPES[measurementData[i]]
+			compact := false
+			if version >= 2 {
+				// the most significant bit of the data type selects the compact encoding
+				compact = measurementData[i]&0x80 == 0x80
+				dataType = DATA_TYPES[measurementData[i]&0x7F]
+			}
 			samplingFrequency := binary.LittleEndian.Uint32(measurementData[i+1 : i+5])
 			lengthOfData := binary.LittleEndian.Uint32(measurementData[i+5 : i+9])
 			if i+9+lengthOfData > uint32(len(measurementData)) || lengthOfData == 0 {
@@ -213,12 +289,21 @@ func handleData(_ bluetooth.Connection, _ int, value []byte) {
 
 			out.Logger.Println("Received " + dataType + " data from " + model.MacToString(macAddress) + " (" + sensor.Name + ")")
 			if dataType == "vibration" {
-				numberOfMeasurements := len(rawData) / 12 // 3 axes, 4 bytes per axis => 12 bytes per measurement
-				x, y, z := make([]float32, numberOfMeasurements), make([]float32, numberOfMeasurements), make([]float32, numberOfMeasurements)
-				for i := 0; i < numberOfMeasurements; i++ {
-					x[i] = math.Float32frombits(binary.LittleEndian.Uint32(rawData[i*12 : 4+i*12]))
-					y[i] = math.Float32frombits(binary.LittleEndian.Uint32(rawData[4+i*12 : 8+i*12]))
-					z[i] = math.Float32frombits(binary.LittleEndian.Uint32(rawData[8+i*12 : 12+i*12]))
+				// the collection capacity of version 2 sensors is checked against the compact encoding
+				if version >= 2 && !compact {
+					out.Logger.Println("Invalid vibration data received (version 2 sensors must use the compact encoding)")
+					continue
+				}
+				var x, y, z []float32
+				if compact {
+					var err error
+					x, y, z, err = parseCompactVibrationData(rawData)
+					if err != nil {
+						out.Logger.Println("Error:", err)
+						continue
+					}
+				} else {
+					x, y, z = parseVibrationData(rawData)
 				}
 
 				measurements = append(measurements,
@@ -267,6 +352,28 @@ func handleData(_ bluetooth.Connection, _ int, value []byte) {
 						"raw_data":           temperature,
 					},
 				)
+			} else if dataType == "audio" {
+				if len(rawData)%3 != 0 {
+					out.Logger.Println("Invalid audio data received (" + strconv.Itoa(len(rawData)) + " bytes)")
+					continue
+				}
+				expected := uint64(samplingFrequency) * uint64(sensor.Settings["audio"].SamplingDuration)
+				if uint64(len(rawData)/3) != expected {
+					out.Logger.Println("Invalid audio data received (expected " + strconv.FormatUint(expected, 10) + " samples, got " + strconv.Itoa(len(rawData)/3) + ")")
+					continue
+				}
+				samples, normalized := parsePCM24Data(rawData)
+
+				measurements = append(measurements,
+					map[string]interface{}{
+						"sensor_id":          model.MacToString(macAddress),
+						"time":               timestamp,
+						"measurement_type":   dataType,
+						"sampling_frequency": samplingFrequency,
+						"raw_data":           normalized,
+						"pcm24":              samples,
+					},
+				)
 			} else {
 				measurements = append(measurements,
 					map[string]interface{}{
@@ -281,33 +388,17 @@ func handleData(_ bluetooth.Connection, _ int, value []byte) {
 		}
 	}
 
+	addSensorMetadata(measurements, sensor)
+	storeMeasurements(macAddress, now, measurements)
+
 	jsonData, err := json.Marshal(measurements)
 	if err != nil {
 		out.Logger.Println("Error:", err)
 		return
 	}
 
-	resp, err := sendMeasurements(jsonData, Gateway)
-
+	err = spoolMeasurements(jsonData)
 	if err != nil {
 		out.Logger.Println("Error:", err)
-		if err := saveUnsentMeasurements(jsonData, timestamp); err != nil {
-			out.Logger.Println("Error:", err)
-		}
-		return
-	}
-
-	if resp.StatusCode != 200 {
-		out.Logger.Println("Error sending data to server")
-		body := make([]byte, resp.ContentLength)
-		defer resp.Body.Close()
-		resp.Body.Read(body)
-		out.Logger.Println(string(body))
-		if err := saveUnsentMeasurements(jsonData, timestamp); err != nil {
-			out.Logger.Println(err)
-		}
-		return
 	}
-
-	sendUnsentMeasurements()
 }
@@ -0,0 +1,404 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/store"
+	"github.com/jukuly/ss_machmos/server/internal/transport"
+)
+
+const TEST_COLLECTION_CAPACITY = 1000000
+
+// a gateway on the in-memory transport, without the background tasks of Init
+func newTestServer(t *testing.T) *transport.Memory {
+	t.Helper()
+	model.SetConfigDir(t.TempDir())
+	Gateway = &model.Gateway{Id: "test"}
+	Sensors = model.NewSensorRegistry(model.SENSORS_FILE)
+	Groups = model.NewGroupRegistry(model.GROUPS_FILE)
+	Profiles = model.NewProfileRegistry(model.PROFILES_FILE)
+	memory := transport.NewMemory()
+	ble = memory
+	t.Cleanup(func() {
+		resetPairing()
+		ble = nil
+		Gateway = nil
+		Sensors = nil
+		Groups = nil
+		Profiles = nil
+		model.SetConfigDir("")
+	})
+
+	err := ble.Enable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetPairing()
+	err = addService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ble.StartAdvertising()
+	if err != nil {
+		t.Fatal(err)
+	}
+	EnablePairing()
+	return memory
+}
+
+// the side of the sensor, as described in protocol.md
+type testSensor struct {
+	mac      [6]byte
+	key      crypto.Signer
+	version  byte
+	dataChar [4]uint32
+}
+
+func newTestSensor(t *testing.T, index byte, version byte) *testSensor {
+	t.Helper()
+	sensor := &testSensor{mac: [6]byte{0x5E, 0, 0, 0, 1, index}, version: version}
+	var err error
+	if version == 1 {
+		sensor.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		_, sensor.key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dropMessages(sensor.mac) })
+	return sensor
+}
+
+func (s *testSensor) sign(t *testing.T, message []byte) []byte {
+	t.Helper()
+	var signature []byte
+	var err error
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		hash := sha256.Sum256(message)
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, message)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+// version 1 sensors send a PEM encoded RSA key right away
+func (s *testSensor) pairRequest(t *testing.T) []byte {
+	t.Helper()
+	request := append([]byte{0x00}, s.mac[:]...)
+	request = append(request, 0b00000111)
+	request = binary.LittleEndian.AppendUint32(request, TEST_COLLECTION_CAPACITY)
+	switch key := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(request, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...)
+	case ed25519.PublicKey:
+		return append(append(request, s.version, 0x01), key...)
+	}
+	t.Fatal("unsupported key")
+	return nil
+}
+
+// request, acceptance on the gateway and confirmation, returns the pairing response
+func (s *testSensor) pair(t *testing.T, memory *transport.Memory) []byte {
+	t.Helper()
+	err := memory.ClientWrite(PAIR_REQUEST_CHARACTERISTIC_UUID, s.pairRequest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Pair(s.mac)
+	res, err := memory.Read(PAIR_RESPONSE_CHARACTERISTIC_UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) < 39 || [6]byte(res[1:7]) != s.mac {
+		t.Fatalf("invalid pairing response %v", res)
+	}
+	s.dataChar = model.BytesToUuid([16]byte(res[7:23]))
+
+	confirmation := append([]byte{0x00}, s.mac[:]...)
+	confirmation = append(confirmation, res[7:39]...)
+	err = memory.ClientWrite(PAIR_RESPONSE_CHARACTERISTIC_UUID, append(confirmation, s.sign(t, confirmation)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Sensors.Contains(s.mac) {
+		t.Fatal("the sensor was not paired")
+	}
+	return res
+}
+
+// returns the settings response without its header
+func (s *testSensor) fetchSettings(t *testing.T, memory *transport.Memory) []byte {
+	t.Helper()
+	err := memory.ClientWrite(settingsCharUUID, append([]byte{0x00}, s.mac[:]...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := memory.Read(settingsCharUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) < 11 || res[0] != 0x01 || [6]byte(res[1:7]) != s.mac {
+		t.Fatalf("invalid settings response %v", res)
+	}
+	return res[7:]
+}
+
+// data is { data type | sampling frequency | length of data | data }
+func (s *testSensor) message(t *testing.T, counter uint32, batteryLevel int8, data []byte) []byte {
+	t.Helper()
+	message := append([]byte{0x00}, s.mac[:]...)
+	if s.version >= 2 {
+		message = binary.LittleEndian.AppendUint32(message, counter)
+	}
+	message = append(message, byte(batteryLevel))
+	message = append(message, data...)
+	return append(message, s.sign(t, message)...)
+}
+
+// a version 2 message in a single chunk
+func (s *testSensor) send(t *testing.T, memory *transport.Memory, messageId uint32, message []byte) {
+	t.Helper()
+	content := message[7:]
+	err := memory.ClientWrite(s.dataChar, newChunk(s.mac, messageId, 0, uint32(len(content)), content))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func compactVibration(samplingFrequency uint32, scale float32, samples ...int16) []byte {
+	data := binary.LittleEndian.AppendUint32(nil, math.Float32bits(scale))
+	for _, sample := range samples {
+		data = binary.LittleEndian.AppendUint16(data, uint16(sample))
+	}
+	entry := binary.LittleEndian.AppendUint32([]byte{0x00 | 0x80}, samplingFrequency)
+	entry = binary.LittleEndian.AppendUint32(entry, uint32(len(data)))
+	return append(entry, data...)
+}
+
+func queryStore(t *testing.T, mac [6]byte, dataType string) []store.Measurement {
+	t.Helper()
+	measurements, err := store.Query(mac, dataType, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return measurements
+}
+
+func TestPairFetchSettingsAndSendData(t *testing.T) {
+	memory := newTestServer(t)
+	s := newTestSensor(t, 1, PROTOCOL_VERSION)
+
+	res := s.pair(t, memory)
+	if len(res) != 40 || res[39] != PROTOCOL_VERSION {
+		t.Fatalf("expected protocol version %d in the pairing response, got %v", PROTOCOL_VERSION, res[39:])
+	}
+	sensor, _ := Sensors.Get(s.mac)
+	if sensor.GetProtocolVersion() != PROTOCOL_VERSION || sensor.PublicKey.Algorithm != model.KEY_ED25519 || sensor.CollectionCapacity != TEST_COLLECTION_CAPACITY {
+		t.Errorf("unexpected sensor version %d, key %s, capacity %d", sensor.GetProtocolVersion(), sensor.PublicKey.Algorithm, sensor.CollectionCapacity)
+	}
+
+	// wake up | counter | scale | { type | active | sampling frequency | sampling duration }
+	settings := s.fetchSettings(t, memory)
+	if len(settings) != 12+8*len(sensor.Settings) {
+		t.Fatalf("expected %d settings, got %d bytes", len(sensor.Settings), len(settings))
+	}
+	if counter := binary.LittleEndian.Uint32(settings[4:8]); counter != 0 {
+		t.Errorf("expected counter 0, got %d", counter)
+	}
+	if scale := math.Float32frombits(binary.LittleEndian.Uint32(settings[8:12])); scale != float32(model.DEFAULT_VIBRATION_SCALE) {
+		t.Errorf("expected scale %v, got %v", model.DEFAULT_VIBRATION_SCALE, scale)
+	}
+	for i := 12; i < len(settings); i += 8 {
+		dataType := DATA_TYPES[settings[i]]
+		expected := sensor.Settings[dataType]
+		if expected.Active != (settings[i+1] == 0x01) {
+			t.Errorf("%s: expected active %v", dataType, expected.Active)
+		}
+		if dataType != "temperature" && (binary.LittleEndian.Uint32(settings[i+2:i+6]) != expected.SamplingFrequency || binary.LittleEndian.Uint16(settings[i+6:i+8]) != expected.SamplingDuration) {
+			t.Errorf("%s: expected %d Hz for %d s", dataType, expected.SamplingFrequency, expected.SamplingDuration)
+		}
+	}
+
+	// the data is decoded with the scale of the frame
+	s.send(t, memory, 1, s.message(t, 1, 42, compactVibration(100, 0.5, 2, -4, 6, 1, 0, -1)))
+	vibration := queryStore(t, s.mac, "vibration")
+	if len(vibration) != 3 {
+		t.Fatalf("expected 3 axes of vibration, got %d", len(vibration))
+	}
+	expected := map[string][]float32{"x": {1, 0.5}, "y": {-2, 0}, "z": {3, -0.5}}
+	for _, m := range vibration {
+		if m.SamplingFrequency != 100 || len(m.Samples) != 2 || m.Samples[0] != expected[m.Axis][0] || m.Samples[1] != expected[m.Axis][1] {
+			t.Errorf("axis %s: expected %v at 100 Hz, got %v at %d Hz", m.Axis, expected[m.Axis], m.Samples, m.SamplingFrequency)
+		}
+	}
+	battery := queryStore(t, s.mac, "battery")
+	if len(battery) != 1 || battery[0].Samples[0] != 42 {
+		t.Errorf("expected a battery level of 42, got %v", battery)
+	}
+	sensor, _ = Sensors.Get(s.mac)
+	if sensor.BatteryLevel != 42 || sensor.MessageCounter != 1 {
+		t.Errorf("expected battery level 42 and counter 1, got %d and %d", sensor.BatteryLevel, sensor.MessageCounter)
+	}
+}
+
+func TestRejectedDataFrames(t *testing.T) {
+	memory := newTestServer(t)
+	s := newTestSensor(t, 1, PROTOCOL_VERSION)
+	s.pair(t, memory)
+
+	message := s.message(t, 5, -1, compactVibration(100, 0.5, 1, 2, 3))
+	s.send(t, memory, 1, message)
+	if len(queryStore(t, s.mac, "vibration")) != 3 {
+		t.Fatal("the first message was not accepted")
+	}
+
+	// the same message (a new message id does not help), an older counter,
+	// a bad signature and float32 vibration data from a version 2 sensor
+	tampered := s.message(t, 6, -1, compactVibration(100, 0.5, 1, 2, 3))
+	tampered[len(tampered)-1] ^= 0xFF
+	float32Vibration := binary.LittleEndian.AppendUint32([]byte{0x00}, 100)
+	float32Vibration = binary.LittleEndian.AppendUint32(float32Vibration, 12)
+	float32Vibration = append(float32Vibration, make([]byte, 12)...)
+	for i, m := range [][]byte{
+		message,
+		s.message(t, 4, -1, compactVibration(100, 0.5, 1, 2, 3)),
+		tampered,
+		s.message(t, 7, -1, float32Vibration),
+	} {
+		s.send(t, memory, uint32(2+i), m)
+	}
+	if n := len(queryStore(t, s.mac, "vibration")); n != 3 {
+		t.Errorf("expected only the first message to be stored, got %d measurements", n)
+	}
+	sensor, _ := Sensors.Get(s.mac)
+	if sensor.MessageCounter != 7 {
+		t.Errorf("expected counter 7, got %d", sensor.MessageCounter)
+	}
+}
+
+// sensors running the first firmware keep the version 1 formats
+func TestVersion1Sensor(t *testing.T) {
+	memory := newTestServer(t)
+	s := newTestSensor(t, 1, 1)
+
+	res := s.pair(t, memory)
+	if len(res) != 39 {
+		t.Errorf("expected a version 1 pairing response (39 bytes), got %d bytes", len(res))
+	}
+	sensor, _ := Sensors.Get(s.mac)
+	if sensor.GetProtocolVersion() != 1 || sensor.PublicKey.Algorithm != model.KEY_RSA {
+		t.Fatalf("expected a version 1 RSA sensor, got version %d and %s", sensor.GetProtocolVersion(), sensor.PublicKey.Algorithm)
+	}
+
+	// wake up | { type | active | sampling frequency | sampling duration }, without counter nor scale
+	settings := s.fetchSettings(t, memory)
+	if len(settings) != 4+8*len(sensor.Settings) {
+		t.Fatalf("expected %d version 1 settings, got %d bytes", len(sensor.Settings), len(settings))
+	}
+	for i := 4; i < len(settings); i += 8 {
+		if _, exists := sensor.Settings[DATA_TYPES[settings[i]]]; !exists {
+			t.Errorf("unexpected data type %d at byte %d", settings[i], i)
+		}
+	}
+
+	// the whole message in a single write, float32 vibration data
+	vibration := binary.LittleEndian.AppendUint32([]byte{0x00}, 10)
+	vibration = binary.LittleEndian.AppendUint32(vibration, 12)
+	for _, v := range []float32{0.25, -0.5, 1} {
+		vibration = binary.LittleEndian.AppendUint32(vibration, math.Float32bits(v))
+	}
+	err := memory.ClientWrite(s.dataChar, s.message(t, 0, 80, vibration))
+	if err != nil {
+		t.Fatal(err)
+	}
+	measurements := queryStore(t, s.mac, "vibration")
+	if len(measurements) != 3 {
+		t.Fatalf("expected 3 axes of vibration, got %d", len(measurements))
+	}
+	for _, m := range measurements {
+		expected := map[string]float32{"x": 0.25, "y": -0.5, "z": 1}[m.Axis]
+		if len(m.Samples) != 1 || m.Samples[0] != expected {
+			t.Errorf("axis %s: expected [%v], got %v", m.Axis, expected, m.Samples)
+		}
+	}
+}
+
+// the gateway answers with the lowest of the two versions and refuses the
+// requests it can't understand
+func TestPairingVersionNegotiation(t *testing.T) {
+	memory := newTestServer(t)
+
+	newer := newTestSensor(t, 1, PROTOCOL_VERSION+1)
+	res := newer.pair(t, memory)
+	sensor, _ := Sensors.Get(newer.mac)
+	if res[39] != PROTOCOL_VERSION || sensor.GetProtocolVersion() != PROTOCOL_VERSION {
+		t.Errorf("expected version %d, got %d in the response and %d for the sensor", PROTOCOL_VERSION, res[39], sensor.GetProtocolVersion())
+	}
+
+	for i, c := range []struct {
+		name    string
+		version byte
+		request func(request []byte) []byte
+	}{
+		// versioned requests start at version 2, version 1 sensors send a PEM key
+		{"version 0", 0, nil},
+		{"version 1 without PEM key", 1, nil},
+		{"unknown key algorithm", PROTOCOL_VERSION, func(request []byte) []byte {
+			request[13] = 0x7F
+			return request
+		}},
+		{"truncated key", PROTOCOL_VERSION, func(request []byte) []byte { return request[:20] }},
+		{"no key", PROTOCOL_VERSION, func(request []byte) []byte { return request[:14] }},
+	} {
+		s := newTestSensor(t, byte(2+i), c.version)
+		// a version 1 sensor would send a PEM encoded RSA key
+		_, s.key, _ = ed25519.GenerateKey(rand.Reader)
+		request := s.pairRequest(t)
+		if c.request != nil {
+			request = c.request(request)
+		}
+		err := memory.ClientWrite(PAIR_REQUEST_CHARACTERISTIC_UUID, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mac := range GetPairingRequests() {
+			if mac == model.MacToString(s.mac) {
+				t.Errorf("%s: the pairing request was accepted", c.name)
+			}
+		}
+	}
+
+	// a rejected sensor gets no settings (the characteristic keeps its request)
+	err := memory.ClientWrite(settingsCharUUID, []byte{0x00, 0x5E, 0, 0, 1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = memory.Read(settingsCharUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) == 0 || res[0] == 0x01 {
+		t.Errorf("settings were sent to an unknown sensor: %v", res)
+	}
+}
@@ -2,31 +2,62 @@ package server
 
 import (
 	"encoding/binary"
+	"math"
+	"sync"
 	"time"
 
 	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
 )
 
+// sensors asking for their settings at the same time must not be given the
+// same wake up time, nor a wake up scheduled with another number of sessions
+var scheduleMutex sync.Mutex
+
+func SetSessions(sessions int) error {
+	scheduleMutex.Lock()
+	defer scheduleMutex.Unlock()
+	return model.SetGatewaySessions(Gateway, sessions)
+}
+
 // see protocol.md to understand what is going on here
 func sendSettings(value []byte) {
 	if len(value) < 7 {
 		return
 	}
 	mac := [6]byte(value[1:7])
-	var sensor *model.Sensor
-	for i, s := range *Sensors {
-		if s.Mac == mac {
-			sensor = &(*Sensors)[i]
-			break
-		}
-	}
-	if sensor == nil {
+
+	scheduleMutex.Lock()
+	sensor, exists := Sensors.Get(mac)
+	if !exists {
+		scheduleMutex.Unlock()
 		return
 	}
+	now := time.Now().Truncate(SCHEDULE_RESOLUTION)
+	next, err := nextWakeUp(&sensor, Sensors.List(), model.GetSessions(Gateway), now)
+	if err != nil {
+		out.Logger.Println("Error:", err)
+	}
+	sensor.NextWakeUp = next
+	err = Sensors.Update(mac, func(s *model.Sensor) error {
+		s.NextWakeUp = next
+		return nil
+	})
+	scheduleMutex.Unlock()
+	if err != nil {
+		out.Logger.Println("Error:", err)
+	}
+	wakeUp := uint32(next.Sub(now).Milliseconds())
 
 	response := []byte{0x01}
 	response = append(response, mac[:]...)
-	response = binary.LittleEndian.AppendUint32(response, setNextWakeUp(sensor))
+	response = binary.LittleEndian.AppendUint32(response, wakeUp)
+	if sensor.GetProtocolVersion() >= 2 {
+		// lets the sensor resume its counter if it lost it (after a reset for example)
+		response = binary.LittleEndian.AppendUint32(response, sensor.MessageCounter)
+		// the sensor sends it back with the compact vibration data it samples
+		response = binary.LittleEndian.AppendUint32(response, math.Float32bits(float32(sensor.GetVibrationScale())))
+	}
 
 	for dataType, settings := range sensor.Settings {
 		var active byte
@@ -49,100 +80,5 @@ func sendSettings(value []byte) {
 		}
 	}
 
-	settingsCharacteristic.Write(response)
-}
-
-func setNextWakeUp(sensor *model.Sensor) uint32 {
-	maxOffset := time.Duration(sensor.WakeUpIntervalMaxOffset) * time.Second
-
-	wakeUpDurationThis := getWakeUpDuration(sensor)
-	nextWakeUpCenter := time.Now().Add(time.Duration(sensor.WakeUpInterval) * time.Second)
-
-	// going backward
-	nextWakeUpLow := nextWakeUpCenter
-	var offsetLow time.Duration
-	i := 0
-	for i < len(*Sensors) {
-		s := (*Sensors)[i]
-		i++
-		wakeUpDurationOther := getWakeUpDuration(&s)
-
-		j := 0
-		for {
-			difference := s.NextWakeUp.Add(time.Duration(j) * time.Duration(s.WakeUpInterval) * time.Second).Sub(nextWakeUpLow)
-			j++
-
-			if difference > wakeUpDurationThis {
-				break
-			}
-
-			// if conflict
-			if difference >= 0 && difference < wakeUpDurationThis || difference < 0 && -difference < wakeUpDurationOther {
-				nextWakeUpLow = nextWakeUpLow.Add(difference - wakeUpDurationThis)
-				i = 0
-				break
-			}
-		}
-
-		if nextWakeUpCenter.Sub(nextWakeUpLow) > maxOffset {
-			offsetLow = time.Duration(-1)
-			break
-		}
-	}
-	offsetLow = nextWakeUpCenter.Sub(nextWakeUpLow)
-
-	// going forward
-	nextWakeUpHigh := nextWakeUpCenter
-	var offsetHigh time.Duration
-	i = 0
-	for i < len(*Sensors) {
-		s := (*Sensors)[i]
-		i++
-		wakeUpDurationOther := getWakeUpDuration(&s)
-
-		j := 0
-		for {
-			difference := s.NextWakeUp.Add(time.Duration(j) * time.Duration(s.WakeUpInterval) * time.Second).Sub(nextWakeUpHigh)
-			j++
-
-			if difference > wakeUpDurationThis || nextWakeUpHigh.Sub(nextWakeUpCenter) > maxOffset {
-				break
-			}
-
-			// if conflict
-			if difference >= 0 && difference < wakeUpDurationThis || difference < 0 && -difference < wakeUpDurationOther {
-				nextWakeUpHigh = nextWakeUpHigh.Add(difference + wakeUpDurationOther)
-				i = 0
-			}
-		}
-
-		if nextWakeUpHigh.Sub(nextWakeUpCenter) > maxOffset {
-			offsetHigh = time.Duration(-1)
-			break
-		}
-	}
-	offsetHigh = nextWakeUpHigh.Sub(nextWakeUpCenter)
-
-	if (offsetHigh >= offsetLow || offsetHigh == time.Duration(-1)) && offsetLow != time.Duration(-1) {
-		sensor.NextWakeUp = nextWakeUpLow
-		return uint32(sensor.WakeUpInterval)*1000 - uint32(offsetLow.Milliseconds())
-	} else if offsetHigh != time.Duration(-1) {
-		sensor.NextWakeUp = nextWakeUpHigh
-		return uint32(sensor.WakeUpInterval)*1000 + uint32(offsetHigh.Milliseconds())
-	} else {
-		sensor.NextWakeUp = nextWakeUpCenter
-		return uint32(sensor.WakeUpInterval) * 1000
-	}
-}
-
-func getWakeUpDuration(sensor *model.Sensor) time.Duration {
-	WAKE_UP_DURATION_BASELINE := time.Second * 30 // baseline to account for transmission time
-
-	var maxSamplingDuration uint16 = 0
-	for _, setting := range sensor.Settings {
-		if setting.SamplingDuration > maxSamplingDuration {
-			maxSamplingDuration = setting.SamplingDuration
-		}
-	}
-	return time.Duration(maxSamplingDuration)*time.Second + WAKE_UP_DURATION_BASELINE
+	ble.Write(settingsCharUUID, response)
 }
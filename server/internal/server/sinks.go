@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/mqtt"
+)
+
+// the measurements written to disk (file sink and spool) are only readable
+// by the user running the server
+const DATA_DIR_MODE = 0700
+const DATA_FILE_MODE = 0600
+
+// a sink is where the measurements end up (see the Sinks setting of the gateway)
+type sink interface {
+	send(jsonData []byte) error
+}
+
+type openphmSink struct {
+	config  model.Sink
+	gateway *model.Gateway
+}
+
+type httpSink struct {
+	config    model.Sink
+	gatewayId string
+}
+
+type mqttSink struct {
+	config    model.Sink
+	gatewayId string
+}
+
+type influxSink struct {
+	config    model.Sink
+	gatewayId string
+}
+
+type fileSink struct {
+	config    model.Sink
+	gatewayId string
+}
+
+func getSink(config model.Sink, gateway *model.Gateway) (sink, error) {
+	gatewayId, _ := model.GetGatewayCredentials(gateway)
+	switch config.Type {
+	case "openphm":
+		return openphmSink{config: config, gateway: gateway}, nil
+	case "http":
+		return httpSink{config: config, gatewayId: gatewayId}, nil
+	case "mqtt":
+		return mqttSink{config: config, gatewayId: gatewayId}, nil
+	case "influx":
+		return influxSink{config: config, gatewayId: gatewayId}, nil
+	case "file":
+		return fileSink{config: config, gatewayId: gatewayId}, nil
+	}
+	return nil, errors.New("unknown sink type " + config.Type)
+}
+
+// the sink rejected the batch itself, sending it again will not help
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func isPermanent(err error) bool {
+	return errors.As(err, &permanentError{})
+}
+
+// a batch that can't be decoded never will be, whatever the sink
+func decodeBatch(jsonData []byte) ([]map[string]interface{}, error) {
+	measurements := []map[string]interface{}{}
+	err := json.Unmarshal(jsonData, &measurements)
+	if err != nil {
+		return nil, permanentError{errors.New("invalid batch of measurements: " + err.Error())}
+	}
+	return measurements, nil
+}
+
+// a 4xx response rejects the batch, except when the sink is not ready for it
+// (timeout, rate limiting) or the gateway is not allowed to send (the
+// credentials can be fixed)
+func statusError(resp *http.Response, message string) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err := errors.New(message + " (" + resp.Status + "): " + string(body))
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return err
+	}
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return permanentError{err}
+	}
+	return err
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return statusError(resp, "error sending data to server")
+	}
+	return nil
+}
+
+func (s openphmSink) send(jsonData []byte) error {
+	resp, err := sendMeasurements(jsonData, s.config.URL, s.gateway)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return checkResponse(resp)
+	}
+	return nil
+}
+
+// same body as openPHM without the gateway password
+func (s httpSink) send(jsonData []byte) error {
+	data, err := json.Marshal(struct {
+		GatewayId    string          `json:"gateway_id"`
+		Measurements json.RawMessage `json:"measurements"`
+	}{s.gatewayId, jsonData})
+	if err != nil {
+		return permanentError{errors.New("invalid batch of measurements: " + err.Error())}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.config.URL, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.config.Token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// every measurement is published on its own topic
+func (s mqttSink) send(jsonData []byte) error {
+	measurements, err := decodeBatch(jsonData)
+	if err != nil {
+		return err
+	}
+
+	client, err := mqtt.Connect(mqtt.Options{
+		Broker:   s.config.URL,
+		ClientId: "ssmachmos-" + s.gatewayId + "-" + s.config.Name,
+		Username: s.config.Username,
+		Password: s.config.Password,
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	topic := s.config.Topic
+	if topic == "" {
+		topic = model.DEFAULT_MQTT_TOPIC
+	}
+	for _, m := range measurements {
+		m["gateway_id"] = s.gatewayId
+		payload, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		sensorId, _ := m["sensor_id"].(string)
+		measurementType, _ := m["measurement_type"].(string)
+		t := strings.NewReplacer("{gateway}", s.gatewayId, "{sensor}", sensorId, "{type}", measurementType).Replace(topic)
+		err = client.Publish(t, payload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// one measurement per line in <directory>/<yyyy-mm-dd>.jsonl
+func (s fileSink) send(jsonData []byte) error {
+	measurements, err := decodeBatch(jsonData)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(s.config.URL, DATA_DIR_MODE)
+	if err != nil {
+		return err
+	}
+	lines := []byte{}
+	for _, m := range measurements {
+		m["gateway_id"] = s.gatewayId
+		line, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	file, err := os.OpenFile(path.Join(s.config.URL, time.Now().UTC().Format("2006-01-02")+".jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, DATA_FILE_MODE)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(lines)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
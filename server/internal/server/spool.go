@@ -0,0 +1,497 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+)
+
+// Every sink has its own upload queue in spool/<sink name>, one file per
+// batch named <time in ns>-<uuid>.json so that they sort in the order they
+// were received. A goroutine per sink uploads them in that order, so a sink
+// that is down never blocks (or duplicates delivery to) the others. The
+// batches a sink rejects (see permanentError) are moved to
+// spool/<sink name>/failed to be looked at by hand.
+
+const SPOOL_PATH = "spool"
+const MAX_SPOOL_SIZE = 512 * 1024 * 1024 // bytes, per sink
+const MAX_SPOOL_AGE = 30 * 24 * time.Hour
+const MIN_RETRY_DELAY = time.Second
+const MAX_RETRY_DELAY = 10 * time.Minute
+
+// Batches, Bytes and Oldest of the status are kept up to date by the writes
+// and the uploads, and counted again from the files whenever they are listed
+type uploadQueue struct {
+	name   string
+	dir    string
+	status model.SpoolStatus
+	notify chan bool
+	stop   chan bool
+	done   chan bool // closed when run returns
+}
+
+// spoolMutex protects the queues and their files, the sinks of the gateway
+// only change with it held so that every sink has a queue
+var spoolMutex sync.Mutex
+var queues = map[string]*uploadQueue{}
+
+// sinksMutex is held while the sinks change, a removed sink is only deleted
+// once its queue has stopped so that a new sink with the same name never
+// shares its directory with it
+var sinksMutex sync.Mutex
+var uploaderStarted = false
+
+func getSpoolDir() (string, error) {
+	configPath, err := model.GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir := path.Join(configPath, SPOOL_PATH)
+	return dir, os.MkdirAll(dir, DATA_DIR_MODE)
+}
+
+type spoolFile struct {
+	name     string
+	size     int64
+	received time.Time
+}
+
+// sorted from the oldest to the newest
+func listSpool(dir string) ([]spoolFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []spoolFile{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		file := spoolFile{name: entry.Name(), size: info.Size(), received: info.ModTime()}
+		if ns, err := strconv.ParseInt(strings.SplitN(entry.Name(), "-", 2)[0], 10, 64); err == nil {
+			file.received = time.Unix(0, ns)
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, nil
+}
+
+// spoolMeasurements queues a batch of measurements (JSON array) for upload
+// to every sink
+func spoolMeasurements(data []byte) error {
+	name := fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), uuid.New().String())
+
+	spoolMutex.Lock()
+	defer spoolMutex.Unlock()
+	var errs []error
+	for _, q := range queues {
+		err := writeSpoolFile(q.dir, name, data)
+		if err == nil {
+			if q.status.Batches == 0 {
+				q.status.Oldest = time.Now()
+			}
+			q.status.Batches++
+			q.status.Bytes += int64(len(data))
+			err = enforceSpoolLimits(q)
+		}
+		if err != nil {
+			errs = append(errs, errors.New(q.name+": "+err.Error()))
+			continue
+		}
+
+		select {
+		case q.notify <- true:
+		default:
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// written under another name first so the uploader never reads a partial file
+func writeSpoolFile(dir string, name string, data []byte) error {
+	err := os.WriteFile(path.Join(dir, name+".tmp"), data, DATA_FILE_MODE)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path.Join(dir, name+".tmp"), path.Join(dir, name))
+}
+
+// spoolMutex must be held
+func (q *uploadQueue) count(files []spoolFile) {
+	q.status.Batches = len(files)
+	q.status.Bytes = 0
+	for _, f := range files {
+		q.status.Bytes += f.size
+	}
+	q.status.Oldest = time.Time{}
+	if len(files) > 0 {
+		q.status.Oldest = files[0].received
+	}
+}
+
+// evicts the batches older than MAX_SPOOL_AGE, then the oldest ones until
+// the spool is smaller than MAX_SPOOL_SIZE. The files are only listed when
+// the counts of the queue exceed a limit.
+func enforceSpoolLimits(q *uploadQueue) error {
+	if q.status.Bytes <= MAX_SPOOL_SIZE && (q.status.Batches == 0 || time.Since(q.status.Oldest) <= MAX_SPOOL_AGE) {
+		return nil
+	}
+	files, err := listSpool(q.dir)
+	if err != nil {
+		return err
+	}
+	defer func() { q.count(files) }()
+	var size int64
+	for _, f := range files {
+		size += f.size
+	}
+
+	evicted := 0
+	for len(files) > 1 && (size > MAX_SPOOL_SIZE || time.Since(files[0].received) > MAX_SPOOL_AGE) {
+		err = os.Remove(path.Join(q.dir, files[0].name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		size -= files[0].size
+		files = files[1:]
+		evicted++
+	}
+	if evicted > 0 {
+		q.status.Evicted += evicted
+		out.Logger.Println("Upload queue of sink " + q.name + " is full, " + strconv.Itoa(evicted) + " batches of measurements evicted")
+	}
+	return nil
+}
+
+// imports what older versions of the gateway saved in the temp directory
+func importUnsentMeasurements(dir string) {
+	oldDir := path.Join(os.TempDir(), "ss_machmos", UNSENT_DATA_PATH)
+	files, err := os.ReadDir(oldDir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(path.Join(oldDir, file.Name()))
+		if err != nil {
+			continue
+		}
+		received := time.Now()
+		if t, err := time.Parse(ISO8601, strings.TrimSuffix(file.Name(), ".json")); err == nil {
+			received = t
+		}
+		name := fmt.Sprintf("%020d-%s.json", received.UnixNano(), uuid.New().String())
+		if os.WriteFile(path.Join(dir, name), data, DATA_FILE_MODE) == nil {
+			os.Remove(path.Join(oldDir, file.Name()))
+		}
+	}
+}
+
+func retryDelay(failures int) time.Duration {
+	delay := MIN_RETRY_DELAY
+	for i := 1; i < failures && delay < MAX_RETRY_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > MAX_RETRY_DELAY {
+		delay = MAX_RETRY_DELAY
+	}
+	// jitter so that gateways don't all retry at the same time
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// moves the batches spooled before the gateway had multiple sinks to the
+// queue of every sink
+func migrateSpool(dir string) {
+	files, err := listSpool(dir)
+	if err != nil || len(files) == 0 || len(queues) == 0 {
+		return
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(path.Join(dir, file.name))
+		if err != nil {
+			continue
+		}
+		ok := true
+		for _, q := range queues {
+			ok = writeSpoolFile(q.dir, file.name, data) == nil && ok
+		}
+		if ok {
+			os.Remove(path.Join(dir, file.name))
+		}
+	}
+}
+
+func uploadSpooledFile(q *uploadQueue, data []byte) error {
+	var config *model.Sink
+	for _, s := range model.GetGatewaySinks(Gateway) {
+		if s.Name == q.name {
+			config = &s
+			break
+		}
+	}
+	if config == nil {
+		return errors.New("sink " + q.name + " not found")
+	}
+
+	sink, err := getSink(*config, Gateway)
+	if err != nil {
+		return err
+	}
+	return sink.send(data)
+}
+
+// startUploader uploads the spooled measurements of every sink in order in
+// the background
+func startUploader() error {
+	dir, err := getSpoolDir()
+	if err != nil {
+		return err
+	}
+	if uploaderStarted {
+		return nil
+	}
+	uploaderStarted = true
+	importUnsentMeasurements(dir)
+
+	spoolMutex.Lock()
+	defer spoolMutex.Unlock()
+	// new gateways send their measurements to openPHM
+	model.SetDefaultGatewaySinks(Gateway, []model.Sink{{Name: "openphm", Type: "openphm", URL: DEFAULT_GATEWAY_HTTP_ENDPOINT}})
+	for _, s := range model.GetGatewaySinks(Gateway) {
+		err = startQueue(dir, s.Name)
+		if err != nil {
+			return err
+		}
+	}
+	migrateSpool(dir)
+	return nil
+}
+
+// spoolMutex must be held
+func startQueue(dir string, name string) error {
+	q := &uploadQueue{
+		name:   name,
+		dir:    path.Join(dir, name),
+		notify: make(chan bool, 1),
+		stop:   make(chan bool),
+		done:   make(chan bool),
+	}
+	err := os.MkdirAll(q.dir, DATA_DIR_MODE)
+	if err != nil {
+		return err
+	}
+	files, err := listSpool(q.dir)
+	if err != nil {
+		return err
+	}
+	q.count(files)
+	if failed, err := os.ReadDir(path.Join(q.dir, model.DEAD_LETTER_PATH)); err == nil {
+		q.status.Failed = len(failed)
+	}
+	queues[name] = q
+	go q.run()
+	return nil
+}
+
+// uploads the batches in order, retrying with exponential backoff when the
+// upload fails. The queue is listed once per pass, the batches spooled
+// meanwhile are uploaded by the next pass.
+func (q *uploadQueue) run() {
+	defer close(q.done)
+	failures := 0
+	for {
+		spoolMutex.Lock()
+		files, err := listSpool(q.dir)
+		if err != nil {
+			out.Logger.Println("Error:", err)
+		} else {
+			q.count(files)
+		}
+		spoolMutex.Unlock()
+		if len(files) == 0 {
+			select {
+			case <-q.notify:
+				continue
+			case <-q.stop:
+				return
+			}
+		}
+
+		for len(files) > 0 {
+			data, err := os.ReadFile(path.Join(q.dir, files[0].name))
+			if errors.Is(err, os.ErrNotExist) {
+				// evicted since the listing
+				files = files[1:]
+				continue
+			}
+			if err == nil {
+				err = uploadSpooledFile(q, data)
+			}
+			if isPermanent(err) {
+				out.Logger.Println("Error: sink "+q.name+" rejected batch "+files[0].name+", moved to "+model.DEAD_LETTER_PATH+":", err)
+				spoolMutex.Lock()
+				err = q.deadLetter(files[0])
+				if err == nil {
+					q.status.Failed++
+					q.removed(files)
+				}
+				spoolMutex.Unlock()
+				if err == nil {
+					files = files[1:]
+					continue
+				}
+			}
+			if err != nil {
+				failures++
+				delay := retryDelay(failures)
+				out.Logger.Println("Error: sink "+q.name+":", err)
+				spoolMutex.Lock()
+				q.status.LastError = err.Error()
+				q.status.NextRetry = time.Now().Add(delay)
+				spoolMutex.Unlock()
+				select {
+				case <-time.After(delay):
+					continue
+				case <-q.stop:
+					return
+				}
+			}
+
+			failures = 0
+			spoolMutex.Lock()
+			if os.Remove(path.Join(q.dir, files[0].name)) == nil {
+				q.removed(files)
+			}
+			q.status.LastError = ""
+			q.status.NextRetry = time.Time{}
+			spoolMutex.Unlock()
+			files = files[1:]
+
+			select {
+			case <-q.stop:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// spoolMutex must be held
+func (q *uploadQueue) deadLetter(file spoolFile) error {
+	dir := path.Join(q.dir, model.DEAD_LETTER_PATH)
+	err := os.MkdirAll(dir, DATA_DIR_MODE)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path.Join(q.dir, file.name), path.Join(dir, file.name))
+}
+
+// the first of the listed files left the queue, spoolMutex must be held
+func (q *uploadQueue) removed(files []spoolFile) {
+	q.status.Batches--
+	q.status.Bytes -= files[0].size
+	if q.status.Batches <= 0 {
+		q.count(nil)
+	} else if len(files) > 1 {
+		q.status.Oldest = files[1].received
+	}
+	// else the batches were written after the listing, the oldest time stays
+	// older than them until the next listing
+}
+
+func AddSink(sink model.Sink) error {
+	dir, err := getSpoolDir()
+	if err != nil {
+		return err
+	}
+
+	sinksMutex.Lock()
+	defer sinksMutex.Unlock()
+	spoolMutex.Lock()
+	defer spoolMutex.Unlock()
+	err = model.AddGatewaySink(Gateway, sink)
+	if err != nil {
+		return err
+	}
+	if !uploaderStarted {
+		return nil
+	}
+	return startQueue(dir, sink.Name)
+}
+
+// the measurements waiting to be sent to the sink (and the ones it rejected)
+// are deleted
+func RemoveSink(name string) error {
+	sinksMutex.Lock()
+	defer sinksMutex.Unlock()
+	spoolMutex.Lock()
+	err := model.RemoveGatewaySink(Gateway, name)
+	if err != nil {
+		spoolMutex.Unlock()
+		return err
+	}
+	q, exists := queues[name]
+	if !exists {
+		spoolMutex.Unlock()
+		return nil
+	}
+	close(q.stop)
+	delete(queues, name)
+	spoolMutex.Unlock()
+
+	// the upload in progress, if any, ends first
+	<-q.done
+	return os.RemoveAll(q.dir)
+}
+
+// changes the URL of the openPHM sink (it is added if there is none)
+func SetHTTPEndpoint(endpoint string) error {
+	dir, err := getSpoolDir()
+	if err != nil {
+		return err
+	}
+
+	sinksMutex.Lock()
+	defer sinksMutex.Unlock()
+	spoolMutex.Lock()
+	defer spoolMutex.Unlock()
+	err = model.SetGatewayHTTPEndpoint(Gateway, endpoint)
+	if err != nil {
+		return err
+	}
+	for _, s := range model.GetGatewaySinks(Gateway) {
+		if _, exists := queues[s.Name]; !exists && uploaderStarted {
+			err = startQueue(dir, s.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// upload queue of every sink by sink name
+func GetSpoolStatus() (map[string]model.SpoolStatus, error) {
+	spoolMutex.Lock()
+	defer spoolMutex.Unlock()
+	statuses := map[string]model.SpoolStatus{}
+	for name, q := range queues {
+		statuses[name] = q.status
+	}
+	return statuses, nil
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+)
+
+// starts the upload queue of a single sink
+func newTestSpool(t *testing.T, sinkType string, url string) *uploadQueue {
+	t.Helper()
+	dir := t.TempDir()
+	model.SetConfigDir(dir)
+	Gateway = &model.Gateway{Id: "test", Sinks: []model.Sink{{Name: "test", Type: sinkType, URL: url}}}
+	t.Cleanup(func() {
+		spoolMutex.Lock()
+		stopped := []*uploadQueue{}
+		for name, q := range queues {
+			close(q.stop)
+			delete(queues, name)
+			stopped = append(stopped, q)
+		}
+		uploaderStarted = false
+		spoolMutex.Unlock()
+		for _, q := range stopped {
+			<-q.done
+		}
+		model.SetConfigDir("")
+	})
+
+	err := startUploader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spoolMutex.Lock()
+	defer spoolMutex.Unlock()
+	return queues["test"]
+}
+
+func waitForEmptySpool(t *testing.T) model.SpoolStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		statuses, err := GetSpoolStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if statuses["test"].Batches == 0 {
+			return statuses["test"]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the spool was not emptied")
+	return model.SpoolStatus{}
+}
+
+func TestSpoolRejectedBatchIsDeadLettered(t *testing.T) {
+	var received []string
+	var receivedMutex sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "invalid") {
+			http.Error(w, "invalid measurement", http.StatusBadRequest)
+			return
+		}
+		receivedMutex.Lock()
+		received = append(received, string(body))
+		receivedMutex.Unlock()
+	}))
+	defer ts.Close()
+	q := newTestSpool(t, "http", ts.URL)
+
+	for _, batch := range []string{`[{"a":"invalid"}]`, `[{"a":"valid"}]`} {
+		err := spoolMeasurements([]byte(batch))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	status := waitForEmptySpool(t)
+
+	if status.Failed != 1 || status.Bytes != 0 {
+		t.Errorf("expected 1 rejected batch and an empty queue, got %+v", status)
+	}
+	failed, err := os.ReadDir(path.Join(q.dir, model.DEAD_LETTER_PATH))
+	if err != nil || len(failed) != 1 {
+		t.Fatal("the rejected batch is not in the dead letter directory")
+	}
+	receivedMutex.Lock()
+	if len(received) != 1 || !strings.Contains(received[0], "valid") {
+		t.Error("the batch after the rejected one was not uploaded")
+	}
+	receivedMutex.Unlock()
+
+	info, err := os.Stat(q.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != DATA_DIR_MODE {
+		t.Errorf("spool directory created with mode %o", info.Mode().Perm())
+	}
+}
+
+// a sink that is down keeps the batches, counted without listing the files
+func TestSpoolCountsBatches(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	q := newTestSpool(t, "http", ts.URL)
+
+	batch := []byte(`[{"a":"valid"}]`)
+	for i := 0; i < 3; i++ {
+		err := spoolMeasurements(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	statuses, err := GetSpoolStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses["test"].Batches != 3 || statuses["test"].Bytes != int64(3*len(batch)) || statuses["test"].Failed != 0 {
+		t.Errorf("expected 3 batches of %d bytes, got %+v", len(batch), statuses["test"])
+	}
+	files, err := listSpool(q.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("expected 3 spooled files, got %d", len(files))
+	}
+	for _, f := range files {
+		info, err := os.Stat(path.Join(q.dir, f.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != DATA_FILE_MODE {
+			t.Errorf("spool file created with mode %o", info.Mode().Perm())
+		}
+	}
+}
+
+// a batch the gateway itself can't decode is not retried forever, the
+// batches after it are uploaded
+func TestSpoolCorruptBatchIsDeadLettered(t *testing.T) {
+	out := t.TempDir()
+	q := newTestSpool(t, "file", out)
+
+	for _, batch := range []string{`[{"a":`, `[{"a":"valid"}]`} {
+		err := spoolMeasurements([]byte(batch))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	status := waitForEmptySpool(t)
+
+	if status.Failed != 1 {
+		t.Errorf("expected 1 rejected batch, got %+v", status)
+	}
+	failed, err := os.ReadDir(path.Join(q.dir, model.DEAD_LETTER_PATH))
+	if err != nil || len(failed) != 1 {
+		t.Fatal("the corrupt batch is not in the dead letter directory")
+	}
+	written, err := os.ReadDir(out)
+	if err != nil || len(written) != 1 {
+		t.Fatal("the batch after the corrupt one was not written")
+	}
+}
+
+func TestLocalErrorsArePermanent(t *testing.T) {
+	gateway := &model.Gateway{Id: "test"}
+	for _, sinkType := range []string{"openphm", "http", "mqtt", "influx", "file"} {
+		sink, err := getSink(model.Sink{Name: "test", Type: sinkType, URL: "http://127.0.0.1:1"}, gateway)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sink.send([]byte(`[{"a":`))
+		if !isPermanent(err) {
+			t.Errorf("%s: a corrupt batch is retried (%v)", sinkType, err)
+		}
+	}
+
+	// a time that can't be parsed
+	sink, _ := getSink(model.Sink{Name: "test", Type: "influx", URL: "http://127.0.0.1:1"}, gateway)
+	err := sink.send([]byte(`[{"sensor_id":"5E:00:00:00:00:01","time":"yesterday","raw_data":1}]`))
+	if !isPermanent(err) {
+		t.Errorf("influx: a batch with an invalid time is retried (%v)", err)
+	}
+}
+
+// the queue of a removed sink stops before its directory is deleted, a sink
+// added again with the same name starts from an empty queue
+func TestRemoveSinkWaitsForUpload(t *testing.T) {
+	uploading := make(chan bool)
+	release := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case uploading <- true:
+			<-release
+		default:
+		}
+	}))
+	defer ts.Close()
+	q := newTestSpool(t, "http", ts.URL)
+
+	err := spoolMeasurements([]byte(`[{"a":"valid"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-uploading
+
+	removed := make(chan error)
+	go func() { removed <- RemoveSink("test") }()
+	select {
+	case <-removed:
+		t.Fatal("the sink was removed during an upload")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	err = <-removed
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-q.done:
+	default:
+		t.Fatal("the queue of the removed sink is still running")
+	}
+	if _, err := os.Stat(q.dir); !os.IsNotExist(err) {
+		t.Error("the queue of the removed sink was not deleted")
+	}
+
+	err = AddSink(model.Sink{Name: "test", Type: "http", URL: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := GetSpoolStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses["test"].Batches != 0 {
+		t.Errorf("expected an empty queue, got %+v", statuses["test"])
+	}
+}
@@ -0,0 +1,326 @@
+package simulator
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+	"github.com/jukuly/ss_machmos/server/internal/server"
+	"github.com/jukuly/ss_machmos/server/internal/transport"
+)
+
+const COLLECTION_CAPACITY = 1000000
+const PAIRING_TIMEOUT = 30 * time.Second
+const CHUNK_SIZE = 512 - 18 // maximum length of a characteristic value minus the chunk header
+
+type setting struct {
+	active            bool
+	samplingFrequency uint32
+	samplingDuration  uint16
+}
+
+// sensor is the Go version of the firmware described in sensor_pseudo_code
+type sensor struct {
+	mac          [6]byte
+	version      byte // protocol version
+	algorithm    string
+	key          crypto.Signer
+	ble          *transport.Memory
+	dataChar     [4]uint32
+	settingsChar [4]uint32
+	settings     map[byte]setting
+	nextWakeUp   time.Duration
+	batteryLevel float64
+	signal       *waveform
+	messageId    uint32
+	counter      uint32
+	compact      bool    // send vibration data with the compact encoding
+	scale        float64 // G per unit of the compact encoding, given by the gateway
+}
+
+func newSensor(index int, ble *transport.Memory) (*sensor, error) {
+	// every fourth sensor runs the first firmware (protocol version 1, RSA
+	// keys only), the others cycle through the key algorithms
+	var key crypto.Signer
+	var err error
+	version := server.PROTOCOL_VERSION
+	algorithm := model.KEY_ALGORITHMS[byte(index%len(model.KEY_ALGORITHMS))]
+	if index%4 == 3 {
+		version = 1
+		algorithm = model.KEY_RSA
+	}
+	switch algorithm {
+	case model.KEY_RSA:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case model.KEY_ED25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case model.KEY_P256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mac := [6]byte{0x5E, 0x00, 0x00, 0x00, 0x00, 0x00}
+	binary.BigEndian.PutUint32(mac[2:], uint32(index+1))
+
+	return &sensor{
+		mac:          mac,
+		version:      version,
+		algorithm:    algorithm,
+		key:          key,
+		ble:          ble,
+		settings:     map[byte]setting{},
+		batteryLevel: 100,
+		signal:       newWaveform(),
+		compact:      version >= 2, // mandatory from version 2
+		scale:        model.DEFAULT_VIBRATION_SCALE,
+	}, nil
+}
+
+func (s *sensor) name() string {
+	return model.MacToString(s.mac)
+}
+
+func (s *sensor) sign(message []byte) ([]byte, error) {
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		hash := sha256.Sum256(message)
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, message), nil
+	case *ecdsa.PrivateKey:
+		hash := sha256.Sum256(message)
+		r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+		if err != nil {
+			return nil, err
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature, nil
+	}
+	return nil, errors.New("unsupported key")
+}
+
+// version 1 sensors only send a PEM encoded RSA key, the others send the
+// protocol version and the key algorithm followed by the raw key (PEM for RSA)
+func (s *sensor) serializePublicKey() ([]byte, error) {
+	switch key := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+		encoded := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+		if s.version == 1 {
+			return encoded, nil
+		}
+		return append([]byte{s.version, 0x00}, encoded...), nil
+	case ed25519.PublicKey:
+		return append([]byte{s.version, 0x01}, key...), nil
+	case *ecdsa.PublicKey:
+		return append([]byte{s.version, 0x02}, elliptic.Marshal(elliptic.P256(), key.X, key.Y)...), nil
+	}
+	return nil, errors.New("unsupported key")
+}
+
+// see protocol.md to understand what is going on here
+func (s *sensor) pair() error {
+	publicKey, err := s.serializePublicKey()
+	if err != nil {
+		return err
+	}
+	request := append([]byte{0x00}, s.mac[:]...)
+	request = append(request, 0b00000111)
+	request = binary.LittleEndian.AppendUint32(request, COLLECTION_CAPACITY)
+	request = append(request, publicKey...)
+	err = s.ble.ClientWrite(server.PAIR_REQUEST_CHARACTERISTIC_UUID, request)
+	if err != nil {
+		return err
+	}
+
+	// the user accepts the request on the gateway
+	server.Pair(s.mac)
+
+	var res []byte
+	deadline := time.Now().Add(PAIRING_TIMEOUT)
+	for {
+		res, err = s.ble.Read(server.PAIR_RESPONSE_CHARACTERISTIC_UUID)
+		if err != nil {
+			return err
+		}
+		if len(res) >= 39 && [6]byte(res[1:7]) == s.mac {
+			break
+		}
+		if time.Now().After(deadline) {
+			return errors.New("pairing response timed out")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// the gateway answers with the version both of us support
+	if len(res) > 39 {
+		s.version = res[39]
+	} else {
+		s.version = 1
+	}
+	s.dataChar = model.BytesToUuid([16]byte(res[7:23]))
+	s.settingsChar = model.BytesToUuid([16]byte(res[23:39]))
+
+	confirmation := append([]byte{0x00}, s.mac[:]...)
+	confirmation = append(confirmation, res[7:39]...)
+	signature, err := s.sign(confirmation)
+	if err != nil {
+		return err
+	}
+	return s.ble.ClientWrite(server.PAIR_RESPONSE_CHARACTERISTIC_UUID, append(confirmation, signature...))
+}
+
+// see protocol.md to understand what is going on here
+func (s *sensor) fetchSettings() error {
+	for i := 0; ; i++ {
+		err := s.ble.ClientWrite(s.settingsChar, append([]byte{0x00}, s.mac[:]...))
+		if err != nil {
+			return err
+		}
+
+		for j := 0; j < 10+i*10; j++ {
+			res, err := s.ble.Read(s.settingsChar)
+			if err != nil {
+				return err
+			}
+			if len(res) >= 11 && res[0] == 0x01 && [6]byte(res[1:7]) == s.mac {
+				s.parseSettings(res[7:])
+				return nil
+			}
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func (s *sensor) parseSettings(res []byte) {
+	s.nextWakeUp = time.Duration(binary.LittleEndian.Uint32(res[0:4])) * time.Millisecond
+	res = res[4:]
+	if s.version >= 2 && len(res) >= 4 {
+		counter := binary.LittleEndian.Uint32(res[0:4])
+		if counter > s.counter {
+			s.counter = counter
+		}
+		res = res[4:]
+	}
+	if s.version >= 2 && len(res) >= 4 {
+		scale := float64(math.Float32frombits(binary.LittleEndian.Uint32(res[0:4])))
+		if scale > 0 {
+			s.scale = scale
+		}
+		res = res[4:]
+	}
+
+	s.settings = map[byte]setting{}
+	for i := 0; i+8 <= len(res); i += 8 {
+		s.settings[res[i]] = setting{
+			active:            res[i+1] == 0x01,
+			samplingFrequency: binary.LittleEndian.Uint32(res[i+2 : i+6]),
+			samplingDuration:  binary.LittleEndian.Uint16(res[i+6 : i+8]),
+		}
+	}
+}
+
+// see protocol.md to understand what is going on here
+func (s *sensor) collectAndSendData() error {
+	s.batteryLevel -= 0.05
+	if s.batteryLevel < 0 {
+		s.batteryLevel = 100
+	}
+
+	message := append([]byte{0x00}, s.mac[:]...)
+	if s.version >= 2 {
+		s.counter++
+		message = binary.LittleEndian.AppendUint32(message, s.counter)
+	}
+	message = append(message, byte(int8(s.batteryLevel)))
+	now := time.Now()
+	for dataType, setting := range s.settings {
+		if !setting.active {
+			continue
+		}
+		var data []byte
+		switch dataType {
+		case 0x00:
+			data = s.signal.vibration(now, setting.samplingFrequency, setting.samplingDuration, s.compact, s.scale)
+		case 0x01:
+			data = s.signal.audio(now, setting.samplingFrequency, setting.samplingDuration)
+		case 0x02:
+			data = s.signal.temperature(now)
+		}
+		if len(data) == 0 {
+			continue
+		}
+		if dataType == 0x00 && s.compact {
+			message = append(message, dataType|0x80)
+		} else {
+			message = append(message, dataType)
+		}
+		message = binary.LittleEndian.AppendUint32(message, setting.samplingFrequency)
+		message = binary.LittleEndian.AppendUint32(message, uint32(len(data)))
+		message = append(message, data...)
+	}
+
+	signature, err := s.sign(message)
+	if err != nil {
+		return err
+	}
+	if s.version == 1 {
+		return s.ble.ClientWrite(s.dataChar, append(message, signature...))
+	}
+	return s.sendChunks(append(message[7:], signature...))
+}
+
+// see protocol.md to understand what is going on here
+func (s *sensor) sendChunks(content []byte) error {
+	s.messageId = (s.messageId + 1) & 0xFFFFFF
+	for offset := 0; offset < len(content); offset += CHUNK_SIZE {
+		end := offset + CHUNK_SIZE
+		if end > len(content) {
+			end = len(content)
+		}
+		chunk := append([]byte{0x00}, s.mac[:]...)
+		chunk = append(chunk, byte(s.messageId), byte(s.messageId>>8), byte(s.messageId>>16))
+		chunk = binary.LittleEndian.AppendUint32(chunk, uint32(offset))
+		chunk = binary.LittleEndian.AppendUint32(chunk, uint32(len(content)))
+		chunk = append(chunk, content[offset:end]...)
+		err := s.ble.ClientWrite(s.dataChar, chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// main loop of the sensor (wait, fetch settings, send data)
+func (s *sensor) run() {
+	for {
+		time.Sleep(s.nextWakeUp)
+		err := s.fetchSettings()
+		if err != nil {
+			out.Logger.Println("Error: simulated sensor "+s.name()+":", err)
+			return
+		}
+		err = s.collectAndSendData()
+		if err != nil {
+			out.Logger.Println("Error: simulated sensor "+s.name()+":", err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package simulator
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+	"github.com/jukuly/ss_machmos/server/internal/server"
+	"github.com/jukuly/ss_machmos/server/internal/transport"
+)
+
+var received atomic.Int64
+
+// Run pairs count virtual sensors with the gateway, one after the other like
+// a user would, and starts their main loop. The server must already be
+// initialized with ble and advertising.
+func Run(ble *transport.Memory, count int, wakeUpInterval int, wakeUpIntervalMaxOffset int) {
+	server.EnablePairing()
+	defer server.DisablePairing()
+
+	for i := 0; i < count; i++ {
+		s, err := newSensor(i, ble)
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			continue
+		}
+
+		err = s.pair()
+		if err != nil {
+			out.Logger.Println("Error: simulated sensor "+s.name()+" failed to pair:", err)
+			continue
+		}
+
+		// the max offset must always be smaller than the wake up interval
+		err = model.UpdateSensorSetting(s.mac, "wake_up_interval_max_offset", "0", server.Sensors, server.Profiles)
+		if err == nil {
+			err = model.UpdateSensorSetting(s.mac, "wake_up_interval", strconv.Itoa(wakeUpInterval), server.Sensors, server.Profiles)
+		}
+		if err == nil {
+			err = model.UpdateSensorSetting(s.mac, "wake_up_interval_max_offset", strconv.Itoa(wakeUpIntervalMaxOffset), server.Sensors, server.Profiles)
+		}
+		if err != nil {
+			out.Logger.Println("Error:", err)
+		}
+
+		err = s.fetchSettings()
+		if err != nil {
+			out.Logger.Println("Error: simulated sensor "+s.name()+":", err)
+			continue
+		}
+		go s.run()
+	}
+	out.Logger.Println("Simulation: " + strconv.Itoa(count) + " sensors started")
+}
+
+// StartEndpoint starts a local stand-in for openPHM that accepts every
+// upload and returns its URL.
+func StartEndpoint() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gateway_data", func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			GatewayId    string            `json:"gateway_id"`
+			Measurements []json.RawMessage `json:"measurements"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		total := received.Add(int64(len(body.Measurements)))
+		out.Logger.Println("Simulated endpoint received " + strconv.Itoa(len(body.Measurements)) + " measurements from gateway " + body.GatewayId + " (" + strconv.FormatInt(total, 10) + " in total)")
+	})
+	go http.Serve(listener, mux)
+
+	return "http://" + listener.Addr().String() + "/gateway_data", nil
+}
@@ -0,0 +1,63 @@
+package simulator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/server"
+	"github.com/jukuly/ss_machmos/server/internal/transport"
+)
+
+// the virtual sensors pair through the in-memory transport (every key
+// algorithm and a version 1 sensor) and their measurements reach the
+// simulated endpoint
+func TestRun(t *testing.T) {
+	model.SetConfigDir(t.TempDir())
+	t.Cleanup(func() { model.SetConfigDir("") })
+
+	endpoint, err := StartEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := &model.Gateway{Id: "simulation", Sinks: []model.Sink{{Name: "openphm", Type: "openphm", URL: endpoint}}}
+	ble := transport.NewMemory()
+	err = server.Init(model.NewSensorRegistry(model.SENSORS_FILE), model.NewGroupRegistry(model.GROUPS_FILE), model.NewProfileRegistry(model.PROFILES_FILE), gateway, ble)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.StartAdvertising()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := len(model.KEY_ALGORITHMS) + 1
+	Run(ble, count, 2, 1)
+
+	sensors := server.Sensors.List()
+	if len(sensors) != count {
+		t.Fatalf("expected %d paired sensors, got %d", count, len(sensors))
+	}
+	algorithms := map[string]bool{}
+	versions := map[byte]bool{}
+	for _, sensor := range sensors {
+		algorithms[sensor.PublicKey.Algorithm] = true
+		versions[sensor.GetProtocolVersion()] = true
+		if sensor.WakeUpInterval != 2 || sensor.WakeUpIntervalMaxOffset != 1 {
+			t.Errorf("sensor %s: the wake up interval was not set", model.MacToString(sensor.Mac))
+		}
+	}
+	if len(algorithms) != len(model.KEY_ALGORITHMS) || !versions[1] || !versions[server.PROTOCOL_VERSION] {
+		t.Errorf("expected every key algorithm and protocol version, got %v and %v", algorithms, versions)
+	}
+
+	// battery, temperature, audio and vibration (3 axes) per wake up
+	expected := int64(6 * count)
+	deadline := time.Now().Add(30 * time.Second)
+	for received.Load() < expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected at least %d measurements uploaded, got %d", expected, received.Load())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
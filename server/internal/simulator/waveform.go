@@ -0,0 +1,97 @@
+package simulator
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// waveform generates plausible signals for a rotating machine: a shaft
+// frequency with a couple of harmonics for vibration, a tone and its
+// harmonics over background noise for audio and a slowly drifting temperature.
+type waveform struct {
+	shaftFrequency float64 // Hz
+	amplitude      float64 // G
+	toneFrequency  float64 // Hz
+	baseTemp       float64 // °C
+	random         *rand.Rand
+}
+
+func newWaveform() *waveform {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return &waveform{
+		shaftFrequency: 10 + random.Float64()*15,
+		amplitude:      0.2 + random.Float64()*0.8,
+		toneFrequency:  100 + random.Float64()*400,
+		baseTemp:       20 + random.Float64()*30,
+		random:         random,
+	}
+}
+
+// 3 axes, float32 per axis in G or, if compact, the scale followed by an
+// int16 per axis in units of the scale
+func (w *waveform) vibration(start time.Time, samplingFrequency uint32, samplingDuration uint16, compact bool, scale float64) []byte {
+	n := int(samplingFrequency) * int(samplingDuration)
+	data := make([]byte, 0, n*12)
+	if compact {
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(float32(scale)))
+	}
+	t0 := float64(start.UnixNano()) / 1e9
+	for i := 0; i < n; i++ {
+		t := t0 + float64(i)/float64(samplingFrequency)
+		phase := 2 * math.Pi * w.shaftFrequency * t
+		x := w.amplitude*math.Sin(phase) + 0.3*w.amplitude*math.Sin(2*phase) + w.noise(0.05)
+		y := w.amplitude*math.Cos(phase) + 0.1*w.amplitude*math.Sin(3*phase) + w.noise(0.05)
+		z := 1 + 0.1*w.amplitude*math.Sin(phase) + w.noise(0.02)
+		if compact {
+			data = binary.LittleEndian.AppendUint16(data, compactSample(x, scale))
+			data = binary.LittleEndian.AppendUint16(data, compactSample(y, scale))
+			data = binary.LittleEndian.AppendUint16(data, compactSample(z, scale))
+			continue
+		}
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(float32(x)))
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(float32(y)))
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(float32(z)))
+	}
+	return data
+}
+
+// clipped like the accelerometer does when the scale is too small
+func compactSample(value float64, scale float64) uint16 {
+	return uint16(int16(math.Max(-32768, math.Min(32767, value/scale))))
+}
+
+// 24 bit signed PCM
+func (w *waveform) audio(start time.Time, samplingFrequency uint32, samplingDuration uint16) []byte {
+	n := int(samplingFrequency) * int(samplingDuration)
+	data := make([]byte, 0, n*3)
+	t0 := float64(start.UnixNano()) / 1e9
+	for i := 0; i < n; i++ {
+		t := t0 + float64(i)/float64(samplingFrequency)
+		phase := 2 * math.Pi * w.toneFrequency * t
+		value := 0.4*math.Sin(phase) + 0.15*math.Sin(2*phase) + 0.05*math.Sin(3*phase) + w.noise(0.05)
+		sample := int32(math.Max(-1, math.Min(1, value)) * 8388607)
+		data = append(data, byte(sample), byte(sample>>8), byte(sample>>16))
+	}
+	return data
+}
+
+// raw ADC value of the RTD (see parseTemperatureData in the server)
+func (w *waveform) temperature(now time.Time) []byte {
+	const A = 3.9083e-3
+	const B = -5.775e-7
+
+	hours := float64(now.UnixNano()) / 1e9 / 3600
+	temperature := w.baseTemp + 3*math.Sin(2*math.Pi*hours/24) + w.noise(0.1)
+	if temperature < 0 {
+		temperature = 0
+	}
+	resistance := 1000 * (1 + A*temperature + B*temperature*temperature)
+	adc := resistance / 1500 * (math.Pow(2, 15) - 1)
+	return binary.LittleEndian.AppendUint16([]byte{}, uint16(adc))
+}
+
+func (w *waveform) noise(amplitude float64) float64 {
+	return w.random.NormFloat64() * amplitude
+}
@@ -0,0 +1,319 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+)
+
+// Every series (sensor, measurement type and axis) is stored in its own
+// directory with one file per day (UTC):
+//   data/<mac>/<type>[_<axis>]/<yyyy-mm-dd>.bin
+// Each file is a sequence of records:
+//   time in ns since epoch (8 bytes) | sampling frequency (4 bytes) | number of samples (4 bytes) | samples (float32, 4 bytes each)
+// All values are little endian. A record left incomplete by a crash is cut
+// off the file before the next one is appended. The day files older than
+// the retention of the gateway are deleted (see Prune).
+
+const DATA_PATH = "data"
+const DAY_FORMAT = "2006-01-02"
+const RECORD_HEADER_SIZE = 16
+
+// the measurements are only readable by the user running the server
+const DIR_MODE = 0700
+const FILE_MODE = 0600
+
+type Measurement struct {
+	Sensor            [6]byte
+	Type              string
+	Axis              string
+	Time              time.Time
+	SamplingFrequency uint32
+	Samples           []float32
+}
+
+var mutex sync.RWMutex
+
+// the files checked for an incomplete record since the server started
+var checkedFiles = map[string]bool{}
+
+func getSeriesPath(sensor [6]byte, dataType string, axis string) (string, error) {
+	configPath, err := model.GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	series := dataType
+	if axis != "" {
+		series += "_" + axis
+	}
+	return path.Join(configPath, DATA_PATH, strings.ReplaceAll(model.MacToString(sensor), ":", ""), series), nil
+}
+
+func Append(measurement Measurement) error {
+	if measurement.Type == "" || strings.ContainsAny(measurement.Type+measurement.Axis, "/_.") {
+		return errors.New("invalid measurement type or axis")
+	}
+	seriesPath, err := getSeriesPath(measurement.Sensor, measurement.Type, measurement.Axis)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, 0, RECORD_HEADER_SIZE+4*len(measurement.Samples))
+	record = binary.LittleEndian.AppendUint64(record, uint64(measurement.Time.UnixNano()))
+	record = binary.LittleEndian.AppendUint32(record, measurement.SamplingFrequency)
+	record = binary.LittleEndian.AppendUint32(record, uint32(len(measurement.Samples)))
+	for _, sample := range measurement.Samples {
+		record = binary.LittleEndian.AppendUint32(record, math.Float32bits(sample))
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	err = os.MkdirAll(seriesPath, DIR_MODE)
+	if err != nil {
+		return err
+	}
+	fileName := path.Join(seriesPath, measurement.Time.UTC().Format(DAY_FORMAT)+".bin")
+	if !checkedFiles[fileName] {
+		err = truncateIncompleteRecord(fileName)
+		if err != nil {
+			return err
+		}
+		checkedFiles[fileName] = true
+	}
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, FILE_MODE)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(record)
+	if err != nil {
+		// part of the record may have been written
+		delete(checkedFiles, fileName)
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// truncateIncompleteRecord cuts the file after its last complete record,
+// mutex must be held
+func truncateIncompleteRecord(fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+	var end int64
+	header := make([]byte, RECORD_HEADER_SIZE)
+	for end+RECORD_HEADER_SIZE <= size {
+		_, err = file.ReadAt(header, end)
+		if err != nil {
+			return err
+		}
+		recordSize := RECORD_HEADER_SIZE + 4*int64(binary.LittleEndian.Uint32(header[12:16]))
+		if end+recordSize > size {
+			break
+		}
+		end += recordSize
+	}
+	if end == size {
+		return nil
+	}
+	return file.Truncate(end)
+}
+
+// Prune deletes the day files of every series that end before the given
+// time, and the series and sensors left without any
+func Prune(before time.Time) (int, error) {
+	configPath, err := model.GetConfigDir()
+	if err != nil {
+		return 0, err
+	}
+	dataPath := path.Join(configPath, DATA_PATH)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	sensors, err := os.ReadDir(dataPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, sensor := range sensors {
+		if !sensor.IsDir() {
+			continue
+		}
+		sensorPath := path.Join(dataPath, sensor.Name())
+		series, err := os.ReadDir(sensorPath)
+		if err != nil {
+			return removed, err
+		}
+		for _, s := range series {
+			if !s.IsDir() {
+				continue
+			}
+			seriesPath := path.Join(sensorPath, s.Name())
+			files, err := os.ReadDir(seriesPath)
+			if err != nil {
+				return removed, err
+			}
+			for _, f := range files {
+				day, err := time.Parse(DAY_FORMAT, strings.TrimSuffix(f.Name(), ".bin"))
+				if err != nil || day.Add(24*time.Hour).After(before) {
+					continue
+				}
+				err = os.Remove(path.Join(seriesPath, f.Name()))
+				if err != nil {
+					return removed, err
+				}
+				delete(checkedFiles, path.Join(seriesPath, f.Name()))
+				removed++
+			}
+			// fails if the directory is not empty
+			os.Remove(seriesPath)
+		}
+		os.Remove(sensorPath)
+	}
+	return removed, nil
+}
+
+// Query returns the measurements of a given type (every axis) recorded by
+// the sensor between from (included) and to (excluded), sorted by time
+func Query(sensor [6]byte, dataType string, from time.Time, to time.Time) ([]Measurement, error) {
+	typePath, err := getSeriesPath(sensor, dataType, "")
+	if err != nil {
+		return nil, err
+	}
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	series, err := os.ReadDir(path.Dir(typePath))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Measurement{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	measurements := []Measurement{}
+	for _, s := range series {
+		name := s.Name()
+		if !s.IsDir() || (name != dataType && !strings.HasPrefix(name, dataType+"_")) {
+			continue
+		}
+		axis := strings.TrimPrefix(strings.TrimPrefix(name, dataType), "_")
+
+		files, err := os.ReadDir(path.Join(path.Dir(typePath), name))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			day, err := time.Parse(DAY_FORMAT, strings.TrimSuffix(f.Name(), ".bin"))
+			if err != nil || !day.Before(to) || !day.Add(24*time.Hour).After(from) {
+				continue
+			}
+			m, err := readFile(path.Join(path.Dir(typePath), name, f.Name()), from, to)
+			if err != nil {
+				return nil, err
+			}
+			for i := range m {
+				m[i].Sensor = sensor
+				m[i].Type = dataType
+				m[i].Axis = axis
+			}
+			measurements = append(measurements, m...)
+		}
+	}
+
+	sort.SliceStable(measurements, func(i, j int) bool {
+		if measurements[i].Time.Equal(measurements[j].Time) {
+			return measurements[i].Axis < measurements[j].Axis
+		}
+		return measurements[i].Time.Before(measurements[j].Time)
+	})
+	return measurements, nil
+}
+
+func readFile(fileName string, from time.Time, to time.Time) ([]Measurement, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	remaining := info.Size()
+	reader := bufio.NewReader(file)
+
+	measurements := []Measurement{}
+	header := make([]byte, RECORD_HEADER_SIZE)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err == io.EOF {
+			return measurements, nil
+		}
+		if err != nil {
+			// a partially written record at the end of the file is ignored
+			if err == io.ErrUnexpectedEOF {
+				return measurements, nil
+			}
+			return nil, err
+		}
+		t := time.Unix(0, int64(binary.LittleEndian.Uint64(header[0:8]))).UTC()
+		samplingFrequency := binary.LittleEndian.Uint32(header[8:12])
+		numberOfSamples := binary.LittleEndian.Uint32(header[12:16])
+		remaining -= RECORD_HEADER_SIZE + 4*int64(numberOfSamples)
+		// a partially written (or corrupt) record at the end of the file
+		if remaining < 0 {
+			return measurements, nil
+		}
+
+		if t.Before(from) || !t.Before(to) {
+			_, err = reader.Discard(int(numberOfSamples) * 4)
+			if err != nil {
+				return measurements, nil
+			}
+			continue
+		}
+
+		data := make([]byte, int(numberOfSamples)*4)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return measurements, nil
+		}
+		samples := make([]float32, numberOfSamples)
+		for i := range samples {
+			samples[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[i*4 : i*4+4]))
+		}
+		measurements = append(measurements, Measurement{
+			Time:              t,
+			SamplingFrequency: samplingFrequency,
+			Samples:           samples,
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+)
+
+var testSensor = [6]byte{0x5E, 0, 0, 0, 0, 1}
+
+func setTestConfigDir(t *testing.T) {
+	t.Helper()
+	model.SetConfigDir(t.TempDir())
+	t.Cleanup(func() {
+		model.SetConfigDir("")
+		mutex.Lock()
+		checkedFiles = map[string]bool{}
+		mutex.Unlock()
+	})
+}
+
+func getTestFile(t *testing.T, day time.Time) string {
+	t.Helper()
+	seriesPath, err := getSeriesPath(testSensor, "temperature", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path.Join(seriesPath, day.UTC().Format(DAY_FORMAT)+".bin")
+}
+
+func appendTest(t *testing.T, at time.Time, samples ...float32) {
+	t.Helper()
+	err := Append(Measurement{Sensor: testSensor, Type: "temperature", Time: at, Samples: samples})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func queryDay(t *testing.T, day time.Time) []Measurement {
+	t.Helper()
+	measurements, err := Query(testSensor, "temperature", day, day.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return measurements
+}
+
+// a crash while appending leaves part of a record, the next records must
+// still be readable
+func TestAppendTruncatesIncompleteRecord(t *testing.T) {
+	setTestConfigDir(t)
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	appendTest(t, day.Add(time.Hour), 1, 2)
+	fileName := getTestFile(t, day)
+
+	// the header of a 10 samples record and 2 of its samples
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := make([]byte, RECORD_HEADER_SIZE+8)
+	torn[12] = 10
+	file.Write(torn)
+	file.Close()
+	// as if the server restarted
+	mutex.Lock()
+	checkedFiles = map[string]bool{}
+	mutex.Unlock()
+
+	appendTest(t, day.Add(2*time.Hour), 3)
+	measurements := queryDay(t, day)
+	if len(measurements) != 2 || len(measurements[1].Samples) != 1 || measurements[1].Samples[0] != 3 {
+		t.Fatalf("expected the records before and after the incomplete one, got %+v", measurements)
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 2*RECORD_HEADER_SIZE+3*4 {
+		t.Errorf("the incomplete record was not removed (file of %d bytes)", info.Size())
+	}
+	if info.Mode().Perm() != FILE_MODE {
+		t.Errorf("file created with mode %o", info.Mode().Perm())
+	}
+	info, err = os.Stat(path.Dir(fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != DIR_MODE {
+		t.Errorf("directory created with mode %o", info.Mode().Perm())
+	}
+}
+
+// a corrupt number of samples must not be allocated
+func TestQueryStopsAtInvalidSampleCount(t *testing.T) {
+	setTestConfigDir(t)
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	appendTest(t, day.Add(time.Hour), 1)
+	appendTest(t, day.Add(2*time.Hour), 2)
+
+	file, err := os.OpenFile(getTestFile(t, day), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// number of samples of the second record
+	file.WriteAt([]byte{0xFF, 0xFF, 0xFF, 0xFF}, RECORD_HEADER_SIZE+4+12)
+	file.Close()
+
+	measurements := queryDay(t, day)
+	if len(measurements) != 1 || measurements[0].Samples[0] != 1 {
+		t.Errorf("expected only the first record, got %+v", measurements)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	setTestConfigDir(t)
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	for day := 0; day < 10; day++ {
+		appendTest(t, now.AddDate(0, 0, -day), float32(day))
+	}
+
+	// the day files ending before 3 days ago, from 4 days ago
+	removed, err := Prune(now.AddDate(0, 0, -3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 6 {
+		t.Errorf("expected 6 day files removed, got %d", removed)
+	}
+	measurements, err := Query(testSensor, "temperature", time.Time{}, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(measurements) != 4 || !measurements[0].Time.Equal(now.AddDate(0, 0, -3)) {
+		t.Errorf("expected the measurements of the last 4 days, got %d", len(measurements))
+	}
+
+	_, err = Prune(now.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath, _ := model.GetConfigDir()
+	sensors, err := os.ReadDir(path.Join(configPath, DATA_PATH))
+	if err != nil || len(sensors) != 0 {
+		t.Error("the directory of a sensor without measurements was not removed")
+	}
+}
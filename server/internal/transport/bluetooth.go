@@ -0,0 +1,88 @@
+package transport
+
+import (
+	"errors"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// Bluetooth is the Transport backed by the system adapter (BlueZ on linux).
+type Bluetooth struct {
+	adapter *bluetooth.Adapter
+	handles map[[4]uint32]*bluetooth.Characteristic
+}
+
+func NewBluetooth() *Bluetooth {
+	return &Bluetooth{
+		adapter: bluetooth.DefaultAdapter,
+		handles: make(map[[4]uint32]*bluetooth.Characteristic),
+	}
+}
+
+func (b *Bluetooth) Enable() error {
+	return b.adapter.Enable()
+}
+
+func (b *Bluetooth) AddService(uuid [4]uint32, characteristics []Characteristic) error {
+	service := bluetooth.Service{
+		UUID:            uuid,
+		Characteristics: make([]bluetooth.CharacteristicConfig, len(characteristics)),
+	}
+	for i, c := range characteristics {
+		handle := &bluetooth.Characteristic{}
+		b.handles[c.UUID] = handle
+		writeEvent := c.WriteEvent
+		service.Characteristics[i] = bluetooth.CharacteristicConfig{
+			Handle: handle,
+			UUID:   c.UUID,
+			Value:  []byte{},
+			Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission,
+			WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+				if writeEvent != nil {
+					writeEvent(value)
+				}
+			},
+		}
+	}
+	return b.adapter.AddService(&service)
+}
+
+func (b *Bluetooth) ConfigureAdvertisement(localName string, serviceUUIDs [][4]uint32) error {
+	adv := b.adapter.DefaultAdvertisement()
+	if adv == nil {
+		return errors.New("advertisement is nil")
+	}
+	uuids := make([]bluetooth.UUID, len(serviceUUIDs))
+	for i, u := range serviceUUIDs {
+		uuids[i] = u
+	}
+	return adv.Configure(bluetooth.AdvertisementOptions{
+		LocalName:    localName,
+		ServiceUUIDs: uuids,
+	})
+}
+
+func (b *Bluetooth) StartAdvertising() error {
+	adv := b.adapter.DefaultAdvertisement()
+	if adv == nil {
+		return errors.New("advertisement is nil")
+	}
+	return adv.Start()
+}
+
+func (b *Bluetooth) StopAdvertising() error {
+	adv := b.adapter.DefaultAdvertisement()
+	if adv == nil {
+		return errors.New("advertisement is nil")
+	}
+	return adv.Stop()
+}
+
+func (b *Bluetooth) Write(characteristic [4]uint32, value []byte) error {
+	handle, exists := b.handles[characteristic]
+	if !exists {
+		return errors.New("characteristic not found")
+	}
+	_, err := handle.Write(value)
+	return err
+}
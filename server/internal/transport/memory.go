@@ -0,0 +1,106 @@
+package transport
+
+import (
+	"errors"
+	"sync"
+)
+
+// Memory is an in-process Transport. Clients (tests, the simulator) write to
+// characteristics with ClientWrite and poll them with Read, exactly like a
+// sensor would over the air.
+type Memory struct {
+	mu          sync.Mutex
+	enabled     bool
+	advertising bool
+	values      map[[4]uint32][]byte
+	writeEvents map[[4]uint32]func(value []byte)
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		values:      make(map[[4]uint32][]byte),
+		writeEvents: make(map[[4]uint32]func(value []byte)),
+	}
+}
+
+func (m *Memory) Enable() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.enabled = true
+	return nil
+}
+
+func (m *Memory) AddService(uuid [4]uint32, characteristics []Characteristic) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.enabled {
+		return errors.New("transport is not enabled")
+	}
+	for _, c := range characteristics {
+		m.values[c.UUID] = []byte{}
+		m.writeEvents[c.UUID] = c.WriteEvent
+	}
+	return nil
+}
+
+func (m *Memory) ConfigureAdvertisement(localName string, serviceUUIDs [][4]uint32) error {
+	return nil
+}
+
+func (m *Memory) StartAdvertising() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advertising = true
+	return nil
+}
+
+func (m *Memory) StopAdvertising() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advertising = false
+	return nil
+}
+
+// Write is used by the gateway to update the value of a characteristic.
+func (m *Memory) Write(characteristic [4]uint32, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.values[characteristic]; !exists {
+		return errors.New("characteristic not found")
+	}
+	m.values[characteristic] = append([]byte{}, value...)
+	return nil
+}
+
+// ClientWrite simulates a client writing to a characteristic. The value is
+// stored and the characteristic's WriteEvent is called synchronously.
+func (m *Memory) ClientWrite(characteristic [4]uint32, value []byte) error {
+	m.mu.Lock()
+	if !m.advertising {
+		m.mu.Unlock()
+		return errors.New("gateway is not advertising")
+	}
+	writeEvent, exists := m.writeEvents[characteristic]
+	if !exists {
+		m.mu.Unlock()
+		return errors.New("characteristic not found")
+	}
+	m.values[characteristic] = append([]byte{}, value...)
+	m.mu.Unlock()
+
+	if writeEvent != nil {
+		writeEvent(value)
+	}
+	return nil
+}
+
+// Read returns a copy of the current value of a characteristic.
+func (m *Memory) Read(characteristic [4]uint32) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, exists := m.values[characteristic]
+	if !exists {
+		return nil, errors.New("characteristic not found")
+	}
+	return append([]byte{}, value...), nil
+}
@@ -0,0 +1,19 @@
+package transport
+
+// Characteristic is a GATT characteristic exposed by the gateway.
+// WriteEvent is called with the raw value every time a client writes to it.
+type Characteristic struct {
+	UUID       [4]uint32
+	WriteEvent func(value []byte)
+}
+
+// Transport abstracts the BLE peripheral the gateway runs on so that the
+// server can be driven by a real adapter or by an in-memory backend.
+type Transport interface {
+	Enable() error
+	AddService(uuid [4]uint32, characteristics []Characteristic) error
+	ConfigureAdvertisement(localName string, serviceUUIDs [][4]uint32) error
+	StartAdvertising() error
+	StopAdvertising() error
+	Write(characteristic [4]uint32, value []byte) error
+}